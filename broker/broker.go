@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// ExchangeDirect routes messages to the queues bound with their routing key
+	ExchangeDirect = "direct"
+
+	// ExchangeFanout routes messages to every queue bound to the exchange
+	ExchangeFanout = "fanout"
+)
+
+var (
+	// ErrClosed indicates that the broker, or the consumer, was closed
+	ErrClosed = errors.New("broker closed")
+
+	// ErrUnroutable indicates that a message could not be routed to any queue
+	ErrUnroutable = errors.New("message could not be routed to any queue")
+
+	// ErrUnknownDelivery indicates that a delivery was already acked, nacked or returned to its queue
+	ErrUnknownDelivery = errors.New("unknown delivery")
+)
+
+// QueueOptions defines how a queue is declared. Exclusive queues belong to their single consumer and are removed with
+// it; an empty name makes the broker generate one. Messages that stay MessageTTL in a queue, or are rejected without
+// requeueing, are dead-lettered to DeadLetterExchange with DeadLetterRoutingKey, or their own routing key if empty
+type QueueOptions struct {
+	Exclusive            bool
+	MessageTTL           time.Duration
+	DeadLetterExchange   *string
+	DeadLetterRoutingKey string
+}
+
+// Declarer creates the exchanges and queues messages travel through; declaring an existing one with the same settings
+// does nothing
+type Declarer interface {
+	DeclareExchange(name, kind string) error
+	DeclareQueue(name string, options QueueOptions) (string, error)
+	BindQueue(queue, exchange, key string) error
+}
+
+// Confirmation is the result of a published message, resolved once the broker takes responsibility for it
+type Confirmation interface {
+	Wait() error
+}
+
+// Consumer processes the messages of a queue
+type Consumer interface {
+	// Process handles every message until ctx is cancelled or the consumer is shut down, acking the ones processed
+	// successfully and nacking, retrying or dead-lettering the rest as the options of the consumer say
+	Process(ctx context.Context, handler Handler) error
+
+	// FinalAttempt indicates whether a failure processing the delivery would be the last one
+	FinalAttempt(delivery Delivery) bool
+
+	// Shutdown stops consuming, waiting for the messages being processed
+	Shutdown() error
+}
+
+// Broker routes messages published to exchanges into queues, and delivers them to consumers until they are acked;
+// messages delivered to a consumer that stops without acking them are delivered again
+type Broker interface {
+	Declarer
+
+	// Publish sends a message to an exchange; the empty exchange routes it to the queue named as the routing key
+	Publish(exchange, routingKey string, body []byte, headers map[string]interface{}) Confirmation
+
+	// Consume creates a consumer of a declared queue, identified by tag
+	Consume(queue, tag string, options ConsumerOptions) (Consumer, error)
+
+	// Close releases every resource of the broker
+	Close() error
+}
+
+// Acknowledger settles the deliveries of a consumer
+type Acknowledger interface {
+	Ack(tag uint64) error
+	Nack(tag uint64, requeue bool) error
+}
+
+// Delivery is a message received by a consumer
+type Delivery struct {
+	Body         []byte
+	Headers      map[string]interface{}
+	Exchange     string
+	RoutingKey   string
+	Redelivered  bool
+	DeliveryTag  uint64
+	Acknowledger Acknowledger
+}
+
+// Ack tells the broker that the message was processed
+func (d Delivery) Ack() error {
+	return d.Acknowledger.Ack(d.DeliveryTag)
+}
+
+// Nack tells the broker that the message could not be processed, returning it to its queue if requeue is set
+func (d Delivery) Nack(requeue bool) error {
+	return d.Acknowledger.Nack(d.DeliveryTag, requeue)
+}
+
+// resolved is a Confirmation known when the message is published
+type resolved struct {
+	err error
+}
+
+func (r resolved) Wait() error {
+	return r.err
+}
+
+// Resolved returns a Confirmation already resolved with err
+func Resolved(err error) Confirmation {
+	return resolved{err: err}
+}
+
+// WaitAll blocks until every confirmation is resolved, returning the first error found
+func WaitAll(confirmations []Confirmation) error {
+	var result error
+	for _, confirmation := range confirmations {
+		if err := confirmation.Wait(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,298 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/secrets"
+)
+
+const (
+	// AttemptsHeader carries how many times a message was processed unsuccessfully
+	AttemptsHeader = "x-attempts"
+
+	// LastErrorHeader carries the error of the last unsuccessful processing of a message
+	LastErrorHeader = "x-last-error"
+
+	// OriginalExchangeHeader carries the exchange a dead-lettered message was first published to
+	OriginalExchangeHeader = "x-original-exchange"
+
+	// OriginalRoutingKeyHeader carries the routing key a dead-lettered message was first published with
+	OriginalRoutingKeyHeader = "x-original-routing-key"
+
+	// FailedAtHeader carries the time, formatted as RFC3339, when a message was dead-lettered
+	FailedAtHeader = "x-failed-at"
+)
+
+// ConsumerOptions tunes how a consumer receives and processes messages. Prefetch bounds the messages the broker sends
+// without waiting for their acks, and defaults to twice the concurrency; Concurrency is the amount of handlers processing
+// messages at the same time, one by default; Timeout, when set, bounds the processing time of every message; Requeue
+// indicates whether failed messages are requeued instead of dropped; Retry, when set, sends failed messages through
+// delay queues and, after their last attempt, to a dead-letter queue
+type ConsumerOptions struct {
+	Prefetch    int
+	Concurrency int
+	Timeout     time.Duration
+	Requeue     bool
+	Retry       *RetryOptions
+}
+
+func (o ConsumerOptions) concurrency() int {
+	if o.Concurrency <= 0 {
+		return 1
+	}
+	return o.Concurrency
+}
+
+// PrefetchCount returns the prefetch of the options, or its default
+func (o ConsumerOptions) PrefetchCount() int {
+	if o.Prefetch <= 0 {
+		return 2 * o.concurrency()
+	}
+	return o.Prefetch
+}
+
+// DefaultRetryDelays are the delays used by retry options without delays
+var DefaultRetryDelays = []time.Duration{time.Second, 10 * time.Second, time.Minute}
+
+// RetryOptions makes a consumer retry the messages that fail, waiting on a delay queue before delivering them again;
+// the delay of every retry is the one of its attempt, or the last one for the attempts that exceed the delays. After
+// MaxAttempts unsuccessful processings, messages are sent to the dead-letter queue of the consumer
+type RetryOptions struct {
+	MaxAttempts int
+	Delays      []time.Duration
+}
+
+func (o *RetryOptions) delays() []time.Duration {
+	if len(o.Delays) == 0 {
+		return DefaultRetryDelays
+	}
+	return o.Delays
+}
+
+// delay returns the delay that follows an amount of attempts
+func (o *RetryOptions) delay(attempts int) time.Duration {
+	delays := o.delays()
+	if attempts > len(delays) {
+		attempts = len(delays)
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+	return delays[attempts-1]
+}
+
+// RetryExchange returns the name of the exchange routing the failed messages of a queue to its delay queues
+func RetryExchange(queue string) string {
+	return queue + ".retry"
+}
+
+// DelayQueue returns the name of the queue where the messages of a queue wait for a delay before being delivered again
+func DelayQueue(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%v.retry.%v", queue, delay)
+}
+
+// DeadLetterQueue returns the name of the queue holding the messages of a queue that exhausted their attempts
+func DeadLetterQueue(queue string) string {
+	return queue + ".dead"
+}
+
+// Attempts returns how many times a message was processed unsuccessfully
+func Attempts(headers map[string]interface{}) int {
+	attempts, _ := ToInt(headers[AttemptsHeader])
+	return attempts
+}
+
+// ToInt reads an integer header, whose type depends on the broker it travelled through
+func ToInt(value interface{}) (int, bool) {
+	switch number := value.(type) {
+	case int64:
+		return int(number), true
+	case int32:
+		return int(number), true
+	case int:
+		return number, true
+	default:
+		return 0, false
+	}
+}
+
+// DeclareRetry creates the retry exchange, the delay queues and the dead-letter queue of a queue. Delay queues have no
+// consumers; their messages expire after the delay and are dead-lettered back to the queue through the default exchange
+func DeclareRetry(declarer Declarer, queue string, retry *RetryOptions) error {
+	exchange := RetryExchange(queue)
+	if err := declarer.DeclareExchange(exchange, ExchangeDirect); err != nil {
+		return err
+	}
+	defaultExchange := ""
+	for _, delay := range retry.delays() {
+		name := DelayQueue(queue, delay)
+		if _, err := declarer.DeclareQueue(name, QueueOptions{
+			MessageTTL:           delay,
+			DeadLetterExchange:   &defaultExchange,
+			DeadLetterRoutingKey: queue,
+		}); err != nil {
+			return err
+		}
+		if err := declarer.BindQueue(name, exchange, name); err != nil {
+			return err
+		}
+	}
+	_, err := declarer.DeclareQueue(DeadLetterQueue(queue), QueueOptions{})
+	return err
+}
+
+// ErrTimeout indicates that a handler did not process a message within the timeout of the consumer
+var ErrTimeout = errors.New("message processing timed out")
+
+// requeueError marks an error whose message must be requeued regardless of the options of the consumer
+type requeueError struct {
+	err error
+}
+
+func (e requeueError) Error() string {
+	return e.err.Error()
+}
+
+func (e requeueError) Unwrap() error {
+	return e.err
+}
+
+// Requeue wraps the error of a handler so its message is requeued, as for temporary failures
+func Requeue(err error) error {
+	return requeueError{err: err}
+}
+
+// Handler processes a single delivery; the consumer acks it when the handler returns nil and nacks it otherwise. The
+// context is cancelled when the processing times out or the consumer stops processing
+type Handler func(ctx context.Context, delivery Delivery) error
+
+// PublishFunc sends a message and waits for the broker to take it
+type PublishFunc func(exchange, routingKey string, body []byte, headers map[string]interface{}) error
+
+// Dispatcher runs the handler of every delivery of a queue as its consumer options say; consumers of every broker share
+// it, and provide the function used to send failed messages to their delay and dead-letter queues
+type Dispatcher struct {
+	Queue   string
+	Options ConsumerOptions
+	Publish PublishFunc
+}
+
+// Dispatch processes the deliveries with as many concurrent handlers as the options say, until ctx is cancelled or the
+// deliveries channel is closed
+func (d Dispatcher) Dispatch(ctx context.Context, deliveries <-chan Delivery, handler Handler) {
+	wait := sync.WaitGroup{}
+	for i := 0; i < d.Options.concurrency(); i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case delivery, ok := <-deliveries:
+					if !ok {
+						return
+					}
+					d.process(ctx, handler, delivery)
+				}
+			}
+		}()
+	}
+	wait.Wait()
+}
+
+// process runs the handler of a delivery within the timeout of the options and acks or nacks it according to its result.
+// Once the timeout expires or the consumer stops, the context of the handler is cancelled, but the delivery is settled only
+// when the handler returns, so a message is never retried, or dead-lettered, while its previous attempt keeps running
+func (d Dispatcher) process(ctx context.Context, handler Handler, delivery Delivery) {
+	if d.Options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Options.Timeout)
+		defer cancel()
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- handler(ctx, delivery)
+	}()
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		log.Warnf("processing of message %v interrupted: %v; waiting for its handler to return", delivery.DeliveryTag, ctx.Err())
+		err = <-result
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("%w: %v", ErrTimeout, err)
+		}
+	}
+
+	if err == nil {
+		if ackErr := delivery.Ack(); ackErr != nil {
+			log.Errorf("error acking message %v: %v", delivery.DeliveryTag, ackErr)
+		}
+		return
+	}
+	var requeue requeueError
+	// messages interrupted because the consumer stops are not failures, so they go back to the queue
+	requeued := d.Options.Requeue || errors.As(err, &requeue) || ctx.Err() == context.Canceled
+	if !requeued && d.Options.Retry != nil {
+		retryErr := d.retry(delivery, err)
+		if retryErr == nil {
+			return
+		}
+		log.Errorf("%v", retryErr)
+		requeued = true
+	}
+	log.Errorf("error processing message %v (requeue %v): %v", delivery.DeliveryTag, requeued, err)
+	if nackErr := delivery.Nack(requeued); nackErr != nil {
+		log.Errorf("error nacking message %v: %v", delivery.DeliveryTag, nackErr)
+	}
+}
+
+// FinalAttempt indicates whether a failure processing the delivery would be the last one, after which it is dropped or
+// dead-lettered instead of delivered again
+func (d Dispatcher) FinalAttempt(delivery Delivery) bool {
+	if d.Options.Requeue {
+		return false
+	}
+	retry := d.Options.Retry
+	return retry == nil || Attempts(delivery.Headers)+1 >= retry.MaxAttempts
+}
+
+// retry sends a failed delivery to a delay queue, or to the dead-letter queue once it exhausted its attempts, and acks it
+func (d Dispatcher) retry(delivery Delivery, cause error) error {
+	attempts := Attempts(delivery.Headers) + 1
+	headers := map[string]interface{}{}
+	for key, value := range delivery.Headers {
+		headers[key] = value
+	}
+	headers[AttemptsHeader] = int64(attempts)
+	headers[LastErrorHeader] = secrets.Redact(cause.Error())
+
+	exchange := RetryExchange(d.Queue)
+	routingKey := DelayQueue(d.Queue, d.Options.Retry.delay(attempts))
+	if attempts >= d.Options.Retry.MaxAttempts {
+		if _, ok := headers[OriginalExchangeHeader]; !ok {
+			headers[OriginalExchangeHeader] = delivery.Exchange
+			headers[OriginalRoutingKeyHeader] = delivery.RoutingKey
+		}
+		headers[FailedAtHeader] = time.Now().UTC().Format(time.RFC3339)
+		exchange = ""
+		routingKey = DeadLetterQueue(d.Queue)
+	}
+
+	if err := d.Publish(exchange, routingKey, delivery.Body, headers); err != nil {
+		return fmt.Errorf("error sending message to %v: %v", routingKey, err)
+	}
+	if exchange == "" {
+		log.Warnf("message %v dead-lettered to %v after %v attempts: %v", delivery.DeliveryTag, routingKey, attempts, cause)
+	} else {
+		log.Infof("message %v will be retried through %v after %v attempts: %v", delivery.DeliveryTag, routingKey, attempts, cause)
+	}
+	return delivery.Ack()
+}
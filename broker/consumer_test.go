@@ -0,0 +1,252 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// settlement records how a delivery was settled, and whether its handler had returned by then
+type settlement struct {
+	acked    bool
+	requeue  bool
+	returned bool
+}
+
+// recorder is an Acknowledger recording the settlements of its deliveries
+type recorder struct {
+	returned    *int32
+	settlements []settlement
+	sync        sync.Mutex
+}
+
+func (r *recorder) settle(s settlement) error {
+	r.sync.Lock()
+	defer r.sync.Unlock()
+	s.returned = atomic.LoadInt32(r.returned) == 1
+	r.settlements = append(r.settlements, s)
+	return nil
+}
+
+func (r *recorder) Ack(tag uint64) error {
+	return r.settle(settlement{acked: true})
+}
+
+func (r *recorder) Nack(tag uint64, requeue bool) error {
+	return r.settle(settlement{requeue: requeue})
+}
+
+// published is a message sent by a dispatcher to a delay or dead-letter queue
+type published struct {
+	exchange   string
+	routingKey string
+	headers    map[string]interface{}
+}
+
+func TestDispatcherProcess(t *testing.T) {
+	retry := &RetryOptions{MaxAttempts: 2, Delays: []time.Duration{time.Second}}
+	tests := []struct {
+		name          string
+		options       ConsumerOptions
+		attempts      int
+		handler       func(ctx context.Context) error
+		want          settlement
+		wantPublished string
+	}{
+		{
+			name:    "success",
+			handler: func(ctx context.Context) error { return nil },
+			want:    settlement{acked: true, returned: true},
+		},
+		{
+			name:    "failure",
+			handler: func(ctx context.Context) error { return fmt.Errorf("failed") },
+			want:    settlement{returned: true},
+		},
+		{
+			name:    "failure requeued by the options",
+			options: ConsumerOptions{Requeue: true},
+			handler: func(ctx context.Context) error { return fmt.Errorf("failed") },
+			want:    settlement{requeue: true, returned: true},
+		},
+		{
+			name:    "failure requeued by the handler",
+			handler: func(ctx context.Context) error { return Requeue(fmt.Errorf("failed")) },
+			want:    settlement{requeue: true, returned: true},
+		},
+		{
+			name:          "failure retried",
+			options:       ConsumerOptions{Retry: retry},
+			handler:       func(ctx context.Context) error { return fmt.Errorf("failed") },
+			want:          settlement{acked: true, returned: true},
+			wantPublished: DelayQueue("queue", time.Second),
+		},
+		{
+			name:          "failure dead-lettered",
+			options:       ConsumerOptions{Retry: retry},
+			attempts:      1,
+			handler:       func(ctx context.Context) error { return fmt.Errorf("failed") },
+			want:          settlement{acked: true, returned: true},
+			wantPublished: DeadLetterQueue("queue"),
+		},
+		{
+			name:    "timeout ignored by the handler",
+			options: ConsumerOptions{Timeout: 10 * time.Millisecond},
+			handler: func(ctx context.Context) error {
+				time.Sleep(50 * time.Millisecond)
+				return fmt.Errorf("failed")
+			},
+			want: settlement{returned: true},
+		},
+		{
+			name:    "timeout honored by the handler",
+			options: ConsumerOptions{Timeout: 10 * time.Millisecond},
+			handler: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			want: settlement{returned: true},
+		},
+		{
+			name:    "timeout of a handler that succeeds",
+			options: ConsumerOptions{Timeout: 10 * time.Millisecond},
+			handler: func(ctx context.Context) error {
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			},
+			want: settlement{acked: true, returned: true},
+		},
+		{
+			name:    "timeout retried once the handler returns",
+			options: ConsumerOptions{Timeout: 10 * time.Millisecond, Retry: retry},
+			handler: func(ctx context.Context) error {
+				time.Sleep(50 * time.Millisecond)
+				return fmt.Errorf("failed")
+			},
+			want:          settlement{acked: true, returned: true},
+			wantPublished: DelayQueue("queue", time.Second),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var returned int32
+			acknowledger := &recorder{returned: &returned}
+			var messages []published
+			dispatcher := Dispatcher{
+				Queue:   "queue",
+				Options: test.options,
+				Publish: func(exchange, routingKey string, body []byte, headers map[string]interface{}) error {
+					if atomic.LoadInt32(&returned) == 0 {
+						t.Errorf("message published to %v while its handler was running", routingKey)
+					}
+					messages = append(messages, published{exchange: exchange, routingKey: routingKey, headers: headers})
+					return nil
+				},
+			}
+			delivery := Delivery{
+				Headers:      map[string]interface{}{AttemptsHeader: int64(test.attempts)},
+				Acknowledger: acknowledger,
+			}
+			dispatcher.process(context.Background(), func(ctx context.Context, delivery Delivery) error {
+				defer atomic.StoreInt32(&returned, 1)
+				return test.handler(ctx)
+			}, delivery)
+
+			if len(acknowledger.settlements) != 1 {
+				t.Fatalf("delivery settled %v times, want 1", len(acknowledger.settlements))
+			}
+			if got := acknowledger.settlements[0]; got != test.want {
+				t.Errorf("settlement = %+v, want %+v", got, test.want)
+			}
+			if test.wantPublished == "" {
+				if len(messages) > 0 {
+					t.Errorf("published %+v, want nothing", messages)
+				}
+				return
+			}
+			if len(messages) != 1 || messages[0].routingKey != test.wantPublished {
+				t.Fatalf("published %+v, want a message to %v", messages, test.wantPublished)
+			}
+			if attempts := Attempts(messages[0].headers); attempts != test.attempts+1 {
+				t.Errorf("published attempts = %v, want %v", attempts, test.attempts+1)
+			}
+		})
+	}
+}
+
+func TestDispatcherTimeoutError(t *testing.T) {
+	var returned int32
+	var cause error
+	dispatcher := Dispatcher{
+		Queue:   "queue",
+		Options: ConsumerOptions{Timeout: 10 * time.Millisecond, Retry: &RetryOptions{MaxAttempts: 1}},
+		Publish: func(exchange, routingKey string, body []byte, headers map[string]interface{}) error {
+			cause = errors.New(headers[LastErrorHeader].(string))
+			return nil
+		},
+	}
+	dispatcher.process(context.Background(), func(ctx context.Context, delivery Delivery) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, Delivery{Acknowledger: &recorder{returned: &returned}})
+	if cause == nil || cause.Error() != fmt.Sprintf("%v: %v", ErrTimeout, context.DeadlineExceeded) {
+		t.Errorf("dead-lettered error = %v, want %v", cause, ErrTimeout)
+	}
+}
+
+func TestDispatcherFinalAttempt(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  ConsumerOptions
+		attempts int
+		want     bool
+	}{
+		{"without retries", ConsumerOptions{}, 0, true},
+		{"requeued", ConsumerOptions{Requeue: true}, 0, false},
+		{"first of three attempts", ConsumerOptions{Retry: &RetryOptions{MaxAttempts: 3}}, 0, false},
+		{"last of three attempts", ConsumerOptions{Retry: &RetryOptions{MaxAttempts: 3}}, 2, true},
+	}
+	for _, test := range tests {
+		dispatcher := Dispatcher{Options: test.options}
+		delivery := Delivery{Headers: map[string]interface{}{AttemptsHeader: int64(test.attempts)}}
+		if got := dispatcher.FinalAttempt(delivery); got != test.want {
+			t.Errorf("%v: FinalAttempt() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDispatchConcurrency(t *testing.T) {
+	var running, maxRunning int32
+	deliveries := make(chan Delivery)
+	var returned int32 = 1
+	acknowledger := &recorder{returned: &returned}
+	go func() {
+		defer close(deliveries)
+		for i := 0; i < 12; i++ {
+			deliveries <- Delivery{DeliveryTag: uint64(i), Acknowledger: acknowledger}
+		}
+	}()
+	dispatcher := Dispatcher{Options: ConsumerOptions{Concurrency: 3}}
+	dispatcher.Dispatch(context.Background(), deliveries, func(ctx context.Context, delivery Delivery) error {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			previous := atomic.LoadInt32(&maxRunning)
+			if current <= previous || atomic.CompareAndSwapInt32(&maxRunning, previous, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	if maxRunning != 3 {
+		t.Errorf("%v handlers ran at the same time, want 3", maxRunning)
+	}
+	if len(acknowledger.settlements) != 12 {
+		t.Errorf("%v deliveries settled, want 12", len(acknowledger.settlements))
+	}
+}
@@ -0,0 +1,488 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Memory is a Broker keeping its exchanges and queues in the memory of the process, so distributed jobs can run, and be
+// tested, without a server. As rabbitMq does, it delivers the messages of a queue to its consumers in turns, up to their
+// prefetch, delivers again the messages nacked with requeue or left unacked by a consumer that shuts down, and
+// dead-letters the messages that expire or are rejected
+type Memory struct {
+	exchanges map[string]*memoryExchange
+	queues    map[string]*memoryQueue
+	consumers []*memoryConsumer
+	next      uint64
+	closed    bool
+	sync      sync.Mutex
+}
+
+type memoryExchange struct {
+	kind     string
+	bindings []memoryBinding
+}
+
+type memoryBinding struct {
+	queue string
+	key   string
+}
+
+type memoryMessage struct {
+	body        []byte
+	headers     map[string]interface{}
+	exchange    string
+	routingKey  string
+	redelivered bool
+	expiry      *time.Timer
+}
+
+type memoryQueue struct {
+	name      string
+	options   QueueOptions
+	ready     []*memoryMessage
+	consumers []*memoryConsumer
+	turn      int
+}
+
+// NewMemory creates an empty in-memory broker
+func NewMemory() *Memory {
+	return &Memory{
+		exchanges: make(map[string]*memoryExchange),
+		queues:    make(map[string]*memoryQueue),
+	}
+}
+
+// DeclareExchange creates an exchange of a kind, failing if it exists with another kind
+func (m *Memory) DeclareExchange(name, kind string) error {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	if kind != ExchangeDirect && kind != ExchangeFanout {
+		return fmt.Errorf("error declaring exchange %v: unsupported kind %v", name, kind)
+	}
+	if exchange, ok := m.exchanges[name]; ok {
+		if exchange.kind != kind {
+			return fmt.Errorf("error declaring exchange %v: already declared as %v", name, exchange.kind)
+		}
+		return nil
+	}
+	m.exchanges[name] = &memoryExchange{kind: kind}
+	return nil
+}
+
+// DeclareQueue creates a queue, generating its name if empty
+func (m *Memory) DeclareQueue(name string, options QueueOptions) (string, error) {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	if m.closed {
+		return "", ErrClosed
+	}
+	if name == "" {
+		m.next++
+		name = fmt.Sprintf("memory.gen-%d", m.next)
+	}
+	if _, ok := m.queues[name]; !ok {
+		m.queues[name] = &memoryQueue{name: name, options: options}
+	}
+	return name, nil
+}
+
+// BindQueue routes the messages an exchange receives with key to a queue
+func (m *Memory) BindQueue(queue, exchange, key string) error {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	source, ok := m.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("error binding queue %v: exchange %v not found", queue, exchange)
+	}
+	if _, ok := m.queues[queue]; !ok {
+		return fmt.Errorf("error binding queue %v: queue not found", queue)
+	}
+	bound := memoryBinding{queue: queue, key: key}
+	for _, existing := range source.bindings {
+		if existing == bound {
+			return nil
+		}
+	}
+	source.bindings = append(source.bindings, bound)
+	return nil
+}
+
+// Publish routes a message into the queues bound to the exchange; messages routed nowhere are rejected
+func (m *Memory) Publish(exchange, routingKey string, body []byte, headers map[string]interface{}) Confirmation {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	if m.closed {
+		return Resolved(ErrClosed)
+	}
+	queues, err := m.route(exchange, routingKey)
+	if err != nil {
+		return Resolved(err)
+	}
+	if len(queues) == 0 {
+		return Resolved(ErrUnroutable)
+	}
+	for _, queue := range queues {
+		m.enqueue(queue, &memoryMessage{
+			body:       body,
+			headers:    copyHeaders(headers),
+			exchange:   exchange,
+			routingKey: routingKey,
+		})
+	}
+	return Resolved(nil)
+}
+
+func copyHeaders(headers map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(headers))
+	for key, value := range headers {
+		result[key] = value
+	}
+	return result
+}
+
+// route returns the queues a message published to exchange with routingKey goes to
+func (m *Memory) route(exchange, routingKey string) ([]*memoryQueue, error) {
+	if exchange == "" {
+		if queue, ok := m.queues[routingKey]; ok {
+			return []*memoryQueue{queue}, nil
+		}
+		return nil, nil
+	}
+	source, ok := m.exchanges[exchange]
+	if !ok {
+		return nil, fmt.Errorf("error publishing message: exchange %v not found", exchange)
+	}
+	result := make([]*memoryQueue, 0, len(source.bindings))
+	routed := make(map[string]bool, len(source.bindings))
+	for _, bound := range source.bindings {
+		if routed[bound.queue] || (source.kind == ExchangeDirect && bound.key != routingKey) {
+			continue
+		}
+		routed[bound.queue] = true
+		result = append(result, m.queues[bound.queue])
+	}
+	return result, nil
+}
+
+// enqueue adds a message at the end of a queue, expiring it after the ttl of the queue
+func (m *Memory) enqueue(queue *memoryQueue, message *memoryMessage) {
+	queue.ready = append(queue.ready, message)
+	if queue.options.MessageTTL > 0 {
+		message.expiry = time.AfterFunc(queue.options.MessageTTL, func() {
+			m.expire(queue, message)
+		})
+	}
+	m.dispatch(queue)
+}
+
+// expire dead-letters a message that stayed in its queue for the ttl of the queue
+func (m *Memory) expire(queue *memoryQueue, message *memoryMessage) {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	for i, ready := range queue.ready {
+		if ready == message {
+			queue.ready = append(queue.ready[:i], queue.ready[i+1:]...)
+			m.deadLetter(queue, message)
+			return
+		}
+	}
+}
+
+// deadLetter routes an expired or rejected message to the dead-letter exchange of its queue, or drops it
+func (m *Memory) deadLetter(queue *memoryQueue, message *memoryMessage) {
+	if queue.options.DeadLetterExchange == nil || m.closed {
+		log.Debugf("dropping message of queue %v", queue.name)
+		return
+	}
+	routingKey := queue.options.DeadLetterRoutingKey
+	if routingKey == "" {
+		routingKey = message.routingKey
+	}
+	queues, err := m.route(*queue.options.DeadLetterExchange, routingKey)
+	if err != nil {
+		log.Errorf("error dead-lettering message of queue %v: %v", queue.name, err)
+		return
+	}
+	for _, target := range queues {
+		m.enqueue(target, &memoryMessage{
+			body:       message.body,
+			headers:    copyHeaders(message.headers),
+			exchange:   *queue.options.DeadLetterExchange,
+			routingKey: routingKey,
+		})
+	}
+}
+
+// dispatch delivers the ready messages of a queue to its consumers in turns, while they have prefetch left
+func (m *Memory) dispatch(queue *memoryQueue) {
+	for len(queue.ready) > 0 {
+		var consumer *memoryConsumer
+		for i := 0; i < len(queue.consumers) && consumer == nil; i++ {
+			candidate := queue.consumers[(queue.turn+i)%len(queue.consumers)]
+			if !candidate.cancelled && len(candidate.unacked) < candidate.prefetch {
+				consumer = candidate
+				queue.turn = (queue.turn + i + 1) % len(queue.consumers)
+			}
+		}
+		if consumer == nil {
+			return
+		}
+		message := queue.ready[0]
+		queue.ready = queue.ready[1:]
+		if message.expiry != nil {
+			message.expiry.Stop()
+		}
+		m.next++
+		consumer.unacked[m.next] = message
+		// deliveries is buffered up to the prefetch, so this never blocks
+		consumer.deliveries <- Delivery{
+			Body:         message.body,
+			Headers:      copyHeaders(message.headers),
+			Exchange:     message.exchange,
+			RoutingKey:   message.routingKey,
+			Redelivered:  message.redelivered,
+			DeliveryTag:  m.next,
+			Acknowledger: consumer,
+		}
+	}
+}
+
+// Consume creates a consumer of a queue, declaring the retry topology of the queue if the options need it
+func (m *Memory) Consume(queue, tag string, options ConsumerOptions) (Consumer, error) {
+	if options.Retry != nil {
+		if err := DeclareRetry(m, queue, options.Retry); err != nil {
+			return nil, err
+		}
+	}
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	source, ok := m.queues[queue]
+	if !ok {
+		return nil, fmt.Errorf("error consuming queue %v: queue not found", queue)
+	}
+	consumer := &memoryConsumer{
+		memory:     m,
+		queue:      source,
+		tag:        tag,
+		prefetch:   options.PrefetchCount(),
+		deliveries: make(chan Delivery, options.PrefetchCount()),
+		unacked:    make(map[uint64]*memoryMessage),
+		stopped:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	consumer.dispatcher = Dispatcher{
+		Queue:   queue,
+		Options: options,
+		Publish: func(exchange, routingKey string, body []byte, headers map[string]interface{}) error {
+			return m.Publish(exchange, routingKey, body, headers).Wait()
+		},
+	}
+	source.consumers = append(source.consumers, consumer)
+	m.consumers = append(m.consumers, consumer)
+	m.dispatch(source)
+	return consumer, nil
+}
+
+// Close shuts down every consumer and stops the expiration of the messages
+func (m *Memory) Close() error {
+	m.sync.Lock()
+	if m.closed {
+		m.sync.Unlock()
+		return nil
+	}
+	m.closed = true
+	consumers := append([]*memoryConsumer(nil), m.consumers...)
+	m.sync.Unlock()
+	for _, consumer := range consumers {
+		consumer.Shutdown()
+	}
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	for _, queue := range m.queues {
+		for _, message := range queue.ready {
+			if message.expiry != nil {
+				message.expiry.Stop()
+			}
+		}
+	}
+	return nil
+}
+
+// Messages returns how many messages of a queue are waiting to be delivered, or were delivered but not acked yet
+func (m *Memory) Messages(queue string) int {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	source, ok := m.queues[queue]
+	if !ok {
+		return 0
+	}
+	result := len(source.ready)
+	for _, consumer := range source.consumers {
+		result += len(consumer.unacked)
+	}
+	return result
+}
+
+// memoryConsumer receives the messages of a queue of a Memory broker, and settles them
+type memoryConsumer struct {
+	memory     *Memory
+	queue      *memoryQueue
+	tag        string
+	dispatcher Dispatcher
+	prefetch   int
+	deliveries chan Delivery
+	unacked    map[uint64]*memoryMessage
+	processing bool
+	cancelled  bool
+	stopped    chan struct{}
+	done       chan struct{}
+	once       sync.Once
+}
+
+// Process handles the messages of the queue until ctx is cancelled or the consumer is shut down
+func (c *memoryConsumer) Process(ctx context.Context, handler Handler) error {
+	c.memory.sync.Lock()
+	if c.cancelled {
+		c.memory.sync.Unlock()
+		return ErrClosed
+	}
+	if c.processing {
+		c.memory.sync.Unlock()
+		return fmt.Errorf("consumer %v is already processing", c.tag)
+	}
+	c.processing = true
+	c.memory.sync.Unlock()
+	defer close(c.done)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.stopped:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	c.dispatcher.Dispatch(ctx, c.deliveries, handler)
+	return nil
+}
+
+// FinalAttempt indicates whether a failure processing the delivery would be the last one
+func (c *memoryConsumer) FinalAttempt(delivery Delivery) bool {
+	return c.dispatcher.FinalAttempt(delivery)
+}
+
+// Ack removes a delivered message from the queue
+func (c *memoryConsumer) Ack(tag uint64) error {
+	c.memory.sync.Lock()
+	defer c.memory.sync.Unlock()
+	if _, ok := c.unacked[tag]; !ok {
+		return ErrUnknownDelivery
+	}
+	delete(c.unacked, tag)
+	c.memory.dispatch(c.queue)
+	return nil
+}
+
+// Nack returns a delivered message to the front of the queue, or dead-letters it
+func (c *memoryConsumer) Nack(tag uint64, requeue bool) error {
+	c.memory.sync.Lock()
+	defer c.memory.sync.Unlock()
+	message, ok := c.unacked[tag]
+	if !ok {
+		return ErrUnknownDelivery
+	}
+	delete(c.unacked, tag)
+	if requeue {
+		message.redelivered = true
+		c.queue.ready = append([]*memoryMessage{message}, c.queue.ready...)
+	} else {
+		c.memory.deadLetter(c.queue, message)
+	}
+	c.memory.dispatch(c.queue)
+	return nil
+}
+
+// Shutdown stops the consumer, waiting for the messages being processed, and returns the messages it did not ack to the
+// front of the queue in their original order; exclusive queues are removed along with their consumer
+func (c *memoryConsumer) Shutdown() error {
+	c.once.Do(func() {
+		m := c.memory
+		m.sync.Lock()
+		c.cancelled = true
+		processing := c.processing
+		m.sync.Unlock()
+		close(c.stopped)
+		if processing {
+			<-c.done
+		}
+
+		m.sync.Lock()
+		defer m.sync.Unlock()
+		for i, consumer := range c.queue.consumers {
+			if consumer == c {
+				c.queue.consumers = append(c.queue.consumers[:i], c.queue.consumers[i+1:]...)
+				break
+			}
+		}
+		for i, consumer := range m.consumers {
+			if consumer == c {
+				m.consumers = append(m.consumers[:i], m.consumers[i+1:]...)
+				break
+			}
+		}
+		tags := make([]uint64, 0, len(c.unacked))
+		for tag := range c.unacked {
+			tags = append(tags, tag)
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+		unacked := make([]*memoryMessage, 0, len(tags))
+		for _, tag := range tags {
+			message := c.unacked[tag]
+			message.redelivered = true
+			unacked = append(unacked, message)
+			delete(c.unacked, tag)
+		}
+		c.queue.ready = append(unacked, c.queue.ready...)
+		if c.queue.options.Exclusive {
+			m.delete(c.queue)
+			return
+		}
+		m.dispatch(c.queue)
+	})
+	return nil
+}
+
+// delete removes a queue and its bindings, dropping its messages
+func (m *Memory) delete(queue *memoryQueue) {
+	delete(m.queues, queue.name)
+	for _, exchange := range m.exchanges {
+		bindings := exchange.bindings[:0]
+		for _, bound := range exchange.bindings {
+			if bound.queue != queue.name {
+				bindings = append(bindings, bound)
+			}
+		}
+		exchange.bindings = bindings
+	}
+	for _, message := range queue.ready {
+		if message.expiry != nil {
+			message.expiry.Stop()
+		}
+	}
+}
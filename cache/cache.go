@@ -0,0 +1,260 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ezeriver94/gotransform/env"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTTL is the time a retrieved value is kept in cache
+const DefaultTTL = time.Hour
+
+// Cache stores serialized values by key, each one with its own expiration
+type Cache interface {
+	Get(key string) (string, bool, error)
+	Set(key string, value string, ttl time.Duration) error
+	Delete(key string) error
+}
+
+// NoopCache is a Cache that never stores anything
+type NoopCache struct{}
+
+// NewNoopCache creates a cache that always misses
+func NewNoopCache() Cache {
+	return NoopCache{}
+}
+
+// Get always misses
+func (NoopCache) Get(key string) (string, bool, error) {
+	return "", false, nil
+}
+
+// Set discards the value
+func (NoopCache) Set(key string, value string, ttl time.Duration) error {
+	return nil
+}
+
+// Delete does nothing
+func (NoopCache) Delete(key string) error {
+	return nil
+}
+
+// New builds a cache of a kind: none, memory, disk, redis or layered (memory in front of redis). Several kinds separated by
+// commas build a layered cache looked up in that order, such as memory,disk. Redis settings are read from the
+// REDIS_CACHE_HOST, REDIS_CACHE_PORT and REDIS_CACHE_PASSWORD envVars, and disk settings from DISK_CACHE_DIR and
+// DISK_CACHE_SIZE (in megabytes)
+func New(kind string) (Cache, error) {
+	if strings.Contains(kind, ",") {
+		layers := make([]Cache, 0)
+		for _, layerKind := range strings.Split(kind, ",") {
+			layer, err := New(strings.TrimSpace(layerKind))
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, layer)
+		}
+		return NewLayeredCache(layers...), nil
+	}
+	switch kind {
+	case "none":
+		return NewNoopCache(), nil
+	case "memory":
+		return NewMemoryCache(DefaultMemorySize), nil
+	case "disk":
+		return NewDiskCacheFromEnv()
+	case "redis", "layered":
+		config := redisConfig{}
+		if err := env.Load(&config); err != nil {
+			return nil, fmt.Errorf("error configuring %v cache: %v", kind, err)
+		}
+		redis := NewRedisCache(config.Host, config.Port, config.Password)
+		if kind == "redis" {
+			return redis, nil
+		}
+		return NewLayeredCache(NewMemoryCache(DefaultMemorySize), redis), nil
+	default:
+		return nil, fmt.Errorf("unknown cache kind %v", kind)
+	}
+}
+
+// redisConfig holds the settings of the redis cache
+type redisConfig struct {
+	Host     string `env:"REDIS_CACHE_HOST" required:"true"`
+	Port     int    `env:"REDIS_CACHE_PORT" default:"6379"`
+	Password string `env:"REDIS_CACHE_PASSWORD" secret:"true"`
+}
+
+// diskConfig holds the settings of the disk cache; its size is in megabytes
+type diskConfig struct {
+	Dir  string `env:"DISK_CACHE_DIR"`
+	Size int64  `env:"DISK_CACHE_SIZE"`
+}
+
+// NewDiskCacheFromEnv opens the disk cache configured by the DISK_CACHE_DIR and DISK_CACHE_SIZE (in megabytes) envVars
+func NewDiskCacheFromEnv() (*DiskCache, error) {
+	config := diskConfig{Dir: DefaultDiskDir}
+	if err := env.Load(&config); err != nil {
+		return nil, fmt.Errorf("error configuring disk cache: %v", err)
+	}
+	size := int64(DefaultDiskSize)
+	if config.Size > 0 {
+		size = config.Size << 20
+	}
+	return NewDiskCache(config.Dir, size)
+}
+
+// NewFromEnv builds a layered cache when REDIS_CACHE_HOST envVar is set, or a memory cache otherwise
+func NewFromEnv() (Cache, error) {
+	if len(env.GetString("REDIS_CACHE_HOST")) == 0 {
+		return New("memory")
+	}
+	return New("layered")
+}
+
+func valueToString(value interface{}) (string, error) {
+	switch value.(type) {
+	case string:
+		return value.(string), nil
+	default:
+		result, err := json.Marshal(value)
+		return string(result), err
+	}
+}
+
+// Policy defines how the values of a source are kept in cache; zero TTLs fall back to DefaultTTL. The source names the
+// stats where the retrievals are counted
+type Policy struct {
+	Source      string
+	TTL         time.Duration
+	CacheMisses bool
+	MissTTL     time.Duration
+	Namespace   string
+}
+
+func (p Policy) ttl() time.Duration {
+	if p.TTL > 0 {
+		return p.TTL
+	}
+	return DefaultTTL
+}
+
+func (p Policy) missTTL() time.Duration {
+	if p.MissTTL > 0 {
+		return p.MissTTL
+	}
+	return p.ttl()
+}
+
+// Key prefixes a key with the namespace of the policy
+func (p Policy) Key(key string) string {
+	if p.Namespace == "" {
+		return key
+	}
+	return p.Namespace + "::" + key
+}
+
+// ErrMiss is returned by the getters of Retrieve when a value does not exist on its source; it is cached when the policy
+// allows caching misses, so next retrievals return it without calling the getter
+var ErrMiss = errors.New("value not found")
+
+// missValue is stored in cache to remember a key that does not exist on its source
+const missValue = "\x00miss"
+
+// inflight coalesces the concurrent retrievals of the same key from the same cache, so their getter is executed only once
+var inflight = newGroup()
+
+// flightKey identifies the retrievals of a key from a cache instance, so different caches never share a getter
+type flightKey struct {
+	cache Cache
+	key   string
+}
+
+// Retrieve tries to get a value from the cache; if found, it returns it, otherwise, the function get is executed and stored in cache, and returned.
+// Concurrent retrievals of a key missing in the same cache instance wait for a single execution of get and share its result
+// or error; caches that are not pointers, as NoopCache, have no identity, so their retrievals are never coalesced
+func Retrieve(c Cache, policy Policy, key string, get func() (interface{}, error)) (string, error) {
+	if c == nil {
+		c = NewNoopCache()
+	}
+	key = policy.Key(key)
+	stringResult, found, err := c.Get(key)
+	if err != nil {
+		log.Errorf("error reading cache key %v: %v", key, err)
+		record(policy.Source, func(stats *Stats) { stats.Errors++ })
+	}
+	if found {
+		record(policy.Source, func(stats *Stats) {
+			stats.Hits++
+			stats.BytesRead += int64(len(stringResult))
+		})
+		if stringResult == missValue {
+			log.Debugf("cached miss for key %v", key)
+			return "", ErrMiss
+		}
+		return stringResult, nil
+	}
+	log.Debugf("cache miss for key %v. fetching data", key)
+
+	var shared bool
+	if reflect.ValueOf(c).Kind() == reflect.Ptr {
+		stringResult, shared, err = inflight.do(flightKey{cache: c, key: key}, func() (string, error) {
+			return fetch(c, policy, key, get)
+		})
+	} else {
+		stringResult, err = fetch(c, policy, key, get)
+	}
+	record(policy.Source, func(stats *Stats) {
+		if shared {
+			stats.Coalesced++
+		} else {
+			stats.Misses++
+		}
+	})
+	if shared {
+		log.Debugf("shared in-flight retrieval of key %v", key)
+	}
+	return stringResult, err
+}
+
+// fetch executes the getter of a key and stores its result in cache
+func fetch(c Cache, policy Policy, key string, get func() (interface{}, error)) (string, error) {
+	result, err := get()
+	if err == ErrMiss {
+		if policy.CacheMisses {
+			store(c, policy, key, missValue, policy.missTTL())
+		}
+		return "", ErrMiss
+	}
+	if err != nil {
+		record(policy.Source, func(stats *Stats) { stats.Errors++ })
+		return "", err
+	}
+	stringResult, err := valueToString(result)
+	if err != nil {
+		return "", err
+	}
+
+	log.Debugf("saving key %v with value %v in cache", key, stringResult)
+	store(c, policy, key, stringResult, policy.ttl())
+	return stringResult, nil
+}
+
+// store sets a value in cache, counting it on the stats of the source
+func store(c Cache, policy Policy, key string, value string, ttl time.Duration) {
+	if err := c.Set(key, value, ttl); err != nil {
+		log.Errorf("error saving on cache %v", err)
+		record(policy.Source, func(stats *Stats) { stats.Errors++ })
+		return
+	}
+	log.Debugf("cache key %v saved successfully", key)
+	record(policy.Source, func(stats *Stats) {
+		stats.Sets++
+		stats.BytesWritten += int64(len(value))
+	})
+}
@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ezeriver94/gotransform/env"
+)
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	env.Override(map[string]string{"DISK_CACHE_DIR": dir, "REDIS_CACHE_HOST": ""})
+
+	tests := []struct {
+		kind    string
+		want    string
+		wantErr string
+	}{
+		{kind: "none", want: "cache.NoopCache"},
+		{kind: "memory", want: "*cache.MemoryCache"},
+		{kind: "disk", want: "*cache.DiskCache"},
+		{kind: "memory, disk", want: "*cache.LayeredCache"},
+		{kind: "redis", wantErr: "REDIS_CACHE_HOST envVar is required"},
+		{kind: "layered", wantErr: "REDIS_CACHE_HOST envVar is required"},
+		{kind: "memory,tape", wantErr: "unknown cache kind tape"},
+	}
+	for _, test := range tests {
+		t.Run(test.kind, func(t *testing.T) {
+			c, err := New(test.kind)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("New(%q) error = %v, want %q", test.kind, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New(%q) error = %v", test.kind, err)
+			}
+			if got := fmt.Sprintf("%T", c); got != test.want {
+				t.Errorf("New(%q) = %v, want %v", test.kind, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	c := NewMemoryCache(DefaultMemorySize)
+	tests := []struct {
+		name      string
+		key       string
+		value     string
+		ttl       time.Duration
+		delete    bool
+		wantFound bool
+	}{
+		{"stored value", "a", "1", time.Hour, false, true},
+		{"empty value", "b", "", time.Hour, false, true},
+		{"expired value", "c", "3", -time.Second, false, false},
+		{"deleted value", "d", "4", time.Hour, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := c.Set(test.key, test.value, test.ttl); err != nil {
+				t.Fatal(err)
+			}
+			if test.delete {
+				if err := c.Delete(test.key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, found, err := c.Get(test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != test.wantFound || (found && got != test.value) {
+				t.Errorf("Get(%v) = %q, %v, want %q, %v", test.key, got, found, test.value, test.wantFound)
+			}
+		})
+	}
+}
+
+func TestRetrievePolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    Policy
+		getErr    error
+		wantErr   error
+		wantKey   string
+		wantFound bool
+		wantTTL   time.Duration
+	}{
+		{name: "default ttl", policy: Policy{}, wantKey: "key", wantFound: true, wantTTL: DefaultTTL},
+		{name: "policy ttl", policy: Policy{TTL: time.Minute}, wantKey: "key", wantFound: true, wantTTL: time.Minute},
+		{name: "namespace", policy: Policy{Namespace: "v2"}, wantKey: "v2::key", wantFound: true, wantTTL: DefaultTTL},
+		{name: "uncached miss", policy: Policy{}, getErr: ErrMiss, wantErr: ErrMiss, wantKey: "key"},
+		{name: "cached miss", policy: Policy{CacheMisses: true, TTL: time.Hour, MissTTL: time.Minute}, getErr: ErrMiss, wantErr: ErrMiss, wantKey: "key", wantFound: true, wantTTL: time.Minute},
+		{name: "miss ttl defaults to ttl", policy: Policy{CacheMisses: true, TTL: time.Hour}, getErr: ErrMiss, wantErr: ErrMiss, wantKey: "key", wantFound: true, wantTTL: time.Hour},
+		{name: "failed getter", policy: Policy{CacheMisses: true}, getErr: fmt.Errorf("unreachable"), wantKey: "key"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewMemoryCache(DefaultMemorySize)
+			calls := 0
+			get := func() (interface{}, error) {
+				calls++
+				if test.getErr != nil {
+					return nil, test.getErr
+				}
+				return "value", nil
+			}
+			for i := 0; i < 2; i++ {
+				_, err := Retrieve(c, test.policy, "key", get)
+				if test.wantErr != nil && err != test.wantErr {
+					t.Fatalf("Retrieve error = %v, want %v", err, test.wantErr)
+				}
+			}
+			_, ttl, found, _ := c.GetTTL(test.wantKey)
+			if found != test.wantFound {
+				t.Fatalf("cached = %v, want %v", found, test.wantFound)
+			}
+			if wantCalls := map[bool]int{true: 1, false: 2}[found]; calls != wantCalls {
+				t.Errorf("getter called %v times, want %v", calls, wantCalls)
+			}
+			if found && (ttl > test.wantTTL || ttl < test.wantTTL-time.Second) {
+				t.Errorf("cached ttl = %v, want %v", ttl, test.wantTTL)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultDiskDir is the directory used by disk caches built by New when DISK_CACHE_DIR envVar is not set
+	DefaultDiskDir = ".gotransform-cache"
+
+	// DefaultDiskSize is the amount of bytes used by disk caches built by New when DISK_CACHE_SIZE envVar is not set
+	DefaultDiskSize = 1 << 30 // 1 GB
+
+	// diskHeaderSize is the length of the expiration and key length written before the key and value of every entry
+	diskHeaderSize = 12
+
+	// temporaryPrefix starts the names of the files written by Set before they are renamed as entries
+	temporaryPrefix = ".entry-"
+
+	// staleTemporaryAge is the time after which a temporary file is assumed to be left by a Set that crashed, and removed
+	staleTemporaryAge = 10 * time.Minute
+)
+
+// DiskCache is a Cache persisted on a local directory, so it outlives the process and can be reused by later runs. Every
+// entry is a file named by the hash of its key; once the directory exceeds its size, the least recently used entries are
+// evicted
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+	size     int64
+	sync     sync.Mutex
+}
+
+// Entry describes a value stored on a disk cache
+type Entry struct {
+	Key        string
+	Size       int64
+	Expiration time.Time
+	LastAccess time.Time
+}
+
+// Expired indicates whether the entry can no longer be returned
+func (e Entry) Expired() bool {
+	return time.Now().After(e.Expiration)
+}
+
+// NewDiskCache opens, or creates, a disk cache on dir bounded to maxBytes
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating cache directory %v: %v", dir, err)
+	}
+	result := DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+	}
+	err := result.walk(func(path string, info os.FileInfo) error {
+		result.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// path returns the file of a key, sharded by the first byte of its hash to keep directories small
+func (dc *DiskCache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(hash[:])
+	return filepath.Join(dc.dir, name[:2], name)
+}
+
+// isShard indicates whether a directory name is a shard of the cache, made of the first byte of a hash
+func isShard(name string) bool {
+	decoded, err := hex.DecodeString(name)
+	return err == nil && len(decoded) == 1 && name == strings.ToLower(name)
+}
+
+// isEntry indicates whether a file name is an entry of the cache, made of the hash of its key
+func isEntry(name string) bool {
+	decoded, err := hex.DecodeString(name)
+	return err == nil && len(decoded) == sha256.Size && name == strings.ToLower(name)
+}
+
+// walk calls fn with every entry file of the cache, removing the stale temporary files left by a Set that crashed; any
+// other file or directory is left untouched, so a cache pointed to a directory used for something else never removes its
+// content
+func (dc *DiskCache) walk(fn func(path string, info os.FileInfo) error) error {
+	shards, err := ioutil.ReadDir(dc.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, shard := range shards {
+		if !shard.IsDir() || !isShard(shard.Name()) {
+			continue
+		}
+		shardDir := filepath.Join(dc.dir, shard.Name())
+		entries, err := ioutil.ReadDir(shardDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && strings.HasPrefix(entry.Name(), temporaryPrefix) && time.Since(entry.ModTime()) > staleTemporaryAge {
+				if err := os.Remove(filepath.Join(shardDir, entry.Name())); err != nil && !os.IsNotExist(err) {
+					log.Warnf("error removing stale cache file %v: %v", filepath.Join(shardDir, entry.Name()), err)
+				}
+				continue
+			}
+			if !entry.Mode().IsRegular() || !isEntry(entry.Name()) || entry.Name()[:2] != shard.Name() {
+				continue
+			}
+			if err := fn(filepath.Join(shardDir, entry.Name()), entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// read parses an entry file, returning its key, expiration and value
+func read(path string) (string, time.Time, []byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", time.Time{}, nil, err
+	}
+	if len(content) < diskHeaderSize {
+		return "", time.Time{}, nil, fmt.Errorf("corrupted cache entry %v", path)
+	}
+	expiration := time.Unix(0, int64(binary.BigEndian.Uint64(content[:8])))
+	keyLength := int(binary.BigEndian.Uint32(content[8:diskHeaderSize]))
+	if len(content) < diskHeaderSize+keyLength {
+		return "", time.Time{}, nil, fmt.Errorf("corrupted cache entry %v", path)
+	}
+	key := string(content[diskHeaderSize : diskHeaderSize+keyLength])
+	return key, expiration, content[diskHeaderSize+keyLength:], nil
+}
+
+// Get returns the value stored for a key and whether it was found and not expired
+func (dc *DiskCache) Get(key string) (string, bool, error) {
+	value, _, found, err := dc.GetTTL(key)
+	return value, found, err
+}
+
+// GetTTL returns the value stored for a key along with the time it has left to live, and whether it was found and not expired
+func (dc *DiskCache) GetTTL(key string) (string, time.Duration, bool, error) {
+	path := dc.path(key)
+	storedKey, expiration, value, err := read(path)
+	if os.IsNotExist(err) {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+	if storedKey != key {
+		// hash collision; the entry belongs to another key
+		return "", 0, false, nil
+	}
+	ttl := time.Until(expiration)
+	if ttl <= 0 {
+		dc.Delete(key)
+		return "", 0, false, nil
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return string(value), ttl, true, nil
+}
+
+// Set stores a value for a key during ttl, evicting the least recently used entries if the cache exceeds its size
+func (dc *DiskCache) Set(key string, value string, ttl time.Duration) error {
+	content := make([]byte, diskHeaderSize, diskHeaderSize+len(key)+len(value))
+	binary.BigEndian.PutUint64(content[:8], uint64(time.Now().Add(ttl).UnixNano()))
+	binary.BigEndian.PutUint32(content[8:diskHeaderSize], uint32(len(key)))
+	content = append(content, key...)
+	content = append(content, value...)
+
+	path := dc.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating cache directory: %v", err)
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(path), temporaryPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("error creating cache entry: %v", err)
+	}
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return fmt.Errorf("error writing cache entry: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("error closing cache entry: %v", err)
+	}
+
+	dc.sync.Lock()
+	defer dc.sync.Unlock()
+	var previous int64
+	if info, err := os.Stat(path); err == nil {
+		previous = info.Size()
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("error saving cache entry: %v", err)
+	}
+	dc.size += int64(len(content)) - previous
+	if dc.size > dc.maxBytes {
+		return dc.evict()
+	}
+	return nil
+}
+
+// evict removes the least recently used entries until the cache uses 90% of its size
+func (dc *DiskCache) evict() error {
+	type candidate struct {
+		path       string
+		size       int64
+		lastAccess time.Time
+	}
+	candidates := make([]candidate, 0)
+	var size int64
+	err := dc.walk(func(path string, info os.FileInfo) error {
+		candidates = append(candidates, candidate{path: path, size: info.Size(), lastAccess: info.ModTime()})
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error evicting cache entries: %v", err)
+	}
+	sort.Slice(candidates, func(a, b int) bool {
+		return candidates[a].lastAccess.Before(candidates[b].lastAccess)
+	})
+
+	target := dc.maxBytes / 10 * 9
+	evicted := 0
+	for _, entry := range candidates {
+		if size <= target {
+			break
+		}
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error evicting cache entry %v: %v", entry.path, err)
+		}
+		size -= entry.size
+		evicted++
+	}
+	dc.size = size
+	log.Debugf("evicted %v entries from disk cache %v", evicted, dc.dir)
+	return nil
+}
+
+// Delete removes a key from disk
+func (dc *DiskCache) Delete(key string) error {
+	dc.sync.Lock()
+	defer dc.sync.Unlock()
+	path := dc.path(key)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dc.size -= info.Size()
+	return nil
+}
+
+// Entries describes every entry stored on the cache, expired or not
+func (dc *DiskCache) Entries() ([]Entry, error) {
+	result := make([]Entry, 0)
+	err := dc.walk(func(path string, info os.FileInfo) error {
+		key, expiration, _, err := read(path)
+		if err != nil {
+			log.Warnf("skipping cache entry %v: %v", path, err)
+			return nil
+		}
+		result = append(result, Entry{
+			Key:        key,
+			Size:       info.Size(),
+			Expiration: expiration,
+			LastAccess: info.ModTime(),
+		})
+		return nil
+	})
+	return result, err
+}
+
+// PurgeExpired removes every expired entry, returning how many were removed
+func (dc *DiskCache) PurgeExpired() (int, error) {
+	entries, err := dc.Entries()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, entry := range entries {
+		if !entry.Expired() {
+			continue
+		}
+		if err := dc.Delete(entry.Key); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// Clear removes every entry of the cache and the stale temporary files, along with the shards left empty; files not
+// written by the cache, and the ones being written, are kept
+func (dc *DiskCache) Clear() error {
+	dc.sync.Lock()
+	defer dc.sync.Unlock()
+	err := dc.walk(func(path string, info os.FileInfo) error {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		dc.size -= info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error clearing cache directory %v: %v", dc.dir, err)
+	}
+	shards, _ := ioutil.ReadDir(dc.dir)
+	for _, shard := range shards {
+		if shard.IsDir() && isShard(shard.Name()) {
+			// fails while the shard holds anything else, which is then kept
+			os.Remove(filepath.Join(dc.dir, shard.Name()))
+		}
+	}
+	dc.size = 0
+	return nil
+}
+
+// Size returns the amount of bytes used by the cache
+func (dc *DiskCache) Size() int64 {
+	dc.sync.Lock()
+	defer dc.sync.Unlock()
+	return dc.size
+}
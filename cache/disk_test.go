@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempDiskCache opens a disk cache on a new temporary directory
+func tempDiskCache(t *testing.T, maxBytes int64) (*DiskCache, string) {
+	dir, err := ioutil.TempDir("", "disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewDiskCache(dir, maxBytes)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return c, dir
+}
+
+// writeFile creates a file, and its directories, under dir
+func writeFile(t *testing.T, dir string, name string) string {
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("not a cache entry"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDiskCache(t *testing.T) {
+	c, dir := tempDiskCache(t, DefaultDiskSize)
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name      string
+		key       string
+		value     string
+		ttl       time.Duration
+		delete    bool
+		wantFound bool
+	}{
+		{"stored value", "a", "1", time.Hour, false, true},
+		{"empty value", "b", "", time.Hour, false, true},
+		{"expired value", "c", "3", -time.Second, false, false},
+		{"deleted value", "d", "4", time.Hour, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := c.Set(test.key, test.value, test.ttl); err != nil {
+				t.Fatal(err)
+			}
+			if test.delete {
+				if err := c.Delete(test.key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, ttl, found, err := c.GetTTL(test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != test.wantFound || (found && got != test.value) {
+				t.Errorf("Get(%v) = %q, %v, want %q, %v", test.key, got, found, test.value, test.wantFound)
+			}
+			if found && (ttl > test.ttl || ttl < test.ttl-time.Second) {
+				t.Errorf("GetTTL(%v) ttl = %v, want %v", test.key, ttl, test.ttl)
+			}
+		})
+	}
+}
+
+func TestDiskCacheForeignFiles(t *testing.T) {
+	foreign := []string{
+		"notes.txt",
+		"project/main.go",
+		"ab/readme.md",
+		"zz/" + "zz00000000000000000000000000000000000000000000000000000000000000",
+		"ab/" + "cd00000000000000000000000000000000000000000000000000000000000000",
+		"AB/" + "AB00000000000000000000000000000000000000000000000000000000000000",
+	}
+	tests := []struct {
+		name string
+		run  func(c *DiskCache) error
+	}{
+		{"clear", func(c *DiskCache) error { return c.Clear() }},
+		{"purge", func(c *DiskCache) error {
+			_, err := c.PurgeExpired()
+			return err
+		}},
+		{"evict", func(c *DiskCache) error {
+			c.maxBytes = 1
+			return c.Set("evicting", "value", time.Hour)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, dir := tempDiskCache(t, DefaultDiskSize)
+			defer os.RemoveAll(dir)
+			paths := make([]string, 0, len(foreign))
+			for _, name := range foreign {
+				paths = append(paths, writeFile(t, dir, name))
+			}
+			if err := c.Set("key", "value", -time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if err := test.run(c); err != nil {
+				t.Fatalf("%v error = %v", test.name, err)
+			}
+			for _, path := range paths {
+				if _, err := os.Stat(path); err != nil {
+					t.Errorf("%v removed foreign file %v: %v", test.name, path, err)
+				}
+			}
+			if _, err := os.Stat(c.path("key")); !os.IsNotExist(err) {
+				t.Errorf("%v kept entry of key: %v", test.name, err)
+			}
+		})
+	}
+}
+
+func TestDiskCacheSize(t *testing.T) {
+	c, dir := tempDiskCache(t, DefaultDiskSize)
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "notes.txt")
+	if err := c.Set("key", "value", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewDiskCache(dir, DefaultDiskSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Size() != c.Size() {
+		t.Errorf("reopened cache size = %v, want %v", reopened.Size(), c.Size())
+	}
+	if err := reopened.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Size() != 0 {
+		t.Errorf("cleared cache size = %v, want 0", reopened.Size())
+	}
+}
+
+func TestDiskCacheStaleTemporaryFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stale := writeFile(t, dir, filepath.Join("ab", temporaryPrefix+"stale"))
+	old := time.Now().Add(-2 * staleTemporaryAge)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+	writing := writeFile(t, dir, filepath.Join("cd", temporaryPrefix+"writing"))
+
+	c, err := NewDiskCache(dir, DefaultDiskSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("NewDiskCache() kept stale temporary file, stat error = %v", err)
+	}
+	if _, err := os.Stat(writing); err != nil {
+		t.Errorf("NewDiskCache() removed a temporary file being written: %v", err)
+	}
+	if size := c.Size(); size != 0 {
+		t.Errorf("Size() = %v, want 0", size)
+	}
+
+	if err := os.Chtimes(writing, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Clear() left %v files in the cache directory, want none", len(files))
+	}
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BackfillTTL is the time a value found on an inner layer is kept on the layers before it when that layer cannot tell how
+// long the value has left to live
+const BackfillTTL = 5 * time.Minute
+
+// TTLCache is a Cache able to return how long its values have left to live along with them, so layered caches keep the
+// values they backfill for as long as the layer they were found on does, which is the TTL or MissTTL they were set with
+type TTLCache interface {
+	Cache
+	GetTTL(key string) (string, time.Duration, bool, error)
+}
+
+// LayeredCache looks up keys on several caches, from the fastest to the slowest, and writes to every one of them
+type LayeredCache struct {
+	layers []Cache
+}
+
+// NewLayeredCache creates a cache made of the given layers, the first one being looked up first
+func NewLayeredCache(layers ...Cache) *LayeredCache {
+	return &LayeredCache{
+		layers: layers,
+	}
+}
+
+// Get returns the value of the first layer that has the key, storing it on the layers before it
+func (lc *LayeredCache) Get(key string) (string, bool, error) {
+	value, _, found, err := lc.GetTTL(key)
+	return value, found, err
+}
+
+// GetTTL returns the value of the first layer that has the key along with the time it has left to live there, storing it
+// on the layers before it for that time
+func (lc *LayeredCache) GetTTL(key string) (string, time.Duration, bool, error) {
+	for i, layer := range lc.layers {
+		value, ttl, found, err := getTTL(layer, key)
+		if err != nil {
+			log.Errorf("error reading key %v from cache layer %v: %v", key, i, err)
+			continue
+		}
+		if !found {
+			continue
+		}
+		for _, previous := range lc.layers[:i] {
+			if err := previous.Set(key, value, ttl); err != nil {
+				log.Errorf("error backfilling key %v: %v", key, err)
+			}
+		}
+		return value, ttl, true, nil
+	}
+	return "", 0, false, nil
+}
+
+// getTTL reads a key from a cache along with the time it has left to live, which is BackfillTTL when the cache cannot tell
+func getTTL(c Cache, key string) (string, time.Duration, bool, error) {
+	if expiring, ok := c.(TTLCache); ok {
+		value, ttl, found, err := expiring.GetTTL(key)
+		if found && ttl <= 0 {
+			ttl = BackfillTTL
+		}
+		return value, ttl, found, err
+	}
+	value, found, err := c.Get(key)
+	return value, BackfillTTL, found, err
+}
+
+// Set stores a value on every layer
+func (lc *LayeredCache) Set(key string, value string, ttl time.Duration) error {
+	var result error
+	for _, layer := range lc.layers {
+		if err := layer.Set(key, value, ttl); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Delete removes a key from every layer
+func (lc *LayeredCache) Delete(key string) error {
+	var result error
+	for _, layer := range lc.layers {
+		if err := layer.Delete(key); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// plainCache is a Cache unable to tell how long its values have left to live
+type plainCache struct {
+	values map[string]string
+	err    error
+}
+
+func (pc plainCache) Get(key string) (string, bool, error) {
+	value, found := pc.values[key]
+	return value, found, pc.err
+}
+
+func (pc plainCache) Set(key string, value string, ttl time.Duration) error {
+	pc.values[key] = value
+	return nil
+}
+
+func (pc plainCache) Delete(key string) error {
+	delete(pc.values, key)
+	return nil
+}
+
+func TestLayeredCacheBackfill(t *testing.T) {
+	tests := []struct {
+		name      string
+		inner     func() Cache
+		wantFound bool
+		wantTTL   time.Duration
+	}{
+		{
+			name: "remaining ttl of the inner layer",
+			inner: func() Cache {
+				c := NewMemoryCache(DefaultMemorySize)
+				c.Set("key", "value", time.Hour)
+				return c
+			},
+			wantFound: true,
+			wantTTL:   time.Hour,
+		},
+		{
+			name: "miss ttl of the inner layer",
+			inner: func() Cache {
+				c := NewMemoryCache(DefaultMemorySize)
+				c.Set("key", "value", 10*time.Second)
+				return c
+			},
+			wantFound: true,
+			wantTTL:   10 * time.Second,
+		},
+		{
+			name: "inner layer unable to tell its ttl",
+			inner: func() Cache {
+				return plainCache{values: map[string]string{"key": "value"}}
+			},
+			wantFound: true,
+			wantTTL:   BackfillTTL,
+		},
+		{
+			name: "failing inner layer",
+			inner: func() Cache {
+				return plainCache{values: map[string]string{}, err: fmt.Errorf("unreachable")}
+			},
+		},
+		{
+			name: "missing key",
+			inner: func() Cache {
+				return NewMemoryCache(DefaultMemorySize)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outer := NewMemoryCache(DefaultMemorySize)
+			c := NewLayeredCache(outer, test.inner())
+			value, found, err := c.Get("key")
+			if err != nil {
+				t.Fatalf("Get error = %v", err)
+			}
+			if found != test.wantFound {
+				t.Fatalf("Get found = %v, want %v", found, test.wantFound)
+			}
+			_, ttl, backfilled, _ := outer.GetTTL("key")
+			if backfilled != test.wantFound {
+				t.Fatalf("backfilled = %v, want %v", backfilled, test.wantFound)
+			}
+			if !found {
+				return
+			}
+			if value != "value" {
+				t.Errorf("Get = %v, want value", value)
+			}
+			if ttl > test.wantTTL || ttl < test.wantTTL-time.Second {
+				t.Errorf("backfilled ttl = %v, want %v", ttl, test.wantTTL)
+			}
+		})
+	}
+}
+
+func TestLayeredCacheExpiresWithInnerLayer(t *testing.T) {
+	outer := NewMemoryCache(DefaultMemorySize)
+	inner := NewMemoryCache(DefaultMemorySize)
+	inner.Set("key", "value", 50*time.Millisecond)
+	c := NewLayeredCache(outer, inner)
+	if _, found, _ := c.Get("key"); !found {
+		t.Fatalf("Get found = false, want true")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, found, _ := outer.Get("key"); found {
+		t.Errorf("backfilled value outlived the inner one")
+	}
+	if _, found, _ := c.Get("key"); found {
+		t.Errorf("Get found = true after the inner value expired")
+	}
+}
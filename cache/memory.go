@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/VictoriaMetrics/fastcache"
+)
+
+// DefaultMemorySize is the amount of bytes used by memory caches built by New
+const DefaultMemorySize = 100 << 20 // 100 MB
+
+// MemoryCache is a Cache kept in process memory, evicting the oldest entries once it reaches its size
+type MemoryCache struct {
+	cache *fastcache.Cache
+}
+
+// NewMemoryCache creates a memory cache bounded to maxBytes
+func NewMemoryCache(maxBytes int) *MemoryCache {
+	return &MemoryCache{
+		cache: fastcache.New(maxBytes),
+	}
+}
+
+// Get returns the value stored for a key and whether it was found and not expired
+func (mc *MemoryCache) Get(key string) (string, bool, error) {
+	value, _, found, err := mc.GetTTL(key)
+	return value, found, err
+}
+
+// GetTTL returns the value stored for a key along with the time it has left to live, and whether it was found and not expired
+func (mc *MemoryCache) GetTTL(key string) (string, time.Duration, bool, error) {
+	entry := mc.cache.GetBig(nil, []byte(key))
+	if len(entry) < 8 {
+		return "", 0, false, nil
+	}
+	ttl := time.Until(time.Unix(0, int64(binary.BigEndian.Uint64(entry[:8]))))
+	if ttl <= 0 {
+		mc.cache.Del([]byte(key))
+		return "", 0, false, nil
+	}
+	return string(entry[8:]), ttl, true, nil
+}
+
+// Set stores a value for a key during ttl; the expiration is kept in the first 8 bytes of the entry
+func (mc *MemoryCache) Set(key string, value string, ttl time.Duration) error {
+	entry := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(entry, uint64(time.Now().Add(ttl).UnixNano()))
+	entry = append(entry, value...)
+	mc.cache.SetBig([]byte(key), entry)
+	return nil
+}
+
+// Delete removes a key from memory
+func (mc *MemoryCache) Delete(key string) error {
+	mc.cache.Del([]byte(key))
+	return nil
+}
@@ -2,100 +2,76 @@ package cache
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"time"
 
-	"github.com/ezeriver94/gotransform/env"
-	log "github.com/sirupsen/logrus"
-
-	"github.com/VictoriaMetrics/fastcache"
 	"github.com/go-redis/cache/v8"
 	"github.com/go-redis/redis/v8"
 )
 
-var redisCache *cache.Cache = nil
-var (
-	cacheHost     string
-	cachePassword string
-	cachePort     int
-	cacheEnabled  bool = false
-)
+// RedisCache is a Cache stored in a redis server
+type RedisCache struct {
+	cache *cache.Cache
+	ring  *redis.Ring
+}
 
-func init() {
-	cacheHost := env.GetString("REDIS_CACHE_HOST")
-	cachePassword := env.GetString("REDIS_CACHE_PASSWORD")
-	if len(cacheHost) == 0 {
-		return
-	}
-	cacheEnabled = true
-	err := env.Get("REDIS_CACHE_PORT", &cachePort, 6379, nil)
-	if err != nil {
-		log.Fatalf("error parsing REDIS_CACHE_PORT envVar: %v", err)
-	}
+// NewRedisCache creates a cache connected to a redis server
+func NewRedisCache(host string, port int, password string) *RedisCache {
 	ring := redis.NewRing(&redis.RingOptions{
 		Addrs: map[string]string{
-			"server1": fmt.Sprintf("%v:%v", cacheHost, cachePort),
+			"server1": fmt.Sprintf("%v:%v", host, port),
 		},
-		Password: cachePassword,
-	})
-	redisCache = cache.New(&cache.Options{
-		Redis:      ring,
-		LocalCache: fastcache.New(100 << 20), // 100 MB
+		Password: password,
 	})
+	return &RedisCache{
+		cache: cache.New(&cache.Options{
+			Redis: ring,
+		}),
+		ring: ring,
+	}
 }
 
-func valueToString(value interface{}) (string, error) {
-	switch value.(type) {
-	case string:
-		return value.(string), nil
-	default:
-		result, err := json.Marshal(value)
-		return string(result), err
+// Get returns the value stored for a key and whether it was found
+func (rc *RedisCache) Get(key string) (string, bool, error) {
+	var result string
+	err := rc.cache.Get(context.TODO(), key, &result)
+	if err == cache.ErrCacheMiss {
+		return "", false, nil
 	}
+	if err != nil {
+		return "", false, err
+	}
+	return result, true, nil
 }
 
-// Retrieve tries to get a value from redis cache (if setted); if found, it returns it, otherwise, the function get is executed and stored in cache, and returned
-func Retrieve(key string, get func() (interface{}, error)) (string, error) {
-	var stringResult string
-	var err error
-	if redisCache != nil {
-		ctx := context.TODO()
-		var result interface{}
-		if err = redisCache.Get(ctx, key, &result); err != nil {
-			log.Debugf("cache miss for key %v. fetching data", key)
-
-			result, err = get()
-			if err != nil {
-				return "", err
-			}
-			stringResult, err = valueToString(result)
-			if err != nil {
-				return "", err
-			}
+// GetTTL returns the value stored for a key along with the time it has left to live, and whether it was found
+func (rc *RedisCache) GetTTL(key string) (string, time.Duration, bool, error) {
+	result, found, err := rc.Get(key)
+	if !found || err != nil {
+		return result, 0, found, err
+	}
+	ttl, err := rc.ring.TTL(context.TODO(), key).Result()
+	if err != nil {
+		return "", 0, false, err
+	}
+	return result, ttl, true, nil
+}
 
-			log.Debugf("saving key %v with value %v in cache", key, stringResult)
-			if err := redisCache.Set(&cache.Item{
-				Ctx:   ctx,
-				Key:   key,
-				Value: stringResult,
-				TTL:   time.Hour,
-			}); err != nil {
-				log.Errorf("error saving on cache %v", err)
-			} else {
-				log.Debugf("cache key %v saved successfully", key)
-			}
+// Set stores a value for a key during ttl
+func (rc *RedisCache) Set(key string, value string, ttl time.Duration) error {
+	return rc.cache.Set(&cache.Item{
+		Ctx:   context.TODO(),
+		Key:   key,
+		Value: value,
+		TTL:   ttl,
+	})
+}
 
-		}
-	} else {
-		result, err := get()
-		if err != nil {
-			return "", err
-		}
-		stringResult, err = valueToString(result)
-		if err != nil {
-			return "", err
-		}
+// Delete removes a key from redis
+func (rc *RedisCache) Delete(key string) error {
+	err := rc.cache.Delete(context.TODO(), key)
+	if err == cache.ErrCacheMiss {
+		return nil
 	}
-	return stringResult, nil
+	return err
 }
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"sync"
+)
+
+// flight is a call in progress whose result is shared by every caller asking for the same key
+type flight struct {
+	wait  sync.WaitGroup
+	value string
+	err   error
+}
+
+// group coalesces concurrent calls with the same key into a single one; keys are any comparable value
+type group struct {
+	flights map[interface{}]*flight
+	sync    sync.Mutex
+}
+
+func newGroup() *group {
+	return &group{
+		flights: make(map[interface{}]*flight),
+	}
+}
+
+// do executes fn once for every set of concurrent callers of the same key, returning its result to all of them along with
+// whether the result was shared from another caller
+func (g *group) do(key interface{}, fn func() (string, error)) (string, bool, error) {
+	g.sync.Lock()
+	if existing, ok := g.flights[key]; ok {
+		g.sync.Unlock()
+		existing.wait.Wait()
+		return existing.value, true, existing.err
+	}
+	current := &flight{}
+	current.wait.Add(1)
+	g.flights[key] = current
+	g.sync.Unlock()
+
+	defer func() {
+		g.sync.Lock()
+		delete(g.flights, key)
+		g.sync.Unlock()
+		current.wait.Done()
+	}()
+	current.value, current.err = fn()
+	return current.value, false, current.err
+}
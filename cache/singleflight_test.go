@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupDo(t *testing.T) {
+	tests := []struct {
+		name    string
+		callers int
+		err     error
+	}{
+		{name: "single caller", callers: 1},
+		{name: "concurrent callers", callers: 10},
+		{name: "concurrent callers sharing an error", callers: 10, err: fmt.Errorf("unreachable")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := newGroup()
+			var calls int32
+			release := make(chan struct{})
+			fn := func() (string, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "value", test.err
+			}
+
+			var wait sync.WaitGroup
+			var shared int32
+			for i := 0; i < test.callers; i++ {
+				wait.Add(1)
+				go func() {
+					defer wait.Done()
+					value, wasShared, err := g.do("key", fn)
+					if err != test.err || value != "value" {
+						t.Errorf("do() = %v, %v, want value, %v", value, err, test.err)
+					}
+					if wasShared {
+						atomic.AddInt32(&shared, 1)
+					}
+				}()
+			}
+			// lets every caller join the flight before it ends
+			for atomic.LoadInt32(&calls) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+			wait.Wait()
+
+			if calls != 1 {
+				t.Errorf("fn called %v times, want 1", calls)
+			}
+			if int(shared) != test.callers-1 {
+				t.Errorf("%v callers shared the result, want %v", shared, test.callers-1)
+			}
+			if waiting(g, "key") {
+				t.Errorf("flight of key was not removed")
+			}
+		})
+	}
+}
+
+func TestGroupDoSequential(t *testing.T) {
+	g := newGroup()
+	calls := 0
+	for i := 0; i < 3; i++ {
+		_, shared, _ := g.do("key", func() (string, error) {
+			calls++
+			return "value", nil
+		})
+		if shared {
+			t.Errorf("sequential call %v shared a finished flight", i)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("fn called %v times, want 3", calls)
+	}
+}
+
+// waiting indicates whether a flight of key is in progress
+func waiting(g *group, key string) bool {
+	g.sync.Lock()
+	defer g.sync.Unlock()
+	_, ok := g.flights[key]
+	return ok
+}
+
+func TestRetrieveCoalesces(t *testing.T) {
+	shared := NewMemoryCache(DefaultMemorySize)
+	tests := []struct {
+		name          string
+		cache         func() Cache
+		wantCalls     int32
+		wantMisses    int64
+		wantCoalesced int64
+	}{
+		{name: "same cache", cache: func() Cache { return shared }, wantCalls: 1, wantMisses: 1, wantCoalesced: 4},
+		{name: "different caches", cache: func() Cache { return NewMemoryCache(DefaultMemorySize) }, wantCalls: 5, wantMisses: 5},
+		{name: "caches without identity", cache: NewNoopCache, wantCalls: 5, wantMisses: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := "coalesced test " + test.name
+			before := Statistics()[source]
+			var calls int32
+			release := make(chan struct{})
+			var wait sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wait.Add(1)
+				c := test.cache()
+				go func() {
+					defer wait.Done()
+					value, err := Retrieve(c, Policy{Source: source}, "coalesced key", func() (interface{}, error) {
+						atomic.AddInt32(&calls, 1)
+						<-release
+						return "value", nil
+					})
+					if err != nil || value != "value" {
+						t.Errorf("Retrieve() = %v, %v, want value", value, err)
+					}
+				}()
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wait.Wait()
+
+			if calls != test.wantCalls {
+				t.Errorf("getter called %v times, want %v", calls, test.wantCalls)
+			}
+			stats := Statistics()[source]
+			if misses, coalesced := stats.Misses-before.Misses, stats.Coalesced-before.Coalesced; misses != test.wantMisses || coalesced != test.wantCoalesced {
+				t.Errorf("retrievals added %v misses and %v coalesced, want %v and %v", misses, coalesced, test.wantMisses, test.wantCoalesced)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Stats counts the activity of the cache for the lookups of a single source
+type Stats struct {
+	Hits         int64 `json:"hits"`
+	Misses       int64 `json:"misses"`
+	Coalesced    int64 `json:"coalesced"`
+	Errors       int64 `json:"errors"`
+	Sets         int64 `json:"sets"`
+	BytesRead    int64 `json:"bytesRead"`
+	BytesWritten int64 `json:"bytesWritten"`
+}
+
+var (
+	statistics     = make(map[string]*Stats)
+	statisticsSync sync.Mutex
+)
+
+func init() {
+	expvar.Publish("cache", expvar.Func(func() interface{} {
+		return Statistics()
+	}))
+}
+
+// record applies a change on the stats of a source
+func record(source string, change func(stats *Stats)) {
+	statisticsSync.Lock()
+	defer statisticsSync.Unlock()
+	stats, ok := statistics[source]
+	if !ok {
+		stats = &Stats{}
+		statistics[source] = stats
+	}
+	change(stats)
+}
+
+// Statistics returns a copy of the stats of every source looked up since the process started
+func Statistics() map[string]Stats {
+	statisticsSync.Lock()
+	defer statisticsSync.Unlock()
+	result := make(map[string]Stats, len(statistics))
+	for source, stats := range statistics {
+		result[source] = *stats
+	}
+	return result
+}
+
+// Since returns the activity counted after earlier was taken
+func (s Stats) Since(earlier Stats) Stats {
+	return Stats{
+		Hits:         s.Hits - earlier.Hits,
+		Misses:       s.Misses - earlier.Misses,
+		Coalesced:    s.Coalesced - earlier.Coalesced,
+		Errors:       s.Errors - earlier.Errors,
+		Sets:         s.Sets - earlier.Sets,
+		BytesRead:    s.BytesRead - earlier.BytesRead,
+		BytesWritten: s.BytesWritten - earlier.BytesWritten,
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beevik/guid"
+
+	"github.com/ezeriver94/gotransform/cache"
+	"github.com/ezeriver94/gotransform/env"
+	"github.com/ezeriver94/gotransform/phases"
+	"github.com/ezeriver94/gotransform/state"
+)
+
+func cacheUsage() {
+	fmt.Fprintf(os.Stderr, "usage: gotransform cache <subcommand> [arguments]\n\nsubcommands:\n")
+	fmt.Fprintf(os.Stderr, "  stats    shows the amount of entries and bytes of the disk cache\n")
+	fmt.Fprintf(os.Stderr, "  list     lists the entries of the disk cache\n")
+	fmt.Fprintf(os.Stderr, "  purge    removes the expired entries of the disk cache\n")
+	fmt.Fprintf(os.Stderr, "  clear    removes every entry of the disk cache\n")
+	fmt.Fprintf(os.Stderr, "  warm     populates the cache with the lookups of a sample of the primary data of a metadata file\n")
+}
+
+// cacheCommand inspects and clears the disk cache configured by the DISK_CACHE_DIR envVar or the -dir argument, or warms
+// up any cache
+func cacheCommand(args []string) error {
+	if len(args) < 1 {
+		cacheUsage()
+		os.Exit(2)
+	}
+	subcommand := args[0]
+	if subcommand == "warm" {
+		return warmCache(args[1:])
+	}
+	flags := flag.NewFlagSet("cache "+subcommand, flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of the disk cache; defaults to DISK_CACHE_DIR envVar or "+cache.DefaultDiskDir)
+	prefix := flags.String("prefix", "", "only list entries whose key starts with this prefix")
+	parseFlags(flags, args[1:])
+
+	if *dir != "" {
+		env.Override(map[string]string{"DISK_CACHE_DIR": *dir})
+	}
+	disk, err := cache.NewDiskCacheFromEnv()
+	if err != nil {
+		return err
+	}
+
+	switch subcommand {
+	case "stats":
+		entries, err := disk.Entries()
+		if err != nil {
+			return err
+		}
+		expired := 0
+		for _, entry := range entries {
+			if entry.Expired() {
+				expired++
+			}
+		}
+		fmt.Printf("entries: %v\nexpired: %v\nbytes:   %v\n", len(entries), expired, disk.Size())
+	case "list":
+		entries, err := disk.Entries()
+		if err != nil {
+			return err
+		}
+		sort.Slice(entries, func(a, b int) bool {
+			return entries[a].Key < entries[b].Key
+		})
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "KEY\tBYTES\tEXPIRES\tLAST ACCESS")
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Key, *prefix) {
+				continue
+			}
+			expires := entry.Expiration.Format(time.RFC3339)
+			if entry.Expired() {
+				expires = "expired"
+			}
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", entry.Key, entry.Size, expires, entry.LastAccess.Format(time.RFC3339))
+		}
+		return writer.Flush()
+	case "purge":
+		purged, err := disk.PurgeExpired()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("purged %v expired entries\n", purged)
+	case "clear":
+		if err := disk.Clear(); err != nil {
+			return err
+		}
+		fmt.Println("cache cleared")
+	default:
+		cacheUsage()
+		os.Exit(2)
+	}
+	return nil
+}
+
+// warmCache transforms a sample of the primary data of a metadata file, so the lookups of its joins are stored in cache
+// before the job runs
+func warmCache(args []string) error {
+	flags := flag.NewFlagSet("cache warm", flag.ExitOnError)
+	metadataPath := flags.String("metadata", "", "path of the metadata file whose lookups are warmed")
+	cacheKind := flags.String("cache", "", "cache to warm: memory, disk, redis, layered or a comma separated list of them; defaults to layered when REDIS_CACHE_HOST is set, memory otherwise")
+	sample := flags.Int("sample", 1000, "amount of records of every primary datasource to transform; 0 transforms all of them")
+	statePath := flags.String("state", ".gotransform-state.json", "file path or redis:// url where watermarks are read from")
+	reportPath := flags.String("report", "", "file path where the json report of the warm up is written")
+	params := newParamFlags(flags)
+	parseFlags(flags, args)
+
+	runID := guid.New().String()
+	metadata, err := loadMetadata(*metadataPath, params, runID)
+	if err != nil {
+		return err
+	}
+	store, err := state.NewStore(*statePath)
+	if err != nil {
+		return fmt.Errorf("error opening state store: %v", err)
+	}
+	lookups, err := newCache(*cacheKind)
+	if err != nil {
+		return err
+	}
+	pipeline, err := phases.NewPipeline(metadata, store, lookups, runID)
+	if err != nil {
+		return err
+	}
+	err = pipeline.Warm(*sample)
+	return report(pipeline, *reportPath, err)
+}
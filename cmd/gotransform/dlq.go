@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ezeriver94/gotransform/broker"
+	"github.com/ezeriver94/gotransform/common"
+	"github.com/ezeriver94/gotransform/phases"
+	"github.com/ezeriver94/gotransform/rabbit"
+)
+
+func dlqUsage() {
+	fmt.Fprintf(os.Stderr, "usage: gotransform dlq <subcommand> [arguments]\n\nsubcommands:\n")
+	fmt.Fprintf(os.Stderr, "  list     lists the messages of the dead-letter queue of a stage\n")
+	fmt.Fprintf(os.Stderr, "  show     prints the headers and decoded records of the messages\n")
+	fmt.Fprintf(os.Stderr, "  replay   publishes the messages again to their original routing key\n")
+	fmt.Fprintf(os.Stderr, "  purge    removes the messages from the dead-letter queue\n")
+}
+
+// deadLetter is a dead-lettered message decoded as the Transformed record of a transformation or the record of a
+// primary datasource
+type deadLetter struct {
+	letter         rabbit.DeadLetter
+	transformation string
+	dataSource     string
+	record         common.Record
+	decodeErr      error
+}
+
+func decodeDeadLetter(letter rabbit.DeadLetter) deadLetter {
+	result := deadLetter{letter: letter}
+	result.dataSource, _ = letter.Delivery.Headers[phases.DataSourceHeader].(string)
+	transformed, err := phases.DeserializeTransformed(letter.Delivery.Body)
+	if err == nil && transformed.TransformationName != "" {
+		result.transformation = transformed.TransformationName
+		result.record = transformed.Record
+		return result
+	}
+	result.decodeErr = json.Unmarshal(letter.Delivery.Body, &result.record)
+	return result
+}
+
+func (dl deadLetter) guid() string {
+	if dl.record.ID == nil {
+		return ""
+	}
+	return dl.record.ID.String()
+}
+
+// source returns the transformation or datasource the message belongs to
+func (dl deadLetter) source() string {
+	if dl.transformation != "" {
+		return dl.transformation
+	}
+	return dl.dataSource
+}
+
+// deadLetterFilter selects the messages a dlq subcommand works with; empty fields match every message
+type deadLetterFilter struct {
+	transformation string
+	errorText      string
+	guid           string
+}
+
+func (f deadLetterFilter) matches(dl deadLetter) bool {
+	if f.transformation != "" && dl.transformation != f.transformation {
+		return false
+	}
+	if f.errorText != "" && !strings.Contains(dl.letter.LastError, f.errorText) {
+		return false
+	}
+	if f.guid != "" && !strings.EqualFold(dl.guid(), f.guid) {
+		return false
+	}
+	return true
+}
+
+// dlqCommand inspects, replays and purges the dead-letter queue of a stage of a distributed job
+func dlqCommand(args []string) error {
+	if len(args) < 1 {
+		dlqUsage()
+		os.Exit(2)
+	}
+	subcommand := args[0]
+	flags := flag.NewFlagSet("dlq "+subcommand, flag.ExitOnError)
+	job := flags.String("job", "gotransform", "name of the job whose dead-letter queue is read")
+	stage := flags.String("stage", phases.StageTransformed, "stage whose dead-letter queue is read: extracted or transformed")
+	queue := flags.String("queue", "", "queue whose dead-letter queue is read, instead of the one of -job and -stage")
+	filter := deadLetterFilter{}
+	flags.StringVar(&filter.transformation, "transformation", "", "only messages of this transformation")
+	flags.StringVar(&filter.errorText, "error", "", "only messages whose last error contains this text")
+	flags.StringVar(&filter.guid, "guid", "", "only the message of the record with this guid")
+	limit := flags.Int("limit", 0, "maximum amount of messages to work with; 0 means all of them")
+	parseFlags(flags, args[1:])
+
+	var apply func(browser *rabbit.DeadLetterBrowser, dl deadLetter) error
+	switch subcommand {
+	case "list":
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		defer writer.Flush()
+		fmt.Fprintln(writer, "GUID\tSOURCE\tATTEMPTS\tFAILED AT\tERROR")
+		apply = func(browser *rabbit.DeadLetterBrowser, dl deadLetter) error {
+			_, err := fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\n", dl.guid(), dl.source(), dl.letter.Attempts, dl.letter.FailedAt, dl.letter.LastError)
+			return err
+		}
+	case "show":
+		apply = func(browser *rabbit.DeadLetterBrowser, dl deadLetter) error {
+			return showDeadLetter(dl)
+		}
+	case "replay":
+		apply = func(browser *rabbit.DeadLetterBrowser, dl deadLetter) error {
+			return browser.Replay(dl.letter)
+		}
+	case "purge":
+		apply = func(browser *rabbit.DeadLetterBrowser, dl deadLetter) error {
+			return browser.Discard(dl.letter)
+		}
+	default:
+		dlqUsage()
+		os.Exit(2)
+	}
+
+	name := *queue
+	if name == "" {
+		name = phases.NewTopology(*job).Queue(*stage)
+	}
+	connection, err := rabbit.NewConnectionFromEnv()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	browser, err := rabbit.NewDeadLetterBrowser(connection, broker.DeadLetterQueue(name))
+	if err != nil {
+		return err
+	}
+	defer browser.Close()
+
+	matched := 0
+	for *limit <= 0 || matched < *limit {
+		letter, ok, err := browser.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		dl := decodeDeadLetter(letter)
+		if !filter.matches(dl) {
+			continue
+		}
+		matched++
+		if err := apply(browser, dl); err != nil {
+			return err
+		}
+	}
+	switch subcommand {
+	case "replay":
+		fmt.Printf("replayed %v messages\n", matched)
+	case "purge":
+		fmt.Printf("purged %v messages\n", matched)
+	}
+	return nil
+}
+
+// showDeadLetter prints the failure details, headers and decoded record of a message
+func showDeadLetter(dl deadLetter) error {
+	fmt.Printf("guid:           %v\n", dl.guid())
+	if dl.transformation != "" {
+		fmt.Printf("transformation: %v\n", dl.transformation)
+	}
+	if dl.dataSource != "" {
+		fmt.Printf("datasource:     %v\n", dl.dataSource)
+	}
+	fmt.Printf("attempts:       %v\n", dl.letter.Attempts)
+	fmt.Printf("failed at:      %v\n", dl.letter.FailedAt)
+	fmt.Printf("routing key:    %v\n", dl.letter.OriginalRoutingKey)
+	fmt.Printf("error:          %v\n", dl.letter.LastError)
+	fmt.Printf("headers:\n")
+	for key, value := range dl.letter.Delivery.Headers {
+		fmt.Printf("  %v: %v\n", key, value)
+	}
+	if dl.decodeErr != nil {
+		fmt.Printf("body (undecodable: %v):\n%s\n\n", dl.decodeErr, dl.letter.Delivery.Body)
+		return nil
+	}
+	record, err := json.MarshalIndent(dl.record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializing record %v: %v", dl.guid(), err)
+	}
+	fmt.Printf("record:\n%s\n\n", record)
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/streadway/amqp"
+
+	"github.com/ezeriver94/gotransform/common"
+	"github.com/ezeriver94/gotransform/phases"
+	"github.com/ezeriver94/gotransform/rabbit"
+)
+
+// letterOf builds a dead letter holding body, failed with lastError
+func letterOf(t *testing.T, body interface{}, headers amqp.Table, lastError string) rabbit.DeadLetter {
+	var content []byte
+	switch value := body.(type) {
+	case string:
+		content = []byte(value)
+	default:
+		var err error
+		if content, err = json.Marshal(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rabbit.DeadLetter{
+		Delivery:  amqp.Delivery{Body: content, Headers: headers},
+		LastError: lastError,
+	}
+}
+
+func TestDecodeDeadLetter(t *testing.T) {
+	record := common.NewRecord(false)
+	record.Set("id", 1)
+	tests := []struct {
+		name               string
+		letter             rabbit.DeadLetter
+		wantTransformation string
+		wantSource         string
+		wantGUID           string
+		wantErr            bool
+	}{
+		{
+			name:               "transformed record",
+			letter:             letterOf(t, phases.Transformed{TransformationName: "customers", Record: record}, nil, ""),
+			wantTransformation: "customers",
+			wantSource:         "customers",
+			wantGUID:           record.ID.String(),
+		},
+		{
+			name:       "extracted record",
+			letter:     letterOf(t, record, amqp.Table{phases.DataSourceHeader: "orders"}, ""),
+			wantSource: "orders",
+			wantGUID:   record.ID.String(),
+		},
+		{
+			name:    "invalid body",
+			letter:  letterOf(t, "not json", nil, ""),
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dl := decodeDeadLetter(test.letter)
+			if (dl.decodeErr != nil) != test.wantErr {
+				t.Fatalf("decode error = %v, wantErr %v", dl.decodeErr, test.wantErr)
+			}
+			if dl.transformation != test.wantTransformation || dl.source() != test.wantSource || dl.guid() != test.wantGUID {
+				t.Errorf("decoded %v, %v, %v, want %v, %v, %v", dl.transformation, dl.source(), dl.guid(), test.wantTransformation, test.wantSource, test.wantGUID)
+			}
+		})
+	}
+}
+
+func TestDeadLetterFilter(t *testing.T) {
+	record := common.NewRecord(false)
+	dl := decodeDeadLetter(letterOf(t, phases.Transformed{TransformationName: "customers", Record: record}, nil, "error posting to accessor: unexpected status 500"))
+	tests := []struct {
+		name   string
+		filter deadLetterFilter
+		want   bool
+	}{
+		{"no filter", deadLetterFilter{}, true},
+		{"transformation", deadLetterFilter{transformation: "customers"}, true},
+		{"other transformation", deadLetterFilter{transformation: "orders"}, false},
+		{"error text", deadLetterFilter{errorText: "status 500"}, true},
+		{"other error text", deadLetterFilter{errorText: "timed out"}, false},
+		{"guid in any case", deadLetterFilter{guid: record.ID.StringUpper()}, true},
+		{"other guid", deadLetterFilter{guid: "00000000-0000-0000-0000-000000000000"}, false},
+		{"every field", deadLetterFilter{transformation: "customers", errorText: "500", guid: record.ID.String()}, true},
+	}
+	for _, test := range tests {
+		if got := test.filter.matches(dl); got != test.want {
+			t.Errorf("%v: matches() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
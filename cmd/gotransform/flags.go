@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ezeriver94/gotransform/common"
+	"github.com/ezeriver94/gotransform/env"
+)
+
+// listFlag collects every value of a flag that can be repeated
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// keyValueFlag collects every key=value pair of a flag that can be repeated
+type keyValueFlag map[string]string
+
+func (kv keyValueFlag) String() string {
+	pairs := make([]string, 0, len(kv))
+	for key, value := range kv {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (kv keyValueFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected key=value, received %v", value)
+	}
+	kv[parts[0]] = parts[1]
+	return nil
+}
+
+// parseFlags parses the arguments of a command along with the -env flag, whose key=value pairs override the envVars
+// and the .env file
+func parseFlags(flags *flag.FlagSet, args []string) {
+	overrides := keyValueFlag{}
+	flags.Var(overrides, "env", "envVar given as key=value, overriding the environment and the .env file (repeatable)")
+	flags.Parse(args)
+	env.Override(overrides)
+}
+
+// paramFlags are the flags of the commands reading metadata that define the values of its ${name} placeholders
+type paramFlags struct {
+	values keyValueFlag
+	path   *string
+}
+
+func newParamFlags(flags *flag.FlagSet) *paramFlags {
+	params := &paramFlags{values: keyValueFlag{}}
+	flags.Var(params.values, "param", "name=value of a ${name} placeholder of the metadata (repeatable); overrides the "+common.EnvParamPrefix+"<NAME> envVars, the -params file and the built-in run_id, run_date and run_time")
+	params.path = flags.String("params", "", "path of a yaml file with the values of the ${name} placeholders of the metadata")
+	return params
+}
+
+// lookup returns the params of a run: the ones given by -param, then the envVars, then the ones of the -params file and
+// finally the built-in ones
+func (p *paramFlags) lookup(runID string, started time.Time) (common.ParamLookup, error) {
+	file := common.Params{}
+	if *p.path != "" {
+		var err error
+		if file, err = common.LoadParams(*p.path); err != nil {
+			return nil, err
+		}
+	}
+	return common.LayeredParams(
+		common.Params(p.values).Lookup,
+		common.EnvParam,
+		file.Lookup,
+		common.BuiltinParams(runID, started).Lookup,
+	), nil
+}
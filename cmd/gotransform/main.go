@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// command is a subcommand of the gotransform cli, receiving the arguments that follow its name
+type command func(args []string) error
+
+var commands = map[string]command{
+	"run":     run,
+	"cache":   cacheCommand,
+	"dlq":     dlqCommand,
+	"migrate": migrate,
+	"worker":  worker,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: gotransform <command> [arguments]\n\ncommands:\n")
+	fmt.Fprintf(os.Stderr, "  run      runs a job described by a metadata file\n")
+	fmt.Fprintf(os.Stderr, "  cache    inspects and clears the disk cache\n")
+	fmt.Fprintf(os.Stderr, "  dlq      inspects, replays and purges the dead-letter queues of a distributed job\n")
+	fmt.Fprintf(os.Stderr, "  migrate  rewrites a metadata file to the current version of the metadata format\n")
+	fmt.Fprintf(os.Stderr, "  worker   runs a stage of a job distributed through rabbitMq or redis streams\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd(os.Args[2:]); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
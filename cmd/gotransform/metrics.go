@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "expvar" // registers /debug/vars on the default mux
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serveMetrics exposes every published expvar on addr in the background
+func serveMetrics(addr string) {
+	go func() {
+		log.Infof("serving metrics on http://%v/debug/vars", addr)
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.Errorf("error serving metrics: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/common"
+)
+
+// migrate rewrites a metadata file to the current version of the metadata format
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	metadataPath := flags.String("metadata", "", "path of the metadata file to migrate; included files are migrated on their own")
+	out := flags.String("out", "", "file path where the migrated metadata is written; defaults to stdout")
+	inPlace := flags.Bool("w", false, "rewrite the metadata file itself instead of writing to -out; comments of the file are not kept")
+	parseFlags(flags, args)
+
+	if *metadataPath == "" {
+		return fmt.Errorf("missing -metadata argument")
+	}
+	if *inPlace && *out != "" {
+		return fmt.Errorf("-w and -out cannot be used together")
+	}
+	info, err := os.Stat(*metadataPath)
+	if err != nil {
+		return fmt.Errorf("error reading metadata file %v: %v", *metadataPath, err)
+	}
+	content, err := ioutil.ReadFile(*metadataPath)
+	if err != nil {
+		return fmt.Errorf("error reading metadata file %v: %v", *metadataPath, err)
+	}
+	migrated, applied, err := common.MigrateMetadata(string(content))
+	if err != nil {
+		return fmt.Errorf("error migrating metadata file %v: %v", *metadataPath, err)
+	}
+	if len(applied) == 0 {
+		log.Infof("metadata file %v is already at schema %v", *metadataPath, common.CurrentSchema)
+	}
+	for _, change := range applied {
+		log.Infof("migrated %v", change)
+	}
+
+	switch {
+	case *inPlace:
+		if len(applied) == 0 {
+			return nil
+		}
+		*out = *metadataPath
+	case *out == "":
+		fmt.Print(migrated)
+		return nil
+	}
+	if err := ioutil.WriteFile(*out, []byte(migrated), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("error writing migrated metadata %v: %v", *out, err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/phases"
+)
+
+// logReport writes a summary of a report into the log
+func logReport(report phases.Report) {
+	for _, name := range sortedKeys(report.Extracted) {
+		log.Infof("extracted %v records from datasource %v", report.Extracted[name], name)
+	}
+	for _, name := range sortedKeys(report.Loaded) {
+		log.Infof("loaded %v records into target %v", report.Loaded[name], name)
+	}
+	names := make([]string, 0, len(report.Cache))
+	for name := range report.Cache {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stats := report.Cache[name]
+		log.Infof(
+			"cache of datasource %v: %v hits, %v misses, %v coalesced, %v errors, %v sets, %v bytes read, %v bytes written (%.1f%% hit ratio)",
+			name, stats.Hits, stats.Misses, stats.Coalesced, stats.Errors, stats.Sets, stats.BytesRead, stats.BytesWritten, report.HitRatio(name)*100,
+		)
+	}
+}
+
+// writeReport saves a report as json into path
+func writeReport(report phases.Report, path string) error {
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializing run report: %v", err)
+	}
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("error writing run report %v: %v", path, err)
+	}
+	return nil
+}
+
+func sortedKeys(values map[string]int) []string {
+	result := make([]string, 0, len(values))
+	for key := range values {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/beevik/guid"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/cache"
+	"github.com/ezeriver94/gotransform/common"
+	"github.com/ezeriver94/gotransform/phases"
+	"github.com/ezeriver94/gotransform/state"
+)
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	metadataPath := flags.String("metadata", "", "path of the metadata file describing the job")
+	cacheKind := flags.String("cache", "", "cache for join lookups: none, memory, disk, redis, layered or a comma separated list of them; defaults to layered when REDIS_CACHE_HOST is set, memory otherwise")
+	metricsAddr := flags.String("metrics-addr", "", "address where metrics are served on /debug/vars while the job runs")
+	statePath := flags.String("state", ".gotransform-state.json", "file path or redis:// url where watermarks are stored")
+	reportPath := flags.String("report", "", "file path where the json report of the run is written")
+	minRecords := flags.Int("min-records", 0, "records every load target must receive for its output to be committed and its staged output published; the run fails and discards it otherwise")
+	resetWatermarks := listFlag{}
+	flags.Var(&resetWatermarks, "reset-watermark", "primary datasource whose stored watermark is discarded before running (repeatable)")
+	watermarks := keyValueFlag{}
+	flags.Var(watermarks, "watermark", "datasource=value overriding the stored watermark of a primary datasource (repeatable)")
+	params := newParamFlags(flags)
+	parseFlags(flags, args)
+
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
+	}
+	runID := guid.New().String()
+	metadata, err := loadMetadata(*metadataPath, params, runID)
+	if err != nil {
+		return err
+	}
+	store, err := state.NewStore(*statePath)
+	if err != nil {
+		return fmt.Errorf("error opening state store: %v", err)
+	}
+	lookups, err := newCache(*cacheKind)
+	if err != nil {
+		return err
+	}
+	pipeline, err := phases.NewPipeline(metadata, store, lookups, runID)
+	if err != nil {
+		return err
+	}
+	if *minRecords > 0 {
+		pipeline.Loader.AddCheck(phases.MinRecords(*minRecords))
+	}
+	for _, dataSourceName := range resetWatermarks {
+		if err := pipeline.Extractor.ResetWatermark(dataSourceName); err != nil {
+			return fmt.Errorf("error resetting watermark: %v", err)
+		}
+		log.Infof("watermark of datasource %v reset", dataSourceName)
+	}
+	for dataSourceName, value := range watermarks {
+		if err := pipeline.Extractor.OverrideWatermark(dataSourceName, parseWatermark(value)); err != nil {
+			return fmt.Errorf("error overriding watermark: %v", err)
+		}
+		log.Infof("watermark of datasource %v set to %v", dataSourceName, value)
+	}
+	err = pipeline.Run()
+	return report(pipeline, *reportPath, err)
+}
+
+// report logs the report of a finished pipeline and saves it into path if set, returning the error of the pipeline itself
+func report(pipeline *phases.Pipeline, path string, err error) error {
+	result := pipeline.Report()
+	logReport(result)
+	if path != "" {
+		if reportErr := writeReport(result, path); reportErr != nil {
+			log.Errorf("%v", reportErr)
+		}
+	}
+	return err
+}
+
+func newCache(kind string) (cache.Cache, error) {
+	if kind == "" {
+		return cache.NewFromEnv()
+	}
+	return cache.New(kind)
+}
+
+// loadMetadata reads a metadata file, filling the ${name} placeholders of it and of the files it includes with params
+func loadMetadata(path string, params *paramFlags, runID string) (*common.Metadata, error) {
+	if path == "" {
+		return nil, fmt.Errorf("missing -metadata argument")
+	}
+	lookup, err := params.lookup(runID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := common.ParseMetadataFile(path, lookup)
+	if err != nil {
+		return nil, fmt.Errorf("error loading metadata file %v: %v", path, err)
+	}
+	return metadata, nil
+}
+
+// parseWatermark keeps numeric watermarks as numbers, so they are compared and sent as such
+func parseWatermark(value string) interface{} {
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return json.Number(value)
+	}
+	return value
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/beevik/guid"
+
+	"github.com/ezeriver94/gotransform/broker"
+	"github.com/ezeriver94/gotransform/cache"
+	"github.com/ezeriver94/gotransform/phases"
+	"github.com/ezeriver94/gotransform/rabbit"
+	"github.com/ezeriver94/gotransform/state"
+	"github.com/ezeriver94/gotransform/streams"
+)
+
+// worker runs a single stage of a distributed job, connected to the other stages through a broker: the rabbitMq configured
+// by the RABBIT_* envVars, or redis streams; every stage can run as many workers as needed
+func worker(args []string) error {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	stage := flags.String("stage", "", "stage run by the worker: extract, transform or load")
+	metadataPath := flags.String("metadata", "", "path of the metadata file describing the job")
+	job := flags.String("job", "gotransform", "name of the job, shared by all its workers; it prefixes the queues of every stage")
+	run := flags.String("run", "", "id of the run of the job, shared by all the workers taking part in it and different on every run, so messages left on the queues by other runs are dropped; required")
+	brokerLocation := flags.String("broker", "rabbit", "broker connecting the stages: rabbit, configured by the RABBIT_* envVars, or a redis:// url to use redis streams")
+	exchange := flags.String("exchange", phases.DefaultExchange, "exchange connecting the stages of the job")
+	tag := flags.String("tag", "", "consumer tag of the worker, which identifies it as a producer of its stage; defaults to a random one")
+	prefetch := flags.Int("prefetch", 0, "messages received by transform and load workers before acking them; defaults to twice the concurrency")
+	concurrency := flags.Int("concurrency", 1, "messages processed at the same time by transform and load workers")
+	timeout := flags.Duration("timeout", 0, "maximum processing time of every message of transform and load workers; 0 means no limit")
+	maxAttempts := flags.Int("max-attempts", 0, "attempts of transform and load workers to process a message before sending it to the dead-letter queue of its stage; 0 drops failed messages")
+	retryDelays := listFlag{}
+	flags.Var(&retryDelays, "retry-delay", "delay before retrying a failed message, one per attempt (repeatable); defaults to 1s, 10s and 1m")
+	transformers := flags.Int("transformers", 1, "amount of transform workers whose end a load worker waits for")
+	minRecords := flags.Int("min-records", 0, "records every load target of a load worker must receive for its output to be committed and its staged output published; the worker fails and discards it otherwise")
+	cacheKind := flags.String("cache", "", "cache for join lookups of transform workers: none, memory, disk, redis, layered or a comma separated list of them; defaults to layered when REDIS_CACHE_HOST is set, memory otherwise")
+	dedupKind := flags.String("dedup", "", "cache remembering the records processed by transform and load workers, so duplicated deliveries are skipped: memory, redis, layered or any other cache kind; empty disables deduplication")
+	dedupTTL := flags.Duration("dedup-ttl", phases.DefaultDedupTTL, "time the records processed by transform and load workers are remembered")
+	statePath := flags.String("state", ".gotransform-state.json", "file path or redis:// url where watermarks of extract workers are stored")
+	dataSources := listFlag{}
+	flags.Var(&dataSources, "datasource", "primary datasource extracted by an extract worker (repeatable); defaults to all of them")
+	params := newParamFlags(flags)
+	parseFlags(flags, args)
+
+	if *run == "" {
+		fmt.Fprintf(os.Stderr, "missing -run; every worker of a run needs the same run id\n")
+		flags.Usage()
+		os.Exit(2)
+	}
+	metadata, err := loadMetadata(*metadataPath, params, *run)
+	if err != nil {
+		return err
+	}
+	topology := phases.Topology{Exchange: *exchange, Job: *job, Run: *run}
+	options := broker.ConsumerOptions{
+		Prefetch:    *prefetch,
+		Concurrency: *concurrency,
+		Timeout:     *timeout,
+	}
+	if *maxAttempts > 0 {
+		options.Retry = &broker.RetryOptions{MaxAttempts: *maxAttempts}
+		for _, value := range retryDelays {
+			delay, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid retry delay %v: %v", value, err)
+			}
+			options.Retry.Delays = append(options.Retry.Delays, delay)
+		}
+	}
+	if *tag == "" {
+		*tag = fmt.Sprintf("%v-%v-%v", *job, *stage, guid.New().String())
+	}
+	switch *stage {
+	case "extract", "transform", "load":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown stage %q; expected extract, transform or load\n", *stage)
+		flags.Usage()
+		os.Exit(2)
+	}
+	b, err := newBroker(*brokerLocation)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	var dedup *phases.Deduplicator
+	if *dedupKind != "" && *stage != "extract" {
+		processed, err := cache.New(*dedupKind)
+		if err != nil {
+			return fmt.Errorf("error creating dedup cache: %v", err)
+		}
+		dedup = phases.NewDeduplicator(processed, *job, *dedupTTL)
+	}
+
+	switch *stage {
+	case "extract":
+		store, err := state.NewStore(*statePath)
+		if err != nil {
+			return fmt.Errorf("error opening state store: %v", err)
+		}
+		extractor, err := phases.NewExtractWorker(metadata, store, b, topology)
+		if err != nil {
+			return err
+		}
+		return extractor.Run(dataSources)
+	case "transform":
+		lookups, err := newCache(*cacheKind)
+		if err != nil {
+			return err
+		}
+		transformer, err := phases.NewTransformWorker(metadata, lookups, b, topology, *tag, options)
+		if err != nil {
+			return err
+		}
+		transformer.Deduplicate(dedup)
+		return transformer.Run()
+	case "load":
+		loader, err := phases.NewLoadWorker(metadata, b, topology, *tag, *transformers, options)
+		if err != nil {
+			return err
+		}
+		loader.Deduplicate(dedup)
+		if *minRecords > 0 {
+			loader.AddCheck(phases.MinRecords(*minRecords))
+		}
+		return loader.Run()
+	}
+	return nil
+}
+
+// newBroker connects to the broker of a location: rabbit uses the rabbitMq configured by the RABBIT_* envVars, and
+// redis:// urls use redis streams
+func newBroker(location string) (broker.Broker, error) {
+	switch {
+	case location == "rabbit":
+		b, err := rabbit.NewBroker(rabbit.NewConnectionFromEnv)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case strings.HasPrefix(location, "redis://"):
+		b, err := streams.NewBroker(location)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown broker %v; expected rabbit or a redis:// url", location)
+	}
+}
@@ -10,14 +10,29 @@ import (
 	"github.com/beevik/guid"
 )
 
+// Operation indicates the kind of change that a record applies on a destination
+type Operation string
+
+const (
+	// OperationInsert adds the record to the destination
+	OperationInsert Operation = "insert"
+
+	// OperationUpdate replaces the record identified by the destination keys, inserting it if missing
+	OperationUpdate Operation = "update"
+
+	// OperationDelete removes the record identified by the destination keys
+	OperationDelete Operation = "delete"
+)
+
 // Record represents a single row, with an ID to track it through every phase
 type Record struct {
-	data     map[string]interface{}
-	rawData  []interface{}
-	ID       *guid.Guid
-	Empty    bool
-	raw      bool
-	unrawing bool
+	data      map[string]interface{}
+	rawData   []interface{}
+	ID        *guid.Guid
+	Operation Operation
+	Empty     bool
+	raw       bool
+	unrawing  bool
 }
 
 // ErrMissingItemOnRecord indicates that a key was not found on record values
@@ -26,14 +41,32 @@ var ErrMissingItemOnRecord = errors.New("missing item on record")
 // NewRecord creates an empty record with a new GUID
 func NewRecord(raw bool) Record {
 	return Record{
-		data:    nil,
-		rawData: nil,
-		ID:      guid.New(),
-		raw:     raw,
-		Empty:   true,
+		data:      nil,
+		rawData:   nil,
+		ID:        guid.New(),
+		Operation: OperationInsert,
+		raw:       raw,
+		Empty:     true,
 	}
 }
 
+// ParseOperation converts a string to an Operation, using OperationInsert for an empty value
+func ParseOperation(value string) (Operation, error) {
+	switch Operation(value) {
+	case "":
+		return OperationInsert, nil
+	case OperationInsert, OperationUpdate, OperationDelete:
+		return Operation(value), nil
+	default:
+		return "", fmt.Errorf("unknown record operation %v", value)
+	}
+}
+
+// IsRaw indicates whether the values of the record are indexed by position instead of by name
+func (r *Record) IsRaw() bool {
+	return r.raw
+}
+
 // StartUnraw sets raw property of record to false and enables unrawing property
 func (r *Record) StartUnraw() {
 	r.raw = false
@@ -57,6 +90,13 @@ func (r Record) MarshalJSON() ([]byte, error) {
 	}
 	buffer.Write(guidData)
 	buffer.WriteString(",")
+	operation, err := ParseOperation(string(r.Operation))
+	if err != nil {
+		return nil, err
+	}
+	buffer.WriteString("\"op\":")
+	buffer.WriteString(fmt.Sprintf("%q", operation))
+	buffer.WriteString(",")
 	rawData, err := json.Marshal(r.raw)
 	if err != nil {
 		return nil, err
@@ -87,8 +127,9 @@ func (r Record) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON serializes a record to json
 func (r *Record) UnmarshalJSON(b []byte) error {
 	type PlainData struct {
-		Guid string `json:"guid"`
-		Raw  bool   `json:"raw"`
+		Guid      string `json:"guid"`
+		Operation string `json:"op"`
+		Raw       bool   `json:"raw"`
 	}
 	var plainData PlainData
 	err := json.Unmarshal(b, &plainData)
@@ -100,6 +141,10 @@ func (r *Record) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
+	r.Operation, err = ParseOperation(plainData.Operation)
+	if err != nil {
+		return err
+	}
 	if r.raw {
 		type RawData struct {
 			Data []interface{} `json:"data"`
@@ -355,3 +400,51 @@ func (r *Record) ToString(fields Fields) (string, error) {
 	}
 	return result, nil
 }
+
+// FromString populates the record from a single line written by ToString, splitting it with the definition of the fields
+func (r *Record) FromString(fields Fields, line string) error {
+	runes := []rune(line)
+	position := 0
+	for index, field := range fields {
+		var fieldValue string
+		if field.FixedLength > 0 {
+			if position+field.FixedLength > len(runes) {
+				return fmt.Errorf("field %v has fixed length of %v but only %v characters are left", field.Name, field.FixedLength, len(runes)-position)
+			}
+			fieldValue = string(runes[position : position+field.FixedLength])
+			position += field.FixedLength
+			if len(field.Padding.Char) == 1 {
+				if field.Padding.Mode == FieldPaddingLeft {
+					fieldValue = strings.TrimLeft(fieldValue, field.Padding.Char)
+				} else if field.Padding.Mode == FieldPaddingRight {
+					fieldValue = strings.TrimRight(fieldValue, field.Padding.Char)
+				}
+			}
+		} else {
+			if len(field.EndCharacter) != 1 {
+				return fmt.Errorf("field %v has no fixed length and end character has not length of 1", field.Name)
+			}
+			start := position
+			end := start
+			for end < len(runes) && end-start < field.MaxLength && string(runes[end]) != field.EndCharacter {
+				end++
+			}
+			fieldValue = string(runes[start:end])
+			position = end
+			if end-start < field.MaxLength {
+				// values shorter than the max length are followed by the end character
+				if end == len(runes) {
+					return fmt.Errorf("missing end character of field %v", field.Name)
+				}
+				position++
+			}
+		}
+		if err := r.TrySet(field.Name, index, fieldValue); err != nil {
+			return err
+		}
+	}
+	if position < len(runes) {
+		return fmt.Errorf("line has %v characters left after reading every field", len(runes)-position)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRecordOperationJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation Operation
+		want      Operation
+	}{
+		{"insert", OperationInsert, OperationInsert},
+		{"update", OperationUpdate, OperationUpdate},
+		{"delete", OperationDelete, OperationDelete},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := NewRecord(false)
+			record.Operation = test.operation
+			record.Set("id", 1)
+			content, err := json.Marshal(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded Record
+			if err := json.Unmarshal(content, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Operation != test.want || decoded.ID.String() != record.ID.String() {
+				t.Errorf("decoded %s as operation %v of %v", content, decoded.Operation, decoded.ID)
+			}
+		})
+	}
+}
+
+func TestParseOperation(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Operation
+		wantErr bool
+	}{
+		{"", OperationInsert, false},
+		{"insert", OperationInsert, false},
+		{"update", OperationUpdate, false},
+		{"delete", OperationDelete, false},
+		{"upsert", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := ParseOperation(test.value)
+			if (err != nil) != test.wantErr || got != test.want {
+				t.Errorf("ParseOperation(%q) = %v, %v, want %v, wantErr %v", test.value, got, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,471 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/ezeriver94/gotransform/env"
+	"github.com/ezeriver94/gotransform/secrets"
+)
+
+const (
+	// includeKey lists the metadata files merged before the content of a metadata
+	includeKey = "include"
+
+	// definitionsKey holds the named datasources and field sets that can be referenced with $ref
+	definitionsKey = "definitions"
+
+	// refKey replaces a datasource or a field set by the definition it names, as in $ref: datasources/customers
+	refKey = "$ref"
+)
+
+// definitionKinds are the types of the definitions of every kind, which are decoded strictly as such to validate them
+var definitionKinds = map[string]reflect.Type{
+	"datasources": reflect.TypeOf(DataEndpoint{}),
+	"fields":      reflect.TypeOf(Fields{}),
+}
+
+// composer builds a metadata document out of the files it includes and the definitions it references
+type composer struct {
+	params ParamLookup
+	// changed indicates that the document differs from its text, because of includes, definitions or secrets
+	changed bool
+}
+
+// file reads, interpolates and parses a metadata file along with the files it includes; including lists the files whose
+// includes are being read, to detect cycles
+func (c *composer) file(path string, including []string) (yaml.MapSlice, string, error) {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("error resolving path of metadata file %v: %v", path, err)
+	}
+	for i, previous := range including {
+		if previous == absolute {
+			cycle := append(append([]string{}, including[i:]...), absolute)
+			return nil, "", fmt.Errorf("include cycle: %v", strings.Join(cycle, " -> "))
+		}
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return c.parse(string(content), filepath.Dir(path), append(including, absolute))
+}
+
+// parse parses and interpolates a metadata document, merging the files it includes, relative to dir, before its own
+// content; it returns the document along with its text
+func (c *composer) parse(data, dir string, including []string) (yaml.MapSlice, string, error) {
+	document, err := readDocument([]byte(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("error deserializing metadata as yaml: %v", err)
+	}
+	if c.params != nil {
+		undefined := map[string]bool{}
+		document = c.interpolate(document, undefined).(yaml.MapSlice)
+		if err := undefinedParams(undefined); err != nil {
+			return nil, "", fmt.Errorf("error interpolating metadata: %v", err)
+		}
+	}
+	value, document := pop(document, includeKey)
+	if value == nil {
+		return document, data, nil
+	}
+	includes, err := toPaths(value)
+	if err != nil {
+		return nil, "", err
+	}
+	c.changed = true
+	merged := yaml.MapSlice{}
+	for _, include := range includes {
+		path := include
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		included, _, err := c.file(path, including)
+		if err != nil {
+			return nil, "", fmt.Errorf("error including %v: %v", path, err)
+		}
+		merged = merge(merged, included)
+	}
+	return merge(merged, document), data, nil
+}
+
+// decode resolves the definitions and the secrets of a document and converts it to a Metadata instance; documents that
+// need neither are decoded from their text, so errors point to its lines
+func (c *composer) decode(data string, document yaml.MapSlice) (*Metadata, error) {
+	document, err := c.resolveDefinitions(document)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := c.resolveSecrets(document, "")
+	if err != nil {
+		return nil, fmt.Errorf("error resolving secrets of metadata: %v", err)
+	}
+	if c.changed {
+		// the lines of a composed document are not the ones of its files, so errors are located by path instead
+		if err := locateErrors(document); err != nil {
+			return nil, err
+		}
+		content, err := yaml.Marshal(render(resolved, documentType))
+		if err != nil {
+			return nil, fmt.Errorf("error serializing composed metadata: %v", err)
+		}
+		data = string(content)
+	}
+	var result = new(Metadata)
+	if err := yaml.UnmarshalStrict([]byte(data), &result); err != nil {
+		return nil, fmt.Errorf("error deserializing metadata as yaml: %v", err)
+	}
+	if err := CheckSchema(result.Schema); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// resolveDefinitions removes the definitions of a document and replaces its $ref with them, checking that every
+// definition is valid even when no one references it
+func (c *composer) resolveDefinitions(document yaml.MapSlice) (yaml.MapSlice, error) {
+	value, document := pop(document, definitionsKey)
+	r := resolver{definitions: map[string]interface{}{}}
+	if value != nil {
+		c.changed = true
+		kinds, ok := value.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("%v must map kinds of definitions to them", definitionsKey)
+		}
+		for _, kind := range kinds {
+			if _, ok := definitionKinds[fmt.Sprint(kind.Key)]; !ok {
+				return nil, fmt.Errorf("%v: unknown kind of definitions %v; expected datasources or fields", definitionsKey, kind.Key)
+			}
+			named, ok := kind.Value.(yaml.MapSlice)
+			if !ok {
+				return nil, fmt.Errorf("%v.%v must map names to definitions", definitionsKey, kind.Key)
+			}
+			for _, definition := range named {
+				r.definitions[fmt.Sprintf("%v/%v", kind.Key, definition.Key)] = definition.Value
+			}
+		}
+		names := make([]string, 0, len(r.definitions))
+		for name := range r.definitions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := r.validate(name, r.definitions[name]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	resolved, err := r.resolve(document, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.referenced {
+		c.changed = true
+	}
+	return resolved.(yaml.MapSlice), nil
+}
+
+// interpolate replaces the ${name} placeholders of the keys and values of a document with the value of their params,
+// adding the names of the undefined ones to undefined. Placeholders are replaced once the document is parsed, so params
+// holding yaml syntax, as ": ", "#" or quotes, are kept as they are, and the ones written in comments are ignored
+func (c *composer) interpolate(value interface{}, undefined map[string]bool) interface{} {
+	switch value := value.(type) {
+	case string:
+		interpolated := replaceParams(value, c.params, undefined)
+		if interpolated != value {
+			c.changed = true
+		}
+		return interpolated
+	case scalar:
+		if !isString(value) {
+			return value
+		}
+		interpolated := replaceParams(value.text, c.params, undefined)
+		if interpolated == value.text {
+			return value
+		}
+		c.changed = true
+		return scalar{text: interpolated, value: typed(interpolated)}
+	case yaml.MapSlice:
+		for i, item := range value {
+			value[i].Key = c.interpolate(item.Key, undefined)
+			value[i].Value = c.interpolate(item.Value, undefined)
+		}
+		return value
+	case []interface{}:
+		for i, item := range value {
+			value[i] = c.interpolate(item, undefined)
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+// typed returns the value a plain scalar holding text is read as, as numbers and booleans given by params, or text itself
+// when it would be read as anything else or written back differently
+func typed(text string) interface{} {
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(text), &value); err != nil {
+		return text
+	}
+	switch value.(type) {
+	case int, int64, uint64, float64, bool:
+		written, err := yaml.Marshal(value)
+		if err == nil && strings.TrimSpace(string(written)) == text {
+			return value
+		}
+	}
+	return text
+}
+
+// resolveSecrets replaces the ${env:NAME} and ${file:/path} references of the values of a document. References are
+// resolved once the document is parsed, so the content of secrets is always a string and never read as yaml
+func (c *composer) resolveSecrets(value interface{}, path string) (interface{}, error) {
+	switch value := value.(type) {
+	case scalar:
+		if !isString(value) {
+			return value, nil
+		}
+		resolved, err := secrets.Resolve(value.text, env.Lookup)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		if resolved == value.text {
+			return value, nil
+		}
+		c.changed = true
+		return scalar{text: resolved, value: resolved}, nil
+	case yaml.MapSlice:
+		for i, item := range value {
+			resolved, err := c.resolveSecrets(item.Value, join(path, item.Key))
+			if err != nil {
+				return nil, err
+			}
+			value[i].Value = resolved
+		}
+		return value, nil
+	case []interface{}:
+		for i, item := range value {
+			resolved, err := c.resolveSecrets(item, fmt.Sprintf("%v[%v]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			value[i] = resolved
+		}
+		return value, nil
+	default:
+		return value, nil
+	}
+}
+
+// sections are the named entries of a metadata, along with the type each of them decodes to
+var sections = []struct {
+	path   []string
+	target reflect.Type
+}{
+	{[]string{"extract", "primary"}, reflect.TypeOf(DataEndpoint{})},
+	{[]string{"extract", "additional"}, reflect.TypeOf(DataEndpoint{})},
+	{[]string{"extract", "aditional"}, reflect.TypeOf(DataEndpoint{})},
+	{[]string{"transform"}, reflect.TypeOf(DataTransformation{})},
+	{[]string{"load"}, reflect.TypeOf(DataDestination{})},
+}
+
+// locateErrors decodes every named entry of a composed document on its own, so errors name the entry they come from
+func locateErrors(document yaml.MapSlice) error {
+	for _, section := range sections {
+		var value interface{} = document
+		for _, key := range section.path {
+			mapping, ok := value.(yaml.MapSlice)
+			if !ok {
+				value = nil
+				break
+			}
+			value, _ = pop(mapping, key)
+		}
+		entries, ok := value.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+		for _, entry := range entries {
+			content, err := yaml.Marshal(render(entry.Value, section.target))
+			if err != nil {
+				return fmt.Errorf("error serializing composed metadata: %v", err)
+			}
+			if err := yaml.UnmarshalStrict(content, reflect.New(section.target).Interface()); err != nil {
+				return fmt.Errorf("%v: error deserializing metadata as yaml: %v", join(strings.Join(section.path, "."), entry.Key), err)
+			}
+		}
+	}
+	return nil
+}
+
+// resolver replaces the $ref of a document with the definitions they name
+type resolver struct {
+	definitions map[string]interface{}
+	referenced  bool
+}
+
+// validate checks that a definition, once its own $ref are resolved, is a valid value of its kind
+func (r *resolver) validate(name string, definition interface{}) error {
+	resolved, err := r.resolve(definition, join(definitionsKey, strings.Replace(name, "/", ".", 1)), []string{name})
+	if err != nil {
+		return err
+	}
+	kind := definitionKinds[strings.SplitN(name, "/", 2)[0]]
+	content, err := yaml.Marshal(render(resolved, kind))
+	if err != nil {
+		return fmt.Errorf("error serializing definition %v: %v", name, err)
+	}
+	if err := yaml.UnmarshalStrict(content, reflect.New(kind).Interface()); err != nil {
+		return fmt.Errorf("invalid definition %v: %v", name, err)
+	}
+	return nil
+}
+
+// resolve returns a copy of a value whose $ref are replaced by their definitions. Mappings with a $ref take the content
+// of its definition, overridden by their other keys, and list items that only hold a $ref to a list, as a field set, are
+// replaced by its items. Path locates the value in errors, and stack holds the definitions being resolved, to detect cycles
+func (r *resolver) resolve(value interface{}, path string, stack []string) (interface{}, error) {
+	switch value := value.(type) {
+	case yaml.MapSlice:
+		ref, rest := pop(value, refKey)
+		result := yaml.MapSlice{}
+		for _, item := range rest {
+			resolved, err := r.resolve(item.Value, join(path, item.Key), stack)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, yaml.MapItem{Key: item.Key, Value: resolved})
+		}
+		if ref == nil {
+			return result, nil
+		}
+		definition, err := r.reference(ref, path, stack)
+		if err != nil {
+			return nil, err
+		}
+		if len(result) == 0 {
+			return definition, nil
+		}
+		base, ok := definition.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("%v: %v %v is not a mapping, so it cannot be overridden by other keys", path, refKey, ref)
+		}
+		return merge(base, result), nil
+	case []interface{}:
+		result := make([]interface{}, 0, len(value))
+		for i, item := range value {
+			resolved, err := r.resolve(item, fmt.Sprintf("%v[%v]", path, i), stack)
+			if err != nil {
+				return nil, err
+			}
+			if items, ok := resolved.([]interface{}); ok && isReference(item) {
+				result = append(result, items...)
+				continue
+			}
+			result = append(result, resolved)
+		}
+		return result, nil
+	default:
+		return value, nil
+	}
+}
+
+// reference returns the resolved definition named by a $ref, as datasources/customers or #/definitions/fields/address
+func (r *resolver) reference(ref interface{}, path string, stack []string) (interface{}, error) {
+	if !isString(ref) {
+		return nil, fmt.Errorf("%v: %v must name a definition, received %v", path, refKey, text(ref))
+	}
+	name := strings.TrimPrefix(text(ref), "#/"+definitionsKey+"/")
+	definition, ok := r.definitions[name]
+	if !ok {
+		return nil, fmt.Errorf("%v: unknown definition %v", path, name)
+	}
+	for i, previous := range stack {
+		if previous == name {
+			cycle := append(append([]string{}, stack[i:]...), name)
+			return nil, fmt.Errorf("%v: %v cycle: %v", path, refKey, strings.Join(cycle, " -> "))
+		}
+	}
+	r.referenced = true
+	return r.resolve(definition, join(definitionsKey, strings.Replace(name, "/", ".", 1)), append(stack, name))
+}
+
+// isReference indicates whether a value is a mapping that only holds a $ref
+func isReference(value interface{}) bool {
+	mapping, ok := value.(yaml.MapSlice)
+	return ok && len(mapping) == 1 && mapping[0].Key == refKey
+}
+
+// pop removes a key from a mapping, returning its value, or nil when it is not there, and the rest of the mapping
+func pop(mapping yaml.MapSlice, key string) (interface{}, yaml.MapSlice) {
+	for i, item := range mapping {
+		if item.Key == key {
+			rest := append(append(yaml.MapSlice{}, mapping[:i]...), mapping[i+1:]...)
+			return item.Value, rest
+		}
+	}
+	return nil, mapping
+}
+
+// merge returns a copy of base whose keys are overridden by the ones of override; mappings are merged recursively, and
+// any other value is replaced
+func merge(base, override yaml.MapSlice) yaml.MapSlice {
+	result := append(yaml.MapSlice{}, base...)
+	for _, item := range override {
+		found := false
+		for i, existing := range result {
+			if existing.Key != item.Key {
+				continue
+			}
+			found = true
+			baseMapping, baseOk := existing.Value.(yaml.MapSlice)
+			overrideMapping, overrideOk := item.Value.(yaml.MapSlice)
+			if baseOk && overrideOk {
+				result[i].Value = merge(baseMapping, overrideMapping)
+			} else {
+				result[i].Value = item.Value
+			}
+			break
+		}
+		if !found {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// toPaths reads the value of an include, which is a path or a list of them
+func toPaths(value interface{}) ([]string, error) {
+	switch value := value.(type) {
+	case scalar:
+		return []string{value.text}, nil
+	case []interface{}:
+		paths := make([]string, 0, len(value))
+		for _, item := range value {
+			if _, ok := item.(scalar); !ok {
+				return nil, fmt.Errorf("%v must be a path or a list of paths, received %v", includeKey, item)
+			}
+			paths = append(paths, text(item))
+		}
+		return paths, nil
+	default:
+		return nil, fmt.Errorf("%v must be a path or a list of paths, received %v", includeKey, value)
+	}
+}
+
+// join appends a key to the path of a value within a document
+func join(path string, key interface{}) string {
+	if path == "" {
+		return fmt.Sprint(key)
+	}
+	return fmt.Sprintf("%v.%v", path, key)
+}
@@ -0,0 +1,179 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files relative to a temporary directory, returning it
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestParseMetadataFileComposition(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		check   func(*Metadata) (interface{}, interface{})
+		wantErr string
+	}{
+		{
+			name: "include is overridden by the including file",
+			files: map[string]string{
+				"base.yml": "extract:\n  primary:\n    customers:\n      driver: postgres\n      objectid: customers\n",
+				"main.yml": "include: base.yml\nextract:\n  primary:\n    customers:\n      objectid: clients\n",
+			},
+			check: func(m *Metadata) (interface{}, interface{}) {
+				customers := m.Extract.PrimaryDataSources["customers"]
+				return customers.Driver + " " + customers.ObjectIdentifier, "postgres clients"
+			},
+		},
+		{
+			name: "includes are merged in order",
+			files: map[string]string{
+				"a.yml":    "load:\n  customers:\n    driver: a\n    objectid: a\n",
+				"b.yml":    "load:\n  customers:\n    driver: b\n",
+				"main.yml": "include: [a.yml, b.yml]\n",
+			},
+			check: func(m *Metadata) (interface{}, interface{}) {
+				customers := m.Load["customers"]
+				return customers.Driver + " " + customers.ObjectIdentifier, "b a"
+			},
+		},
+		{
+			name: "include cycle",
+			files: map[string]string{
+				"a.yml":    "include: b.yml\n",
+				"b.yml":    "include: a.yml\n",
+				"main.yml": "include: a.yml\n",
+			},
+			wantErr: "include cycle",
+		},
+		{
+			name:    "missing include",
+			files:   map[string]string{"main.yml": "include: missing.yml\n"},
+			wantErr: "error including",
+		},
+		{
+			name:    "include that is not a path",
+			files:   map[string]string{"main.yml": "include: {a: b}\n"},
+			wantErr: "include must be a path or a list of paths",
+		},
+		{
+			name: "datasource reference overridden by sibling keys",
+			files: map[string]string{"main.yml": `
+definitions:
+  datasources:
+    customers:
+      driver: postgres
+      objectid: customers
+      fields: [id, name]
+extract:
+  primary:
+    customers:
+      $ref: datasources/customers
+      objectid: clients
+`},
+			check: func(m *Metadata) (interface{}, interface{}) {
+				customers := m.Extract.PrimaryDataSources["customers"]
+				return customers.Driver + " " + customers.ObjectIdentifier + " " + customers.Fields[1].Name, "postgres clients name"
+			},
+		},
+		{
+			name: "field set references are spliced into lists",
+			files: map[string]string{"main.yml": `
+definitions:
+  fields:
+    audit: [created, updated]
+extract:
+  primary:
+    customers:
+      fields:
+        - id
+        - $ref: "#/definitions/fields/audit"
+`},
+			check: func(m *Metadata) (interface{}, interface{}) {
+				return len(m.Extract.PrimaryDataSources["customers"].Fields), 3
+			},
+		},
+		{
+			name: "reference cycle",
+			files: map[string]string{"main.yml": `
+definitions:
+  datasources:
+    a:
+      $ref: datasources/b
+    b:
+      $ref: datasources/a
+`},
+			wantErr: "$ref cycle: datasources/a -> datasources/b -> datasources/a",
+		},
+		{
+			name: "unknown definition",
+			files: map[string]string{
+				"main.yml": "extract:\n  primary:\n    customers:\n      $ref: datasources/missing\n",
+			},
+			wantErr: "extract.primary.customers: unknown definition datasources/missing",
+		},
+		{
+			name:    "unknown kind of definitions",
+			files:   map[string]string{"main.yml": "definitions:\n  tables: {}\n"},
+			wantErr: "unknown kind of definitions tables",
+		},
+		{
+			name:    "invalid definition",
+			files:   map[string]string{"main.yml": "definitions:\n  datasources:\n    customers:\n      unknown: true\n"},
+			wantErr: "invalid definition datasources/customers",
+		},
+		{
+			name: "errors of composed documents name their entry",
+			files: map[string]string{
+				"base.yml": "load:\n  customers:\n    unknown: true\n",
+				"main.yml": "include: base.yml\n",
+			},
+			wantErr: "load.customers: error deserializing metadata as yaml",
+		},
+		{
+			name: "composed scalars keep their text",
+			files: map[string]string{
+				"base.yml": "extract:\n  primary:\n    customers:\n      objectid: 0123\n",
+				"main.yml": "include: base.yml\nextract:\n  primary:\n    customers:\n      watermark: no\n",
+			},
+			check: func(m *Metadata) (interface{}, interface{}) {
+				customers := m.Extract.PrimaryDataSources["customers"]
+				return customers.ObjectIdentifier + " " + customers.Watermark, "0123 no"
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeFiles(t, test.files)
+			defer os.RemoveAll(dir)
+			metadata, err := ParseMetadataFile(filepath.Join(dir, "main.yml"), nil)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ParseMetadataFile() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMetadataFile() error = %v", err)
+			}
+			if got, want := test.check(metadata); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package common
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// document is a metadata file as written, before its includes and definitions are resolved; it types the values of a
+// document when it is written again
+type document struct {
+	Metadata    `yaml:",inline"`
+	Include     []string `yaml:"include"`
+	Definitions struct {
+		DataSources map[string]DataEndpoint `yaml:"datasources"`
+		Fields      map[string]Fields       `yaml:"fields"`
+	} `yaml:"definitions"`
+}
+
+var (
+	documentType        = reflect.TypeOf(document{})
+	extractType         = reflect.TypeOf(Extract{})
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// scalar is a yaml scalar along with its text, since plain scalars as y, no or 0123 are read as other types than strings,
+// and writing their value back would change what string fields read
+type scalar struct {
+	text  string
+	value interface{}
+}
+
+// MarshalYAML writes the value of the scalar, used by the values that are not rendered
+func (s scalar) MarshalYAML() (interface{}, error) {
+	return s.value, nil
+}
+
+// node reads a yaml value as yaml.MapSlice, []interface{} and scalar values
+type node struct {
+	value interface{}
+}
+
+// UnmarshalYAML reads a value according to its kind, keeping the order of mappings and the text of scalars
+func (n *node) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var generic interface{}
+	if err := unmarshal(&generic); err != nil {
+		return err
+	}
+	switch generic.(type) {
+	case map[interface{}]interface{}:
+		values := map[interface{}]*node{}
+		if err := unmarshal(&values); err != nil {
+			return err
+		}
+		var keys yaml.MapSlice
+		if err := unmarshal(&keys); err != nil {
+			return err
+		}
+		mapping := make(yaml.MapSlice, 0, len(keys))
+		for _, key := range keys {
+			mapping = append(mapping, yaml.MapItem{Key: key.Key, Value: values[key.Key].get()})
+		}
+		n.value = mapping
+	case []interface{}:
+		var items []*node
+		if err := unmarshal(&items); err != nil {
+			return err
+		}
+		list := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			list = append(list, item.get())
+		}
+		n.value = list
+	default:
+		var text string
+		if err := unmarshal(&text); err != nil {
+			return err
+		}
+		n.value = scalar{text: text, value: generic}
+	}
+	return nil
+}
+
+// get returns the value of a node, which is nil for null values
+func (n *node) get() interface{} {
+	if n == nil {
+		return nil
+	}
+	return n.value
+}
+
+// readDocument reads a yaml mapping keeping the text of its scalars; keys are read as their values
+func readDocument(data []byte) (yaml.MapSlice, error) {
+	var root node
+	if err := yaml.UnmarshalStrict(data, &root); err != nil {
+		return nil, err
+	}
+	switch value := root.value.(type) {
+	case nil:
+		return yaml.MapSlice{}, nil
+	case yaml.MapSlice:
+		return value, nil
+	default:
+		return nil, fmt.Errorf("metadata must be a mapping")
+	}
+}
+
+// text returns the text of a scalar, or the value formatted otherwise
+func text(value interface{}) string {
+	if s, ok := value.(scalar); ok {
+		return s.text
+	}
+	return fmt.Sprint(value)
+}
+
+// isString indicates whether a value is a scalar read as a string
+func isString(value interface{}) bool {
+	s, ok := value.(scalar)
+	if !ok {
+		return false
+	}
+	_, ok = s.value.(string)
+	return ok
+}
+
+// render converts a document read by readDocument into values written as they were read by fields of type t: scalars
+// take their text for strings and text unmarshalers, and their value otherwise. Values without type are written as
+// they were read
+func render(value interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch value := value.(type) {
+	case scalar:
+		if value.value != nil && t != nil && (t.Kind() == reflect.String || reflect.PtrTo(t).Implements(textUnmarshalerType)) {
+			return value.text
+		}
+		return value.value
+	case yaml.MapSlice:
+		result := make(yaml.MapSlice, 0, len(value))
+		fields := fieldTypes(t)
+		for _, item := range value {
+			var itemType reflect.Type
+			if t != nil && t.Kind() == reflect.Map {
+				itemType = t.Elem()
+			} else if fields != nil {
+				itemType = fields[text(item.Key)]
+			}
+			result = append(result, yaml.MapItem{Key: render(item.Key, nil), Value: render(item.Value, itemType)})
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, 0, len(value))
+		var itemType reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			itemType = t.Elem()
+		}
+		for _, item := range value {
+			result = append(result, render(item, itemType))
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+// fieldTypes maps the yaml keys of a struct to the types of their fields, following inline fields
+func fieldTypes(t reflect.Type) map[string]reflect.Type {
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	result := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		if len(tag) > 1 && tag[1] == "inline" {
+			for key, fieldType := range fieldTypes(field.Type) {
+				result[key] = fieldType
+			}
+			continue
+		}
+		key := tag[0]
+		if key == "" {
+			key = strings.ToLower(field.Name)
+		}
+		result[key] = field.Type
+	}
+	if t == extractType {
+		// the misspelled key of schema 1 metadata
+		result["aditional"] = result["additional"]
+	}
+	return result
+}
@@ -3,8 +3,7 @@ package common
 import (
 	"fmt"
 	"strings"
-
-	"gopkg.in/yaml.v2"
+	"time"
 )
 
 // EndOfStreamHeader indicates the header name which indicates that the streaming has ended
@@ -15,11 +14,33 @@ type Fields []Field
 
 // DataEndpoint contains information of a single entity which acts both as a source and as a data destination
 type DataEndpoint struct {
-	AccessorURL      string `yaml:"accessorURL"`
-	Driver           string `yaml:"driver"`
-	ConnectionString string `yaml:"connectionstring"`
-	ObjectIdentifier string `yaml:"objectid"`
-	Fields           Fields `yaml:"fields"`
+	AccessorURL      string         `yaml:"accessorURL"`
+	Driver           string         `yaml:"driver"`
+	ConnectionString string         `yaml:"connectionstring"`
+	ObjectIdentifier string         `yaml:"objectid"`
+	Fields           Fields         `yaml:"fields"`
+	Watermark        string         `yaml:"watermark"`
+	Cache            *CacheSettings `yaml:"cache"`
+	Preload          bool           `yaml:"preload"`
+	PreloadLimit     int            `yaml:"preloadlimit"`
+	PreloadMaxBytes  int64          `yaml:"preloadmaxbytes"`
+}
+
+const (
+	// CacheNamespaceRun scopes the cached records of a datasource to a single run
+	CacheNamespaceRun = "run"
+
+	// CacheNamespaceVersion scopes the cached records of a datasource to the version of the metadata
+	CacheNamespaceVersion = "version"
+)
+
+// CacheSettings defines how the records fetched from an additional datasource are cached; the namespace is either
+// CacheNamespaceRun, CacheNamespaceVersion or any literal value shared by the jobs that must reuse the same records
+type CacheSettings struct {
+	TTL         time.Duration `yaml:"ttl"`
+	CacheMisses bool          `yaml:"cachemisses"`
+	MissTTL     time.Duration `yaml:"missttl"`
+	Namespace   string        `yaml:"namespace"`
 }
 
 // DataSource is a DataEndpoint used as a source of a transformation
@@ -27,10 +48,38 @@ type DataSource struct {
 	DataEndpoint
 }
 
+// WriteMode indicates how the records of a run are written into a destination
+type WriteMode string
+
+const (
+	// WriteModeAppend adds every record to the destination; it is the default mode
+	WriteModeAppend WriteMode = "append"
+
+	// WriteModeUpsert replaces the existing records with the same keys, inserting the missing ones
+	WriteModeUpsert WriteMode = "upsert"
+
+	// WriteModeReplace replaces the whole content of the destination with the records of the run once the load is finished
+	WriteModeReplace WriteMode = "replace"
+
+	// WriteModeTruncateInsert empties the destination before the load starts and then adds every record
+	WriteModeTruncateInsert WriteMode = "truncate-insert"
+)
+
 // DataDestination is a DataEndpoint used as a destination of a transformation
 type DataDestination struct {
 	DataEndpoint       `yaml:",inline"`
-	TransformationName string `yaml:"transformation"`
+	TransformationName string    `yaml:"transformation"`
+	Keys               []string  `yaml:"keys"`
+	Mode               WriteMode `yaml:"mode"`
+	Staged             bool      `yaml:"staged"`
+}
+
+// WriteMode returns the write mode of the destination, defaulting to WriteModeAppend
+func (dd *DataDestination) WriteMode() WriteMode {
+	if dd.Mode == "" {
+		return WriteModeAppend
+	}
+	return dd.Mode
 }
 
 // OnClause represents a single on clause comparing two fields between datasources
@@ -90,28 +139,64 @@ func (f *Field) UnmarshalText(text []byte) error {
 	return nil
 }
 
-// Extract contains primary datasources (which are fully read and cannot be related to each others) and aditional datasources (used on join clauses on transformations)
+// Extract contains primary datasources (which are fully read and cannot be related to each others) and additional datasources (used on join clauses on transformations)
 type Extract struct {
-	PrimaryDataSources   map[string]DataEndpoint `yaml:"primary"`
-	AditionalDataSources map[string]DataEndpoint `yaml:"aditional"`
+	PrimaryDataSources    map[string]DataEndpoint `yaml:"primary"`
+	AdditionalDataSources map[string]DataEndpoint `yaml:"additional"`
+}
+
+// UnmarshalYAML reads an Extract accepting the additional datasources under aditional, their misspelled key up to
+// schema 1 of the metadata
+func (e *Extract) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type extract Extract
+	var value struct {
+		extract   `yaml:",inline"`
+		Aditional map[string]DataEndpoint `yaml:"aditional"`
+	}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*e = Extract(value.extract)
+	if value.Aditional != nil {
+		if e.AdditionalDataSources != nil {
+			return fmt.Errorf("extract has both additional and aditional datasources; aditional is the key of schema 1 metadata, renamed to additional")
+		}
+		e.AdditionalDataSources = value.Aditional
+	}
+	return nil
 }
 
-// Metadata represents the definition of a single row of data
+// Metadata represents the definition of a single row of data; its schema is the version of the metadata format, while its
+// version is a revision chosen by its authors
 type Metadata struct {
+	Schema    string                        `yaml:"schema"`
 	Version   string                        `yaml:"version"`
 	Extract   Extract                       `yaml:"extract"`
 	Transform map[string]DataTransformation `yaml:"transform"`
 	Load      map[string]DataDestination    `yaml:"load"`
 }
 
-// ParseMetadata converts a string to a Metadata instance
+// ParseMetadata converts a string to a Metadata instance: the files it includes, relative to the working directory, are
+// merged before its own content, the $ref of its definitions are resolved and so are the ${env:NAME} and ${file:/path}
+// references of its values
 func ParseMetadata(data string) (*Metadata, error) {
-	var result = new(Metadata)
-	err := yaml.UnmarshalStrict([]byte(data), &result)
+	c := composer{}
+	document, data, err := c.parse(data, ".", nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.decode(data, document)
+}
+
+// ParseMetadataFile reads a metadata file and converts it to a Metadata instance as ParseMetadata does; the files it
+// includes are relative to its directory, and the ${name} placeholders of every file are filled with params, when given
+func ParseMetadataFile(path string, params ParamLookup) (*Metadata, error) {
+	c := composer{params: params}
+	document, data, err := c.file(path, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error deserializing metadata as yaml: %v", err)
+		return nil, err
 	}
-	return result, nil
+	return c.decode(data, document)
 }
 
 // Parse returns the components of a select clause, splitting it by '.'
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseMetadataSecrets(t *testing.T) {
+	os.Setenv("GOTRANSFORM_TEST_PASSWORD", "p4ss: #word")
+	defer os.Unsetenv("GOTRANSFORM_TEST_PASSWORD")
+	tests := []struct {
+		name    string
+		data    string
+		check   func(*Metadata) (string, string)
+		wantErr bool
+	}{
+		{
+			name: "env reference",
+			data: `
+extract:
+  primary:
+    customers:
+      connectionstring: postgres://user:${env:GOTRANSFORM_TEST_PASSWORD}@host/db
+`,
+			check: func(m *Metadata) (string, string) {
+				return m.Extract.PrimaryDataSources["customers"].ConnectionString, "postgres://user:p4ss: #word@host/db"
+			},
+		},
+		{
+			name: "other scalars keep their text",
+			data: `
+extract:
+  primary:
+    customers:
+      connectionstring: ${env:GOTRANSFORM_TEST_PASSWORD}
+      objectid: 0123
+      watermark: y
+`,
+			check: func(m *Metadata) (string, string) {
+				customers := m.Extract.PrimaryDataSources["customers"]
+				return customers.ObjectIdentifier + " " + customers.Watermark, "0123 y"
+			},
+		},
+		{
+			name: "unset envVar",
+			data: `
+extract:
+  primary:
+    customers:
+      connectionstring: ${env:GOTRANSFORM_TEST_MISSING}
+`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata, err := ParseMetadata(test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseMetadata() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.check == nil {
+				return
+			}
+			if got, want := test.check(metadata); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/ezeriver94/gotransform/env"
+)
+
+// placeholder matches the ${name} placeholders of a metadata, and the $${name} escapes that keep them literal. Names
+// have no colon, so the ${env:NAME} and ${file:/path} secret references never match
+var placeholder = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_.-]*)\}`)
+
+// EnvParamPrefix prefixes the envVars defining params, as PARAM_TENANT does for ${tenant}
+const EnvParamPrefix = "PARAM_"
+
+// ParamLookup returns the value of a param, reporting whether it is defined
+type ParamLookup func(name string) (string, bool)
+
+// Params maps the names of params to their values
+type Params map[string]string
+
+// Lookup returns the value of a param
+func (p Params) Lookup(name string) (string, bool) {
+	value, ok := p[name]
+	return value, ok
+}
+
+// BuiltinParams returns the params defined by every run: run_id, and run_date and run_time, the start of the run
+// formatted as 2006-01-02 and RFC3339
+func BuiltinParams(runID string, started time.Time) Params {
+	return Params{
+		"run_id":   runID,
+		"run_date": started.Format("2006-01-02"),
+		"run_time": started.Format(time.RFC3339),
+	}
+}
+
+// LoadParams reads a yaml file mapping the names of params to their values
+func LoadParams(path string) (Params, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading params file %v: %v", path, err)
+	}
+	values := map[string]interface{}{}
+	if err := yaml.UnmarshalStrict(content, &values); err != nil {
+		return nil, fmt.Errorf("error deserializing params file %v as yaml: %v", path, err)
+	}
+	result := Params{}
+	for name, value := range values {
+		if value == nil {
+			value = ""
+		}
+		result[name] = fmt.Sprint(value)
+	}
+	return result, nil
+}
+
+// EnvParam looks up a param in the envVar named after it with the EnvParamPrefix, in upper case
+func EnvParam(name string) (string, bool) {
+	value, ok, _ := env.Lookup(EnvParamPrefix + strings.ToUpper(name))
+	return value, ok
+}
+
+// LayeredParams returns a lookup that tries every lookup in order, so the first ones take precedence
+func LayeredParams(lookups ...ParamLookup) ParamLookup {
+	return func(name string) (string, bool) {
+		for _, lookup := range lookups {
+			if value, ok := lookup(name); ok {
+				return value, true
+			}
+		}
+		return "", false
+	}
+}
+
+// Interpolate replaces the ${name} placeholders of a value with the value of their params; $${name} is kept as the
+// literal ${name}. Every undefined param is reported
+func Interpolate(data string, lookup ParamLookup) (string, error) {
+	undefined := map[string]bool{}
+	result := replaceParams(data, lookup, undefined)
+	if err := undefinedParams(undefined); err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// replaceParams replaces the placeholders of data, adding the names of the undefined params to undefined
+func replaceParams(data string, lookup ParamLookup, undefined map[string]bool) string {
+	return placeholder.ReplaceAllStringFunc(data, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		name := placeholder.FindStringSubmatch(match)[1]
+		value, ok := lookup(name)
+		if !ok {
+			undefined[name] = true
+			return match
+		}
+		return value
+	})
+}
+
+// undefinedParams returns an error listing the undefined params, if any
+func undefinedParams(undefined map[string]bool) error {
+	if len(undefined) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(undefined))
+	for name := range undefined {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("undefined metadata params: %v", strings.Join(names, ", "))
+}
@@ -0,0 +1,172 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInterpolate(t *testing.T) {
+	params := Params{"tenant": "acme", "empty": ""}
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr string
+	}{
+		{name: "placeholder", data: "customers_${tenant}", want: "customers_acme"},
+		{name: "empty param", data: "a${empty}b", want: "ab"},
+		{name: "escaped placeholder", data: "$${tenant}", want: "${tenant}"},
+		{name: "secret reference", data: "${env:PASSWORD}", want: "${env:PASSWORD}"},
+		{name: "undefined params", data: "${b} ${a} ${b}", wantErr: "undefined metadata params: a, b"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Interpolate(test.data, params.Lookup)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("Interpolate() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Interpolate() error = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("Interpolate() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLayeredParams(t *testing.T) {
+	lookup := LayeredParams(Params{"tenant": "flag"}.Lookup, Params{"tenant": "file", "region": "us"}.Lookup)
+	tests := []struct {
+		name   string
+		want   string
+		wantOk bool
+	}{
+		{"tenant", "flag", true},
+		{"region", "us", true},
+		{"missing", "", false},
+	}
+	for _, test := range tests {
+		if got, ok := lookup(test.name); got != test.want || ok != test.wantOk {
+			t.Errorf("lookup(%v) = %q, %v, want %q, %v", test.name, got, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestBuiltinParams(t *testing.T) {
+	started := time.Date(2020, 7, 1, 10, 30, 0, 0, time.UTC)
+	want := Params{"run_id": "run", "run_date": "2020-07-01", "run_time": "2020-07-01T10:30:00Z"}
+	if got := BuiltinParams("run", started); !reflect.DeepEqual(got, want) {
+		t.Errorf("BuiltinParams() = %v, want %v", got, want)
+	}
+}
+
+func TestLoadParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "params")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "params.yml")
+	if err := ioutil.WriteFile(path, []byte("tenant: acme\nbatch: 100\nnothing:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadParams(path)
+	if err != nil {
+		t.Fatalf("LoadParams() error = %v", err)
+	}
+	want := Params{"tenant": "acme", "batch": "100", "nothing": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadParams() = %v, want %v", got, want)
+	}
+	if _, err := LoadParams(filepath.Join(dir, "missing.yml")); err == nil {
+		t.Error("LoadParams() of a missing file returned no error")
+	}
+}
+
+func TestParseMetadataFileParams(t *testing.T) {
+	params := Params{
+		"tenant": "acme",
+		"where":  "name: 'x' # not a comment",
+		"quoted": `"quoted"`,
+		"lines":  "first\nsecond",
+		"bytes":  "1024",
+		"port":   "0123",
+	}
+	tests := []struct {
+		name    string
+		data    string
+		check   func(*Metadata) (interface{}, interface{})
+		wantErr string
+	}{
+		{
+			name: "params with yaml syntax are kept as they are",
+			data: "extract:\n  primary:\n    customers:\n      objectid: ${where}\n      driver: ${quoted}\n      connectionstring: ${lines}\n",
+			check: func(m *Metadata) (interface{}, interface{}) {
+				customers := m.Extract.PrimaryDataSources["customers"]
+				return []string{customers.ObjectIdentifier, customers.Driver, customers.ConnectionString}, []string{params["where"], params["quoted"], params["lines"]}
+			},
+		},
+		{
+			name: "params in keys",
+			data: "extract:\n  primary:\n    customers_${tenant}:\n      objectid: customers\n",
+			check: func(m *Metadata) (interface{}, interface{}) {
+				return m.Extract.PrimaryDataSources["customers_acme"].ObjectIdentifier, "customers"
+			},
+		},
+		{
+			name: "numeric params",
+			data: "extract:\n  primary:\n    customers:\n      objectid: ${port}\n      preloadmaxbytes: ${bytes}\n",
+			check: func(m *Metadata) (interface{}, interface{}) {
+				customers := m.Extract.PrimaryDataSources["customers"]
+				return []interface{}{customers.ObjectIdentifier, customers.PreloadMaxBytes}, []interface{}{"0123", int64(1024)}
+			},
+		},
+		{
+			name: "placeholders in comments are ignored",
+			data: "# uses ${undefined}\nextract:\n  primary:\n    customers:\n      objectid: customers # of ${tenant}\n",
+			check: func(m *Metadata) (interface{}, interface{}) {
+				return m.Extract.PrimaryDataSources["customers"].ObjectIdentifier, "customers"
+			},
+		},
+		{
+			name: "escaped placeholders",
+			data: "extract:\n  primary:\n    customers:\n      objectid: $${tenant}\n",
+			check: func(m *Metadata) (interface{}, interface{}) {
+				return m.Extract.PrimaryDataSources["customers"].ObjectIdentifier, "${tenant}"
+			},
+		},
+		{
+			name:    "undefined params",
+			data:    "extract:\n  primary:\n    customers:\n      objectid: ${table}\n      driver: ${driver}\n",
+			wantErr: "undefined metadata params: driver, table",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"main.yml": test.data})
+			defer os.RemoveAll(dir)
+			metadata, err := ParseMetadataFile(filepath.Join(dir, "main.yml"), params.Lookup)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ParseMetadataFile() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMetadataFile() error = %v", err)
+			}
+			if got, want := test.check(metadata); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -2,6 +2,9 @@ package common
 
 import (
 	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -80,3 +83,90 @@ func (s *MapSet) Items() []*Key {
 func (s *MapSet) Length() int {
 	return len(s.Items())
 }
+
+// CompareValues returns -1, 0 or 1 when a is lower, equal or greater than b; integers are compared exactly, so ids above
+// 2^53 keep their order, other numeric values are compared as numbers and every other value by its string representation
+func CompareValues(a, b interface{}) int {
+	integerA, okA := toInteger(a)
+	integerB, okB := toInteger(b)
+	if okA && okB {
+		switch {
+		case integerA < integerB:
+			return -1
+		case integerA > integerB:
+			return 1
+		default:
+			return 0
+		}
+	}
+	numberA, okA := toFloat(a)
+	numberB, okB := toFloat(b)
+	if okA && okB {
+		switch {
+		case numberA < numberB:
+			return -1
+		case numberA > numberB:
+			return 1
+		default:
+			return 0
+		}
+	}
+	return strings.Compare(FieldToString(a), FieldToString(b))
+}
+
+// toInteger returns the value of integers, and of floats without decimals that fit on an int64
+func toInteger(value interface{}) (int64, bool) {
+	switch value.(type) {
+	case int:
+		return int64(value.(int)), true
+	case int32:
+		return int64(value.(int32)), true
+	case int64:
+		return value.(int64), true
+	case uint32:
+		return int64(value.(uint32)), true
+	case uint64:
+		return int64(value.(uint64)), value.(uint64) <= math.MaxInt64
+	case float32, float64:
+		number, _ := toFloat(value)
+		if number != math.Trunc(number) || number < math.MinInt64 || number >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(number), true
+	case json.Number:
+		result, err := value.(json.Number).Int64()
+		return result, err == nil
+	case string:
+		result, err := strconv.ParseInt(value.(string), 10, 64)
+		return result, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch value.(type) {
+	case int:
+		return float64(value.(int)), true
+	case int32:
+		return float64(value.(int32)), true
+	case int64:
+		return float64(value.(int64)), true
+	case uint32:
+		return float64(value.(uint32)), true
+	case uint64:
+		return float64(value.(uint64)), true
+	case float32:
+		return float64(value.(float32)), true
+	case float64:
+		return value.(float64), true
+	case json.Number:
+		result, err := value.(json.Number).Float64()
+		return result, err == nil
+	case string:
+		result, err := strconv.ParseFloat(value.(string), 64)
+		return result, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestCompareValues(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b interface{}
+		want int
+	}{
+		{"lower int", 1, 2, -1},
+		{"equal mixed numbers", 2, float64(2), 0},
+		{"greater json number", json.Number("10"), 9, 1},
+		{"numeric strings compare as numbers", "10", "9", 1},
+		{"dates compare as strings", "2020-01-02", "2020-01-10", -1},
+		{"equal strings", "b", "b", 0},
+		{"large ids", int64(9007199254740993), int64(9007199254740992), 1},
+		{"large json numbers", json.Number("9007199254740993"), json.Number("9007199254740992"), 1},
+		{"large json number and int", json.Number("9007199254740993"), int64(9007199254740993), 0},
+		{"large numeric strings", "9007199254740992", "9007199254740993", -1},
+		{"integer and decimal", 2, 2.5, -1},
+		{"decimal json numbers", json.Number("2.5"), json.Number("2.25"), 1},
+		{"uint above int64", uint64(math.MaxUint64), int64(math.MaxInt64), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := CompareValues(test.a, test.b); got != test.want {
+				t.Errorf("CompareValues(%v, %v) = %v, want %v", test.a, test.b, got, test.want)
+			}
+		})
+	}
+}
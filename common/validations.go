@@ -128,3 +128,28 @@ func (ds *DataEndpoint) Validate(record *Record) error {
 
 	return nil
 }
+
+// ValidateKeys checks that every key of a destination is one of its fields
+func (dd *DataDestination) ValidateKeys() error {
+	for _, key := range dd.Keys {
+		if _, err := dd.Fields.Find(key); err != nil {
+			return fmt.Errorf("invalid key %v: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// ValidateMode checks that the write mode of a destination is known and that upserts have keys to identify records
+func (dd *DataDestination) ValidateMode() error {
+	switch dd.WriteMode() {
+	case WriteModeAppend, WriteModeReplace, WriteModeTruncateInsert:
+		return nil
+	case WriteModeUpsert:
+		if len(dd.Keys) == 0 {
+			return fmt.Errorf("mode %v needs keys to identify records", dd.Mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown write mode %v", dd.Mode)
+	}
+}
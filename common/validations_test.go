@@ -0,0 +1,37 @@
+package common
+
+import "testing"
+
+func TestDataDestinationValidation(t *testing.T) {
+	fields := Fields{{Name: "id"}, {Name: "name"}}
+	tests := []struct {
+		name     string
+		mode     WriteMode
+		keys     []string
+		wantMode WriteMode
+		wantErr  bool
+	}{
+		{"default mode appends", "", nil, WriteModeAppend, false},
+		{"replace", WriteModeReplace, nil, WriteModeReplace, false},
+		{"truncate-insert", WriteModeTruncateInsert, nil, WriteModeTruncateInsert, false},
+		{"upsert with keys", WriteModeUpsert, []string{"id"}, WriteModeUpsert, false},
+		{"upsert without keys", WriteModeUpsert, nil, WriteModeUpsert, true},
+		{"unknown mode", "merge", nil, "merge", true},
+		{"unknown key", WriteModeAppend, []string{"email"}, WriteModeAppend, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destination := DataDestination{DataEndpoint: DataEndpoint{Fields: fields}, Mode: test.mode, Keys: test.keys}
+			if got := destination.WriteMode(); got != test.wantMode {
+				t.Errorf("WriteMode() = %v, want %v", got, test.wantMode)
+			}
+			err := destination.ValidateKeys()
+			if err == nil {
+				err = destination.ValidateMode()
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("validation error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
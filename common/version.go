@@ -0,0 +1,116 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// CurrentSchema is the version of the metadata format written by MigrateMetadata
+	CurrentSchema = "2"
+
+	// legacySchema is the version of the metadata format written before it was checked, so metadata without schema are
+	// read as such
+	legacySchema = "1"
+
+	// schemaKey holds the version of the metadata format; the version key is left to the revisions of the metadata itself,
+	// as used by the version cache namespace
+	schemaKey = "schema"
+)
+
+// migration rewrites a metadata document of a schema to the next one
+type migration struct {
+	to          string
+	description string
+	migrate     func(document yaml.MapSlice) error
+}
+
+// migrations are the changes of the metadata format, indexed by the schema they apply to; every schema with a migration
+// is still read by ParseMetadata
+var migrations = map[string]migration{
+	"1": {to: "2", description: "extract.aditional renamed to extract.additional", migrate: renameAditional},
+}
+
+// SupportedSchemas returns the versions of the metadata format that can be read
+func SupportedSchemas() []string {
+	schemas := []string{CurrentSchema}
+	for schema := range migrations {
+		schemas = append(schemas, schema)
+	}
+	sort.Strings(schemas)
+	return schemas
+}
+
+// CheckSchema returns an error for the versions of the metadata format that cannot be read; an empty schema is the
+// legacy one
+func CheckSchema(schema string) error {
+	if schema == "" {
+		schema = legacySchema
+	}
+	if schema == CurrentSchema {
+		return nil
+	}
+	if _, ok := migrations[schema]; ok {
+		return nil
+	}
+	return fmt.Errorf("unsupported metadata schema %q; supported schemas are %v", schema, strings.Join(SupportedSchemas(), ", "))
+}
+
+// MigrateMetadata rewrites a metadata document to the current schema, returning it along with the description of every
+// change applied; documents already at the current schema are returned as they are. Comments are not kept, and includes,
+// definitions and placeholders are not resolved, so every included file is migrated on its own
+func MigrateMetadata(data string) (string, []string, error) {
+	document, err := readDocument([]byte(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("error deserializing metadata as yaml: %v", err)
+	}
+	schema := legacySchema
+	if value, _ := pop(document, schemaKey); value != nil && text(value) != "" {
+		schema = text(value)
+	}
+	if err := CheckSchema(schema); err != nil {
+		return "", nil, err
+	}
+	if schema == CurrentSchema {
+		return data, nil, nil
+	}
+	applied := make([]string, 0)
+	for schema != CurrentSchema {
+		step := migrations[schema]
+		if err := step.migrate(document); err != nil {
+			return "", nil, fmt.Errorf("error migrating metadata from schema %v to %v: %v", schema, step.to, err)
+		}
+		applied = append(applied, fmt.Sprintf("%v to %v: %v", schema, step.to, step.description))
+		schema = step.to
+	}
+	_, rest := pop(document, schemaKey)
+	document = append(yaml.MapSlice{{Key: schemaKey, Value: CurrentSchema}}, rest...)
+	content, err := yaml.Marshal(render(document, documentType))
+	if err != nil {
+		return "", nil, fmt.Errorf("error serializing migrated metadata: %v", err)
+	}
+	return string(content), applied, nil
+}
+
+// renameAditional renames the misspelled aditional key of the extract section to additional, keeping its position
+func renameAditional(document yaml.MapSlice) error {
+	value, _ := pop(document, "extract")
+	extract, ok := value.(yaml.MapSlice)
+	if !ok {
+		return nil
+	}
+	if additional, _ := pop(extract, "additional"); additional != nil {
+		if aditional, _ := pop(extract, "aditional"); aditional != nil {
+			return fmt.Errorf("extract has both additional and aditional datasources")
+		}
+	}
+	for i, item := range extract {
+		if item.Key == "aditional" {
+			extract[i].Key = "additional"
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckSchema(t *testing.T) {
+	tests := []struct {
+		schema  string
+		wantErr bool
+	}{
+		{schema: ""},
+		{schema: "1"},
+		{schema: CurrentSchema},
+		{schema: "3", wantErr: true},
+		{schema: "v2", wantErr: true},
+	}
+	for _, test := range tests {
+		if err := CheckSchema(test.schema); (err != nil) != test.wantErr {
+			t.Errorf("CheckSchema(%q) error = %v, wantErr %v", test.schema, err, test.wantErr)
+		}
+	}
+}
+
+func TestMigrateMetadata(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		want        string
+		wantApplied int
+		wantErr     string
+	}{
+		{
+			name:        "legacy metadata",
+			data:        "version: 7\nextract:\n  primary:\n    orders:\n      objectid: orders\n  aditional:\n    customers:\n      objectid: 0123\n",
+			want:        "schema: \"2\"\nversion: \"7\"\nextract:\n  primary:\n    orders:\n      objectid: orders\n  additional:\n    customers:\n      objectid: \"0123\"\n",
+			wantApplied: 1,
+		},
+		{
+			name:        "explicit legacy schema",
+			data:        "schema: 1\nextract:\n  aditional:\n    customers:\n      objectid: customers\n",
+			want:        "schema: \"2\"\nextract:\n  additional:\n    customers:\n      objectid: customers\n",
+			wantApplied: 1,
+		},
+		{
+			name: "current schema is kept as it is",
+			data: "schema: 2 # current\nversion: 7\n",
+			want: "schema: 2 # current\nversion: 7\n",
+		},
+		{
+			name:    "both additional keys",
+			data:    "extract:\n  additional: {}\n  aditional: {}\n",
+			wantErr: "both additional and aditional",
+		},
+		{
+			name:    "unsupported schema",
+			data:    "schema: 9\n",
+			wantErr: "unsupported metadata schema",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, applied, err := MigrateMetadata(test.data)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("MigrateMetadata() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MigrateMetadata() error = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("MigrateMetadata() = %q, want %q", got, test.want)
+			}
+			if len(applied) != test.wantApplied {
+				t.Errorf("MigrateMetadata() applied %v, want %v changes", applied, test.wantApplied)
+			}
+		})
+	}
+}
+
+func TestParseMetadataSchema(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		wantVersion string
+		wantSources []string
+		wantErr     string
+	}{
+		{
+			name:        "legacy aditional key",
+			data:        "version: 7\nextract:\n  aditional:\n    customers:\n      objectid: customers\n",
+			wantVersion: "7",
+			wantSources: []string{"customers"},
+		},
+		{
+			name:        "version is free along the current schema",
+			data:        "schema: 2\nversion: 2020-07-01\nextract:\n  additional:\n    customers:\n      objectid: customers\n",
+			wantVersion: "2020-07-01",
+			wantSources: []string{"customers"},
+		},
+		{
+			name:    "unsupported schema",
+			data:    "schema: 3\n",
+			wantErr: "unsupported metadata schema",
+		},
+		{
+			name:    "both additional keys",
+			data:    "extract:\n  additional: {}\n  aditional: {}\n",
+			wantErr: "both additional and aditional",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata, err := ParseMetadata(test.data)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ParseMetadata() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMetadata() error = %v", err)
+			}
+			if metadata.Version != test.wantVersion {
+				t.Errorf("Version = %q, want %q", metadata.Version, test.wantVersion)
+			}
+			sources := make([]string, 0)
+			for name := range metadata.Extract.AdditionalDataSources {
+				sources = append(sources, name)
+			}
+			if !reflect.DeepEqual(sources, test.wantSources) {
+				t.Errorf("additional datasources = %v, want %v", sources, test.wantSources)
+			}
+		})
+	}
+}
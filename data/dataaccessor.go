@@ -2,8 +2,8 @@ package data
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -15,40 +15,114 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// DataAccessor is a DataProvider backed by an accessor service, reached through http and websockets
 type DataAccessor struct {
-	Url *string
-	ID  string "github.com/gorilla/websocket"
+	Url         string
+	ID          string
+	Keys        []string
+	Mode        common.WriteMode
+	CachePolicy cache.Policy
+	cache       cache.Cache
+	started     bool
 }
 
-func NewDataAccessor(url, id string) DataAccessor {
+// NewDataAccessor creates an accessor for the service on url, caching its fetches on c
+func NewDataAccessor(url, id string, c cache.Cache) DataAccessor {
+	if c == nil {
+		c = cache.NewNoopCache()
+	}
 	return DataAccessor{
-		Url: flag.String(fmt.Sprintf("%v addr", id), url, fmt.Sprintf("http service address for id %v", id)),
-		ID:  id,
+		Url:   url,
+		ID:    id,
+		Mode:  common.WriteModeAppend,
+		cache: c,
 	}
 }
-func (da *DataAccessor) Save(r common.Record) error {
-	u := url.URL{Scheme: "http", Host: *da.Url, Path: "/save"}
 
-	jsonBody, err := json.Marshal(r)
+func (da *DataAccessor) settings() LoadSettings {
+	return LoadSettings{
+		Keys: da.Keys,
+		Mode: da.Mode,
+	}
+}
+
+// post sends a json body to a path of the accessor service and fails on any status other than 200
+func (da *DataAccessor) post(path string, body interface{}) error {
+	u := url.URL{Scheme: "http", Host: da.Url, Path: path}
+	jsonBody, err := json.Marshal(body)
 	if err != nil {
-		return fmt.Errorf("error serializing request %v: %v", r, err)
+		return fmt.Errorf("error serializing request %v: %v", body, err)
 	}
-	log.Infof("saving %v to %v", string(jsonBody), u.String())
+	log.Infof("posting %v to %v", string(jsonBody), u.String())
 
 	resp, err := http.Post(u.String(), "application/json", bytes.NewBuffer(jsonBody))
 	if err != nil {
-		return fmt.Errorf("error fetching data with request %v: %v", r, err)
+		return fmt.Errorf("error posting to %v: %v", u.String(), err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("error fetching data with request %v: %v", r, err)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnprocessableEntity, http.StatusNotImplemented:
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%w: %v rejected the request: %v", ErrUnsupportedOperation, da.ID, string(message))
+	default:
+		return fmt.Errorf("error posting to %v: unexpected status %v", u.String(), resp.Status)
 	}
+}
 
+// Connect announces the start of a load to the accessor service when its write mode needs to know when the load begins and
+// ends, as replace and truncate-insert do; every other call uses its own connection
+func (da *DataAccessor) Connect(connectionMode ConnectionMode) error {
+	if connectionMode != ConenctionModeWrite || (da.Mode != common.WriteModeReplace && da.Mode != common.WriteModeTruncateInsert) {
+		return nil
+	}
+	if err := da.post("/begin", da.settings()); err != nil {
+		return fmt.Errorf("error beginning %v load: %v", da.Mode, err)
+	}
+	da.started = true
 	return nil
 }
+
+// Close announces the end of a load started by Connect, so the accessor service can commit it
+func (da *DataAccessor) Close() error {
+	if !da.started {
+		return nil
+	}
+	da.started = false
+	if err := da.post("/commit", da.settings()); err != nil {
+		return fmt.Errorf("error committing %v load: %v", da.Mode, err)
+	}
+	return nil
+}
+
+// Discard announces the abort of a load started by Connect, so the accessor service rolls it back instead of committing it
+func (da *DataAccessor) Discard() error {
+	if !da.started {
+		return nil
+	}
+	da.started = false
+	if err := da.post("/rollback", da.settings()); err != nil {
+		return fmt.Errorf("error rolling back %v load: %v", da.Mode, err)
+	}
+	return nil
+}
+
+// Save sends a record to the accessor service along with the keys and write mode of the destination; services that cannot
+// apply the operation of the record are expected to answer with 422 or 501 status codes
+func (da *DataAccessor) Save(r common.Record) error {
+	if err := checkOperation(da.ID, da.Keys, r); err != nil {
+		return err
+	}
+	if err := da.post("/save", SaveRequest{LoadSettings: da.settings(), Record: r}); err != nil {
+		return fmt.Errorf(r.Log("error saving %v record: %v", r.Operation, err))
+	}
+	return nil
+}
+
 func (da *DataAccessor) Fetch(r Request) (*common.Record, error) {
-	u := url.URL{Scheme: "http", Host: *da.Url, Path: "/fetch"}
+	u := url.URL{Scheme: "http", Host: da.Url, Path: "/fetch"}
 
 	jsonBody, err := json.Marshal(r)
 	if err != nil {
@@ -57,23 +131,35 @@ func (da *DataAccessor) Fetch(r Request) (*common.Record, error) {
 	log.Infof("fetching %v from %v", string(jsonBody), u.String())
 
 	cacheKey := fmt.Sprintf("%v->%v", da.ID, r.ToString())
-	stringResult, err := cache.Retrieve(cacheKey, func() (interface{}, error) {
+	stringResult, err := cache.Retrieve(da.cache, da.CachePolicy, cacheKey, func() (interface{}, error) {
 		resp, err := http.Post(u.String(), "application/json", bytes.NewBuffer(jsonBody))
 		if err != nil {
 			return nil, fmt.Errorf("error fetching data with request %v: %v", r, err)
 		}
 		defer resp.Body.Close()
 
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, cache.ErrMiss
+		}
 		if resp.StatusCode != 200 {
-			return nil, fmt.Errorf("error fetching data with request %v: %v", r, err)
+			return nil, fmt.Errorf("error fetching data with request %v: unexpected status %v", r, resp.Status)
 		}
 
 		resultJSON, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			return nil, fmt.Errorf("error reading response body: %v", err)
 		}
+		var found common.Record
+		if err := json.Unmarshal(resultJSON, &found); err == nil && found.Empty {
+			return nil, cache.ErrMiss
+		}
 		return string(resultJSON), nil
 	})
+	if err == cache.ErrMiss {
+		log.Infof("no join value found for join %v", r)
+		result := common.NewRecord(false)
+		return &result, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error finding join value: %v", err)
 	}
@@ -87,45 +173,61 @@ func (da *DataAccessor) Fetch(r Request) (*common.Record, error) {
 	return &result, nil
 }
 
+// Stream sends the request to the accessor service as the first message of a websocket, and every record it streams back
+// to the buffer; the stream ends cleanly only when the service closes the websocket normally, and any other error reading it is returned, as some records may have been skipped
 func (da *DataAccessor) Stream(buffer chan<- common.Record, r Request) error {
-	u := url.URL{Scheme: "ws", Host: *da.Url, Path: "/stream"}
+	return da.StreamContext(context.Background(), buffer, r)
+}
+
+// StreamContext streams like Stream until ctx is done, closing the websocket so the service stops sending records; it
+// returns the error of ctx in that case
+func (da *DataAccessor) StreamContext(ctx context.Context, buffer chan<- common.Record, r Request) error {
+	u := url.URL{Scheme: "ws", Host: da.Url, Path: "/stream"}
 	jsonBody, err := json.Marshal(r)
 	if err != nil {
 		return fmt.Errorf("error serializing request %v: %v", r, err)
 	}
 	log.Infof("streaming %v from %v", string(jsonBody), u.String())
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-
+	c, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
 	if err != nil {
-		log.Fatal("dial:", err)
+		return fmt.Errorf("error dialing %v: %v", u.String(), err)
 	}
 	defer c.Close()
-	done := make(chan struct{})
+	if err := c.WriteMessage(websocket.TextMessage, jsonBody); err != nil {
+		return fmt.Errorf("error sending request %v: %v", string(jsonBody), err)
+	}
 
+	finished := make(chan struct{})
+	defer close(finished)
 	go func() {
-		defer close(done)
-		for {
-			var record common.Record
-			err := c.ReadJSON(&record)
-			if err != nil {
-				if _, k := err.(*websocket.CloseError); k {
-					log.Infof("stream finished; returning control")
-					return
-				}
-
-				log.Errorf("error reading message from websocket: %v", err)
-				return
-			}
-			log.Infof("buffering record %v", record)
-			buffer <- record
-
+		select {
+		case <-ctx.Done():
+			// unblocks the pending read
+			c.Close()
+		case <-finished:
 		}
 	}()
+
 	for {
-		select {
-		case <-done:
+		var record common.Record
+		err := c.ReadJSON(&record)
+		if ctx.Err() != nil {
+			log.Infof("stream of %v stopped: %v", da.ID, ctx.Err())
+			return ctx.Err()
+		}
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			log.Infof("stream finished; returning control")
 			return nil
 		}
+		if err != nil {
+			return fmt.Errorf("error reading message from websocket: %v", err)
+		}
+		log.Infof("buffering record %v", record)
+		select {
+		case buffer <- record:
+		case <-ctx.Done():
+			log.Infof("stream of %v stopped: %v", da.ID, ctx.Err())
+			return ctx.Err()
+		}
 	}
-	return nil
 }
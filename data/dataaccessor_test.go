@@ -0,0 +1,125 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/ezeriver94/gotransform/common"
+)
+
+// streamServer serves a websocket stream of records, ending it with the given close code, or dropping the connection
+// when it is zero; it records the requests it receives
+func streamServer(t *testing.T, records int, closeCode int, requests chan<- Request) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("error upgrading connection: %v", err)
+			return
+		}
+		defer c.Close()
+		var request Request
+		if err := c.ReadJSON(&request); err != nil {
+			t.Errorf("error reading request: %v", err)
+			return
+		}
+		requests <- request
+		for i := 0; i < records; i++ {
+			record := common.NewRecord(false)
+			record.Set("id", i)
+			if err := c.WriteJSON(record); err != nil {
+				t.Errorf("error writing record: %v", err)
+				return
+			}
+		}
+		if closeCode != 0 {
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, ""))
+			c.ReadMessage()
+		}
+	}))
+}
+
+func TestDataAccessorStream(t *testing.T) {
+	tests := []struct {
+		name      string
+		closeCode int
+		wantErr   bool
+	}{
+		{"normal closure", websocket.CloseNormalClosure, false},
+		{"error closure", websocket.CloseInternalServerErr, true},
+		{"dropped connection", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := make(chan Request, 1)
+			server := streamServer(t, 3, test.closeCode, requests)
+			defer server.Close()
+			accessor := NewDataAccessor(strings.TrimPrefix(server.URL, "http://"), "stream "+test.name, nil)
+
+			buffer := make(chan common.Record, 3)
+			request := NewRequest(nil)
+			request.Watermark = &Watermark{Field: "id", Value: float64(10)}
+			err := accessor.Stream(buffer, request)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Stream() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if len(buffer) != 3 {
+				t.Errorf("Stream() buffered %v records, want 3", len(buffer))
+			}
+			received := <-requests
+			sent, _ := json.Marshal(request)
+			got, _ := json.Marshal(received)
+			if string(got) != string(sent) {
+				t.Errorf("service received request %s, want %s", got, sent)
+			}
+		})
+	}
+}
+
+func TestDataAccessorStreamDialError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	accessor := NewDataAccessor(strings.TrimPrefix(server.URL, "http://"), "stream dial error", nil)
+	if err := accessor.Stream(make(chan common.Record), NewRequest(nil)); err == nil {
+		t.Fatal("Stream() to a closed server returned no error")
+	}
+}
+
+func TestDataAccessorStreamContext(t *testing.T) {
+	requests := make(chan Request, 1)
+	server := streamServer(t, 3, websocket.CloseNormalClosure, requests)
+	defer server.Close()
+	accessor := NewDataAccessor(strings.TrimPrefix(server.URL, "http://"), "stream context", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	buffer := make(chan common.Record)
+	go func() {
+		<-buffer
+		cancel()
+	}()
+	if err := accessor.StreamContext(ctx, buffer, NewRequest(nil)); err != context.Canceled {
+		t.Fatalf("StreamContext() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestNewDataAccessorAddresses(t *testing.T) {
+	tests := []struct {
+		id  string
+		url string
+	}{
+		{"customers", "extract:8080"},
+		{"customers", "load:8080"},
+		{"orders", "orders:8080"},
+	}
+	for _, test := range tests {
+		if accessor := NewDataAccessor(test.url, test.id, nil); accessor.Url != test.url {
+			t.Errorf("accessor %v for %v has address %v", test.id, test.url, accessor.Url)
+		}
+	}
+}
@@ -1,15 +1,27 @@
 package data
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/ezeriver94/gotransform/common"
 )
 
 // Request contains the information needed for the dataprovider to fetch data
 type Request struct {
-	ObjectID string                 `json:"objectID"`
-	Filters  map[string]interface{} `json:"filters"`
+	ObjectID  string                 `json:"objectID"`
+	Filters   map[string]interface{} `json:"filters"`
+	Watermark *Watermark             `json:"watermark,omitempty"`
+}
+
+// Watermark restricts a request to the records whose field value is greater than the given one
+type Watermark struct {
+	Field string      `json:"field"`
+	Value interface{} `json:"value"`
 }
 
 // ConnectionMode indicates the type of connection
@@ -24,15 +36,95 @@ const (
 type DataProvider interface {
 	Connect(connectionMode ConnectionMode) error
 
-	NewRequest(filters map[common.Field]interface{}) Request
 	Fetch(r Request) (*common.Record, error)
 
-	Stream(r Request, buffer chan<- *common.Record) error
-	Save(buffer <-chan common.Record) error
+	Stream(buffer chan<- common.Record, r Request) error
+	Save(r common.Record) error
 
 	Close() error
 }
 
+// DiscardableProvider is a DataProvider able to drop the output written since Connect instead of closing it, which keeps
+// an aborted load from being committed
+type DiscardableProvider interface {
+	DataProvider
+
+	Discard() error
+}
+
+// StagedProvider is a DataProvider able to write into a staging area that takes the place of its output only when the load
+// succeeds. Close finishes writing the staging area, which is kept until either Publish or Discard is called
+type StagedProvider interface {
+	DiscardableProvider
+
+	Publish() error
+}
+
+// DriverFactory builds the DataProvider of a built-in driver for a named data destination
+type DriverFactory func(name string, destination common.DataDestination) (DataProvider, error)
+
+var drivers = map[string]DriverFactory{
+	"file": NewFileProvider,
+}
+
+// RegisterDriver makes a built-in driver available by name
+func RegisterDriver(name string, factory DriverFactory) {
+	drivers[name] = factory
+}
+
+// NewDataDestination creates the provider used to save records into a load target during the run identified by runID; targets
+// with an accessorURL are saved through their accessor service, otherwise a built-in driver is used. Any driver registered on
+// database/sql is handled by the sql provider
+func NewDataDestination(name string, destination common.DataDestination, runID string) (DataProvider, error) {
+	if destination.AccessorURL != "" {
+		accessor := NewDataAccessor(destination.AccessorURL, name, nil)
+		accessor.Keys = destination.Keys
+		accessor.Mode = destination.WriteMode()
+		return &accessor, nil
+	}
+	if factory, ok := drivers[destination.Driver]; ok {
+		return factory(name, destination)
+	}
+	for _, driver := range sql.Drivers() {
+		if driver == destination.Driver {
+			return NewSQLProvider(name, destination, runID)
+		}
+	}
+	known := make([]string, 0, len(drivers))
+	for driver := range drivers {
+		known = append(known, driver)
+	}
+	known = append(known, sql.Drivers()...)
+	sort.Strings(known)
+	return nil, fmt.Errorf("unknown driver %v for destination %v; available drivers are %v", destination.Driver, name, strings.Join(known, ", "))
+}
+
+// ErrUnsupportedOperation indicates that a provider cannot apply the operation of a record
+var ErrUnsupportedOperation = errors.New("unsupported record operation")
+
+// checkOperation rejects the operations that need key fields to identify the record on destinations without keys
+func checkOperation(name string, keys []string, r common.Record) error {
+	if r.Operation == "" || r.Operation == common.OperationInsert {
+		return nil
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%w: destination %v declares no keys to apply %v operation", ErrUnsupportedOperation, name, r.Operation)
+	}
+	return nil
+}
+
+// LoadSettings describes how an accessor service must write the records of a destination
+type LoadSettings struct {
+	Keys []string         `json:"keys"`
+	Mode common.WriteMode `json:"mode"`
+}
+
+// SaveRequest contains the information sent to an accessor service to save a record
+type SaveRequest struct {
+	LoadSettings
+	Record common.Record `json:"record"`
+}
+
 // NewRequest creates a new request for the plaintext dataprovider
 func NewRequest(filters map[string]interface{}) Request {
 	return Request{
@@ -40,20 +132,52 @@ func NewRequest(filters map[string]interface{}) Request {
 	}
 }
 
-// ToString converts a request to a string value
+// ToString converts a request to a canonical string value; filters are sorted by name and their values json encoded, so
+// equal requests always build the same string
 func (r *Request) ToString() string {
+	names := make([]string, 0, len(r.Filters))
+	for field := range r.Filters {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
 	var filters string
-	for field, value := range r.Filters {
-		filters += field + ":" + common.FieldToString(value) + "#"
+	for _, field := range names {
+		filters += field + ":" + canonicalValue(r.Filters[field]) + "#"
+	}
+	if r.Watermark != nil {
+		filters += r.Watermark.Field + ">" + canonicalValue(r.Watermark.Value) + "#"
 	}
 	return fmt.Sprintf("%v->%v", r.ObjectID, filters)
 }
 
+// canonicalValue encodes a value as json, so that numbers are written the same way no matter their type
+func canonicalValue(value interface{}) string {
+	result, err := json.Marshal(value)
+	if err != nil {
+		return common.FieldToString(value)
+	}
+	return string(result)
+}
+
 // HashCode returns a hashcode for a request
 func (r Request) HashCode() string {
-	var result string
+	return r.ToString()
+}
+
+// Matches indicates whether a record satisfies the filters and the watermark of a request
+func (r *Request) Matches(record *common.Record) bool {
 	for field, value := range r.Filters {
-		result += field + "=" + fmt.Sprint(value) + "#"
+		found, err := record.Get(field)
+		if err != nil || common.CompareValues(found, value) != 0 {
+			return false
+		}
+	}
+	if r.Watermark != nil {
+		found, err := record.Get(r.Watermark.Field)
+		if err != nil || common.CompareValues(found, r.Watermark.Value) <= 0 {
+			return false
+		}
 	}
-	return result
+	return true
 }
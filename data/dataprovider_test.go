@@ -0,0 +1,57 @@
+package data
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRequestToString(t *testing.T) {
+	tests := []struct {
+		name string
+		a    Request
+		b    Request
+		same bool
+	}{
+		{
+			name: "filters in any order",
+			a:    Request{ObjectID: "users", Filters: map[string]interface{}{"id": 1, "country": "ar"}},
+			b:    Request{ObjectID: "users", Filters: map[string]interface{}{"country": "ar", "id": 1}},
+			same: true,
+		},
+		{
+			name: "numbers of any type",
+			a:    Request{ObjectID: "users", Filters: map[string]interface{}{"id": 1}},
+			b:    Request{ObjectID: "users", Filters: map[string]interface{}{"id": json.Number("1")}},
+			same: true,
+		},
+		{
+			name: "float and int numbers",
+			a:    Request{ObjectID: "users", Filters: map[string]interface{}{"id": float64(1)}},
+			b:    Request{ObjectID: "users", Filters: map[string]interface{}{"id": int64(1)}},
+			same: true,
+		},
+		{
+			name: "number and string",
+			a:    Request{ObjectID: "users", Filters: map[string]interface{}{"id": 1}},
+			b:    Request{ObjectID: "users", Filters: map[string]interface{}{"id": "1"}},
+		},
+		{
+			name: "different objects",
+			a:    Request{ObjectID: "users", Filters: map[string]interface{}{"id": 1}},
+			b:    Request{ObjectID: "orders", Filters: map[string]interface{}{"id": 1}},
+		},
+		{
+			name: "different watermarks",
+			a:    Request{ObjectID: "users", Watermark: &Watermark{Field: "updated", Value: 1}},
+			b:    Request{ObjectID: "users", Watermark: &Watermark{Field: "updated", Value: 2}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := test.a.ToString(), test.b.ToString()
+			if (a == b) != test.same {
+				t.Errorf("ToString() = %q and %q, want same = %v", a, b, test.same)
+			}
+		})
+	}
+}
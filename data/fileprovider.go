@@ -0,0 +1,383 @@
+package data
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ezeriver94/gotransform/common"
+)
+
+// FileProvider reads and writes plain text files holding one record per line, formatted with the fields of the endpoint
+type FileProvider struct {
+	name        string
+	destination common.DataDestination
+	file        *os.File
+	writer      *bufio.Writer
+	rows        []*common.Record
+	index       map[string]int
+	temporary   bool
+	staging     string
+	sync        sync.Mutex
+}
+
+// NewFileProvider creates a provider for the file whose path is the connectionstring of the destination
+func NewFileProvider(name string, destination common.DataDestination) (DataProvider, error) {
+	if destination.ConnectionString == "" {
+		return nil, fmt.Errorf("file destination %v needs the path of the file as connectionstring", name)
+	}
+	return &FileProvider{
+		name:        name,
+		destination: destination,
+	}, nil
+}
+
+// Connect prepares the file for writing according to the write mode of the destination; append and truncate-insert write
+// directly into the file, replace writes a temporary file that is renamed on Close, and upsert loads the existing records
+// into memory to rewrite the file on Close. Staged destinations always write a temporary file, which starts as a copy of
+// the file on append mode, and rename it on Publish. Reads open the file on every call
+func (fp *FileProvider) Connect(connectionMode ConnectionMode) error {
+	if connectionMode != ConenctionModeWrite {
+		return nil
+	}
+	path := fp.destination.ConnectionString
+	mode := fp.destination.WriteMode()
+	var (
+		file *os.File
+		err  error
+	)
+	switch {
+	case mode == common.WriteModeUpsert:
+		return fp.loadRows()
+	case mode == common.WriteModeReplace || fp.destination.Staged:
+		file, err = fp.temporaryFile(mode == common.WriteModeAppend)
+		fp.temporary = true
+	case mode == common.WriteModeAppend:
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	case mode == common.WriteModeTruncateInsert:
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	default:
+		return fmt.Errorf("file destination %v does not support write mode %v", fp.name, fp.destination.Mode)
+	}
+	if err != nil {
+		return fmt.Errorf("error opening file %v: %v", path, err)
+	}
+	fp.file = file
+	fp.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// temporaryFile creates a file next to the destination one, so it can be renamed atomically, copying the current content if
+// needed; it takes the permissions of the destination, or the ones of new files, so renaming it keeps them
+func (fp *FileProvider) temporaryFile(copyContent bool) (*os.File, error) {
+	path := fp.destination.ConnectionString
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	var perm os.FileMode = 0644
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	if !copyContent {
+		return file, nil
+	}
+	current, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err == nil {
+		_, err = io.Copy(file, current)
+		current.Close()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// loadRows reads every existing record of the file, indexing it by the keys of the destination; records whose keys cannot
+// be read fail the connection, as rewriting the file without them would delete them
+func (fp *FileProvider) loadRows() error {
+	rows := make([]*common.Record, 0)
+	index := make(map[string]int)
+	if _, err := os.Stat(fp.destination.ConnectionString); os.IsNotExist(err) {
+		fp.rows, fp.index = rows, index
+		return nil
+	}
+	var failed error
+	err := fp.scan(NewRequest(nil), func(record common.Record) bool {
+		key, err := fp.key(&record)
+		if err != nil {
+			failed = fmt.Errorf("error indexing line %v of file %v: %v", len(rows)+1, fp.destination.ConnectionString, err)
+			return false
+		}
+		index[key] = len(rows)
+		rows = append(rows, &record)
+		return true
+	})
+	if err == nil {
+		err = failed
+	}
+	if err != nil {
+		return err
+	}
+	fp.rows, fp.index = rows, index
+	return nil
+}
+
+// key builds a string identifying a record by the values of the keys of the destination
+func (fp *FileProvider) key(r *common.Record) (string, error) {
+	values := make([]string, 0, len(fp.destination.Keys))
+	for _, key := range fp.destination.Keys {
+		value, err := r.Get(key)
+		if err != nil {
+			return "", fmt.Errorf(r.Log("error getting value of key %v: %v", key, err))
+		}
+		values = append(values, common.FieldToString(value))
+	}
+	return strings.Join(values, "\x1f"), nil
+}
+
+// Fetch returns the first record of the file that matches the request, or an empty record if there is none
+func (fp *FileProvider) Fetch(r Request) (*common.Record, error) {
+	result := common.NewRecord(false)
+	err := fp.scan(r, func(record common.Record) bool {
+		result = record
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Stream sends every record of the file that matches the request into the buffer
+func (fp *FileProvider) Stream(buffer chan<- common.Record, r Request) error {
+	return fp.scan(r, func(record common.Record) bool {
+		buffer <- record
+		return true
+	})
+}
+
+// scan parses every line of the file and calls found with the ones that match the request, until it returns false
+func (fp *FileProvider) scan(r Request, found func(common.Record) bool) error {
+	file, err := os.Open(fp.destination.ConnectionString)
+	if err != nil {
+		return fmt.Errorf("error opening file %v: %v", fp.destination.ConnectionString, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		record := common.NewRecord(false)
+		if err := record.FromString(fp.destination.Fields, scanner.Text()); err != nil {
+			return fmt.Errorf("error parsing line %v of file %v: %v", line, fp.destination.ConnectionString, err)
+		}
+		if !r.Matches(&record) {
+			continue
+		}
+		if !found(record) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// Save writes a record into the file; only upserts can identify existing records, so any other mode allows just inserts
+func (fp *FileProvider) Save(r common.Record) error {
+	if fp.destination.WriteMode() == common.WriteModeUpsert {
+		return fp.upsert(r)
+	}
+	if r.Operation != "" && r.Operation != common.OperationInsert {
+		return fmt.Errorf("%w: file destination %v in %v mode only appends records, cannot apply %v operation", ErrUnsupportedOperation, fp.name, fp.destination.WriteMode(), r.Operation)
+	}
+	line, err := r.ToString(fp.destination.Fields)
+	if err != nil {
+		return fmt.Errorf(r.Log("error formatting record for file destination %v: %v", fp.name, err))
+	}
+	fp.sync.Lock()
+	defer fp.sync.Unlock()
+	if fp.writer == nil {
+		return fmt.Errorf("file destination %v is not connected for writing", fp.name)
+	}
+	if _, err := fp.writer.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("error writing to file %v: %v", fp.destination.ConnectionString, err)
+	}
+	return nil
+}
+
+// upsert applies a record on the rows loaded in memory, replacing or removing the one with the same keys
+func (fp *FileProvider) upsert(r common.Record) error {
+	if r.Operation != common.OperationDelete {
+		if _, err := r.ToString(fp.destination.Fields); err != nil {
+			return fmt.Errorf(r.Log("error formatting record for file destination %v: %v", fp.name, err))
+		}
+	}
+	key, err := fp.key(&r)
+	if err != nil {
+		return err
+	}
+	fp.sync.Lock()
+	defer fp.sync.Unlock()
+	if fp.index == nil {
+		return fmt.Errorf("file destination %v is not connected for writing", fp.name)
+	}
+	position, exists := fp.index[key]
+	if r.Operation == common.OperationDelete {
+		if exists {
+			fp.rows[position] = nil
+			delete(fp.index, key)
+		}
+		return nil
+	}
+	if exists {
+		fp.rows[position] = &r
+		return nil
+	}
+	fp.index[key] = len(fp.rows)
+	fp.rows = append(fp.rows, &r)
+	return nil
+}
+
+// Close flushes pending writes and closes the file; on replace and upsert modes, the new content takes the place of the file
+// unless the destination is staged, in which case it waits for Publish
+func (fp *FileProvider) Close() error {
+	fp.sync.Lock()
+	defer fp.sync.Unlock()
+	if fp.index != nil {
+		defer func() {
+			fp.rows = nil
+			fp.index = nil
+		}()
+		return fp.rewrite()
+	}
+	if fp.file == nil {
+		return nil
+	}
+	defer func() {
+		fp.file = nil
+		fp.writer = nil
+		fp.temporary = false
+	}()
+	if err := fp.writer.Flush(); err != nil {
+		fp.file.Close()
+		fp.removeTemporary()
+		return fmt.Errorf("error flushing file %v: %v", fp.destination.ConnectionString, err)
+	}
+	if err := fp.file.Close(); err != nil {
+		fp.removeTemporary()
+		return fmt.Errorf("error closing file %v: %v", fp.file.Name(), err)
+	}
+	if fp.temporary {
+		return fp.place(fp.file.Name())
+	}
+	return nil
+}
+
+// removeTemporary deletes the file being written when it is a temporary one
+func (fp *FileProvider) removeTemporary() {
+	if fp.temporary {
+		os.Remove(fp.file.Name())
+	}
+}
+
+// place renames a finished temporary file over the destination one, or keeps it as staging output if the destination is staged
+func (fp *FileProvider) place(temporary string) error {
+	if fp.destination.Staged {
+		fp.staging = temporary
+		return nil
+	}
+	if err := os.Rename(temporary, fp.destination.ConnectionString); err != nil {
+		os.Remove(temporary)
+		return fmt.Errorf("error replacing file %v: %v", fp.destination.ConnectionString, err)
+	}
+	return nil
+}
+
+// Publish renames the staged file over the destination one
+func (fp *FileProvider) Publish() error {
+	fp.sync.Lock()
+	defer fp.sync.Unlock()
+	if fp.staging == "" {
+		return nil
+	}
+	staging := fp.staging
+	fp.staging = ""
+	if err := os.Rename(staging, fp.destination.ConnectionString); err != nil {
+		os.Remove(staging)
+		return fmt.Errorf("error publishing staged file %v to %v: %v", staging, fp.destination.ConnectionString, err)
+	}
+	return nil
+}
+
+// Discard removes every temporary output, leaving the destination file as it was before the load; records written directly
+// into the file on non staged append and truncate-insert modes cannot be discarded
+func (fp *FileProvider) Discard() error {
+	fp.sync.Lock()
+	defer fp.sync.Unlock()
+	fp.rows = nil
+	fp.index = nil
+	if fp.file != nil {
+		fp.file.Close()
+		fp.removeTemporary()
+		fp.file = nil
+		fp.writer = nil
+		fp.temporary = false
+	}
+	if fp.staging != "" {
+		staging := fp.staging
+		fp.staging = ""
+		if err := os.Remove(staging); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing staged file %v: %v", staging, err)
+		}
+	}
+	return nil
+}
+
+// rewrite writes the rows loaded in memory into a temporary file that takes the place of the file
+func (fp *FileProvider) rewrite() error {
+	file, err := fp.temporaryFile(false)
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for %v: %v", fp.destination.ConnectionString, err)
+	}
+	writer := bufio.NewWriter(file)
+	for _, row := range fp.rows {
+		if row == nil {
+			continue
+		}
+		line, err := row.ToString(fp.destination.Fields)
+		if err == nil {
+			_, err = writer.WriteString(line + "\n")
+		}
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return fmt.Errorf("error writing file %v: %v", file.Name(), err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("error flushing file %v: %v", file.Name(), err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("error closing file %v: %v", file.Name(), err)
+	}
+	return fp.place(file.Name())
+}
@@ -0,0 +1,142 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ezeriver94/gotransform/common"
+)
+
+// fileDestination is a file destination of records with an id and a name, written on mode
+func fileDestination(path string, mode common.WriteMode, keys ...string) common.DataDestination {
+	return common.DataDestination{
+		DataEndpoint: common.DataEndpoint{
+			Driver:           "file",
+			ConnectionString: path,
+			Fields: common.Fields{
+				{Name: "id", MaxLength: 10, EndCharacter: ";"},
+				{Name: "name", MaxLength: 10, EndCharacter: ";"},
+			},
+		},
+		Mode: mode,
+		Keys: keys,
+	}
+}
+
+// tempFile writes content into a file of a new temporary directory, returning the path of the file
+func tempFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "file-provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "customers.txt")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileProviderUpsert(t *testing.T) {
+	tests := []struct {
+		name        string
+		keys        []string
+		wantErr     bool
+		wantContent string
+	}{
+		{name: "rows replaced by key", keys: []string{"id"}, wantContent: "1;alice;\n2;robert;\n3;carol;\n"},
+		{name: "rows without keys fail", keys: []string{"code"}, wantErr: true, wantContent: "1;alice;\n2;bob;\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := tempFile(t, "1;alice;\n2;bob;\n")
+			defer os.RemoveAll(filepath.Dir(path))
+			provider, err := NewFileProvider("customers", fileDestination(path, common.WriteModeUpsert, test.keys...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = provider.Connect(ConenctionModeWrite)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Connect() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil {
+				for id, name := range map[int]string{2: "robert", 3: "carol"} {
+					record := common.NewRecord(false)
+					record.Set("id", id)
+					record.Set("name", name)
+					if err := provider.Save(record); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := provider.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != test.wantContent {
+				t.Errorf("content = %q, want %q", content, test.wantContent)
+			}
+		})
+	}
+}
+
+func TestFileProviderKeepsPermissions(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		perm     os.FileMode
+		mode     common.WriteMode
+		staged   bool
+		want     os.FileMode
+	}{
+		{name: "replace", existing: true, perm: 0640, mode: common.WriteModeReplace, want: 0640},
+		{name: "upsert", existing: true, perm: 0664, mode: common.WriteModeUpsert, want: 0664},
+		{name: "staged append", existing: true, perm: 0600, mode: common.WriteModeAppend, staged: true, want: 0600},
+		{name: "new file", mode: common.WriteModeReplace, want: 0644},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := tempFile(t, "1;alice;\n")
+			defer os.RemoveAll(filepath.Dir(path))
+			if test.existing {
+				if err := os.Chmod(path, test.perm); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				os.Remove(path)
+			}
+			destination := fileDestination(path, test.mode, "id")
+			destination.Staged = test.staged
+			provider, err := NewFileProvider("customers", destination)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := provider.Connect(ConenctionModeWrite); err != nil {
+				t.Fatal(err)
+			}
+			record := common.NewRecord(false)
+			record.Set("id", 2)
+			record.Set("name", "bob")
+			if err := provider.Save(record); err != nil {
+				t.Fatal(err)
+			}
+			if err := provider.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := provider.(StagedProvider).Publish(); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Mode().Perm(); got != test.want {
+				t.Errorf("permissions = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
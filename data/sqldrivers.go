@@ -0,0 +1,7 @@
+package data
+
+import (
+	// database/sql drivers handled by the sql provider, named postgres and mysql as the driver of a destination
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
@@ -0,0 +1,438 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/common"
+)
+
+// numberedPlaceholders lists the database/sql drivers that use $1, $2... instead of ? as query placeholders
+var numberedPlaceholders = map[string]bool{
+	"postgres":         true,
+	"pgx":              true,
+	"cloudsqlpostgres": true,
+}
+
+// operationColumn is the column of staging tables holding the operation of every staged record
+const operationColumn = "gotransform_op"
+
+// execer is implemented by both sql.DB and sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// SQLProvider reads and writes the table named by the objectid of an endpoint, through any driver registered on database/sql
+type SQLProvider struct {
+	name        string
+	destination common.DataDestination
+	db          *sql.DB
+	tx          *sql.Tx
+	staging     string
+	runID       string
+}
+
+// NewSQLProvider creates a provider for a table; the driver of the destination is the name of the database/sql driver and
+// the connectionstring its data source name. The staging table of staged loads is named after the run, identified by runID
+func NewSQLProvider(name string, destination common.DataDestination, runID string) (DataProvider, error) {
+	if destination.ObjectIdentifier == "" {
+		return nil, fmt.Errorf("sql destination %v needs the name of the table as objectid", name)
+	}
+	return &SQLProvider{
+		name:        name,
+		destination: destination,
+		runID:       runID,
+	}, nil
+}
+
+// Connect opens the database and checks that it is reachable; when writing, staged destinations create their staging
+// table, truncate-insert empties the table right away and replace empties it within a transaction that holds every save
+// until Close commits it
+func (sp *SQLProvider) Connect(connectionMode ConnectionMode) error {
+	db, err := sql.Open(sp.destination.Driver, sp.destination.ConnectionString)
+	if err != nil {
+		return fmt.Errorf("error opening database of %v: %v", sp.name, err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return fmt.Errorf("error connecting to database of %v: %v", sp.name, err)
+	}
+	sp.db = db
+	if connectionMode != ConenctionModeWrite {
+		return nil
+	}
+	if sp.destination.Staged {
+		return sp.createStaging()
+	}
+
+	switch sp.destination.WriteMode() {
+	case common.WriteModeTruncateInsert:
+		if err := sp.truncate(db); err != nil {
+			return err
+		}
+	case common.WriteModeReplace:
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("error starting transaction on %v: %v", sp.name, err)
+		}
+		if err := sp.truncate(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		sp.tx = tx
+	}
+	return nil
+}
+
+func (sp *SQLProvider) truncate(db execer) error {
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %v", sp.destination.ObjectIdentifier)); err != nil {
+		return fmt.Errorf("error emptying %v: %v", sp.name, err)
+	}
+	return nil
+}
+
+func (sp *SQLProvider) placeholder(position int) string {
+	if numberedPlaceholders[sp.destination.Driver] {
+		return fmt.Sprintf("$%d", position)
+	}
+	return "?"
+}
+
+func (sp *SQLProvider) columns() []string {
+	result := make([]string, 0, len(sp.destination.Fields))
+	for _, field := range sp.destination.Fields {
+		result = append(result, field.Name)
+	}
+	return result
+}
+
+// where builds a where clause matching every filter and the watermark of a request
+func (sp *SQLProvider) where(r Request) (string, []interface{}) {
+	names := make([]string, 0, len(r.Filters))
+	for name := range r.Filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conditions := make([]string, 0, len(names)+1)
+	args := make([]interface{}, 0, len(names)+1)
+	for _, name := range names {
+		args = append(args, r.Filters[name])
+		conditions = append(conditions, fmt.Sprintf("%v = %v", name, sp.placeholder(len(args))))
+	}
+	if r.Watermark != nil {
+		args = append(args, r.Watermark.Value)
+		conditions = append(conditions, fmt.Sprintf("%v > %v", r.Watermark.Field, sp.placeholder(len(args))))
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// query runs a select over the table and calls found with every record, until it returns false
+func (sp *SQLProvider) query(r Request, suffix string, found func(common.Record) bool) error {
+	columns := sp.columns()
+	where, args := sp.where(r)
+	query := fmt.Sprintf("SELECT %v FROM %v%v%v", strings.Join(columns, ", "), sp.destination.ObjectIdentifier, where, suffix)
+	log.Debugf("querying %v with %v", query, args)
+	rows, err := sp.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("error querying %v: %v", sp.name, err)
+	}
+	defer rows.Close()
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return fmt.Errorf("error reading row of %v: %v", sp.name, err)
+		}
+		record := common.NewRecord(false)
+		for i, column := range columns {
+			value := values[i]
+			if bytes, ok := value.([]byte); ok {
+				value = string(bytes)
+			}
+			record.Set(column, value)
+		}
+		if !found(record) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+// Fetch returns the first row of the table that matches the request, or an empty record if there is none
+func (sp *SQLProvider) Fetch(r Request) (*common.Record, error) {
+	result := common.NewRecord(false)
+	err := sp.query(r, " LIMIT 1", func(record common.Record) bool {
+		result = record
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Stream sends every row of the table that matches the request into the buffer
+func (sp *SQLProvider) Stream(buffer chan<- common.Record, r Request) error {
+	return sp.query(r, "", func(record common.Record) bool {
+		buffer <- record
+		return true
+	})
+}
+
+// Save applies the operation of a record on the table; updates, and inserts on upsert mode, delete the row identified by
+// the destination keys before inserting it again within a single transaction. Staged destinations save into the staging table
+func (sp *SQLProvider) Save(r common.Record) error {
+	if err := checkOperation(sp.name, sp.destination.Keys, r); err != nil {
+		return err
+	}
+	upsert := r.Operation == common.OperationUpdate || sp.destination.WriteMode() == common.WriteModeUpsert
+	if sp.staging != "" {
+		return sp.stage(r, upsert)
+	}
+	if sp.tx != nil {
+		return sp.apply(sp.tx, r, upsert)
+	}
+	if r.Operation == common.OperationDelete || !upsert {
+		return sp.apply(sp.db, r, false)
+	}
+
+	tx, err := sp.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction on %v: %v", sp.name, err)
+	}
+	if err := sp.apply(tx, r, true); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction on %v: %v", sp.name, err)
+	}
+	return nil
+}
+
+func (sp *SQLProvider) apply(db execer, r common.Record, upsert bool) error {
+	if r.Operation == common.OperationDelete {
+		return sp.delete(db, sp.destination.ObjectIdentifier, r)
+	}
+	if upsert {
+		if err := sp.delete(db, sp.destination.ObjectIdentifier, r); err != nil {
+			return err
+		}
+	}
+	return sp.insert(db, sp.destination.ObjectIdentifier, r, "")
+}
+
+// stage saves a record into the staging table along with its operation; records identified by keys replace the staged
+// record with the same keys, so the staging table holds only the last operation of each one
+func (sp *SQLProvider) stage(r common.Record, upsert bool) error {
+	operation := common.OperationInsert
+	if r.Operation == common.OperationDelete {
+		operation = common.OperationDelete
+	} else if upsert {
+		operation = common.OperationUpdate
+	}
+	if operation == common.OperationInsert {
+		return sp.insert(sp.db, sp.staging, r, operation)
+	}
+
+	tx, err := sp.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction on %v: %v", sp.staging, err)
+	}
+	if err := sp.delete(tx, sp.staging, r); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := sp.insert(tx, sp.staging, r, operation); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction on %v: %v", sp.staging, err)
+	}
+	return nil
+}
+
+// insert adds a record into a table, along with its operation when it is a staging table
+func (sp *SQLProvider) insert(db execer, table string, r common.Record, operation common.Operation) error {
+	columns := sp.columns()
+	placeholders := make([]string, 0, len(columns)+1)
+	args := make([]interface{}, 0, len(columns)+1)
+	for _, column := range columns {
+		value, err := r.Get(column)
+		if err != nil && err != common.ErrMissingItemOnRecord {
+			return fmt.Errorf(r.Log("error getting value of column %v: %v", column, err))
+		}
+		args = append(args, value)
+		placeholders = append(placeholders, sp.placeholder(len(args)))
+	}
+	if operation != "" {
+		columns = append(columns, operationColumn)
+		args = append(args, string(operation))
+		placeholders = append(placeholders, sp.placeholder(len(args)))
+	}
+	statement := fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v)", table, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	if _, err := db.Exec(statement, args...); err != nil {
+		return fmt.Errorf(r.Log("error inserting into %v: %v", table, err))
+	}
+	return nil
+}
+
+// delete removes from a table the rows with the same keys as a record
+func (sp *SQLProvider) delete(db execer, table string, r common.Record) error {
+	filters := make(map[string]interface{}, len(sp.destination.Keys))
+	for _, key := range sp.destination.Keys {
+		value, err := r.Get(key)
+		if err != nil {
+			return fmt.Errorf(r.Log("error getting value of key %v: %v", key, err))
+		}
+		filters[key] = value
+	}
+	where, args := sp.where(NewRequest(filters))
+	statement := fmt.Sprintf("DELETE FROM %v%v", table, where)
+	if _, err := db.Exec(statement, args...); err != nil {
+		return fmt.Errorf(r.Log("error deleting from %v: %v", table, err))
+	}
+	return nil
+}
+
+// stagingTable names the staging table of a run after a hash of its id, so concurrent runs never share it and the name
+// stays within the identifier length of every database
+func (sp *SQLProvider) stagingTable() string {
+	hash := fnv.New64a()
+	hash.Write([]byte(sp.runID))
+	return fmt.Sprintf("%v_staging_%x", sp.destination.ObjectIdentifier, hash.Sum64())
+}
+
+// createStaging creates an empty copy of the table, plus a column for the operation of each record
+func (sp *SQLProvider) createStaging() error {
+	staging := sp.stagingTable()
+	statements := []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %v", staging),
+		fmt.Sprintf("CREATE TABLE %v AS SELECT * FROM %v WHERE 1 = 0", staging, sp.destination.ObjectIdentifier),
+		fmt.Sprintf("ALTER TABLE %v ADD %v VARCHAR(10)", staging, operationColumn),
+	}
+	for _, statement := range statements {
+		if _, err := sp.db.Exec(statement); err != nil {
+			return fmt.Errorf("error creating staging table %v: %v", staging, err)
+		}
+	}
+	sp.staging = staging
+	return nil
+}
+
+// dropStaging removes the staging table
+func (sp *SQLProvider) dropStaging() error {
+	staging := sp.staging
+	sp.staging = ""
+	if _, err := sp.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %v", staging)); err != nil {
+		return fmt.Errorf("error dropping staging table %v: %v", staging, err)
+	}
+	return nil
+}
+
+// Close commits the transaction of a replace load and closes the database; staged destinations keep the database open
+// until Publish or Discard
+func (sp *SQLProvider) Close() error {
+	if sp.db == nil || sp.staging != "" {
+		return nil
+	}
+	defer func() {
+		sp.db.Close()
+		sp.db = nil
+	}()
+	if sp.tx != nil {
+		tx := sp.tx
+		sp.tx = nil
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing replace of %v: %v", sp.name, err)
+		}
+	}
+	return nil
+}
+
+// Publish applies the staging table on the table within a single transaction: the table is emptied on replace and
+// truncate-insert modes, rows with the keys of staged updates and deletes are removed, and every staged row that is not
+// a delete is inserted
+func (sp *SQLProvider) Publish() error {
+	if sp.db == nil || sp.staging == "" {
+		return nil
+	}
+	defer func() {
+		sp.db.Close()
+		sp.db = nil
+	}()
+	table, staging := sp.destination.ObjectIdentifier, sp.staging
+	statements := make([]string, 0, 3)
+	mode := sp.destination.WriteMode()
+	if mode == common.WriteModeReplace || mode == common.WriteModeTruncateInsert {
+		statements = append(statements, fmt.Sprintf("DELETE FROM %v", table))
+	} else if len(sp.destination.Keys) > 0 {
+		conditions := make([]string, 0, len(sp.destination.Keys))
+		for _, key := range sp.destination.Keys {
+			conditions = append(conditions, fmt.Sprintf("s.%v = %v.%v", key, table, key))
+		}
+		statements = append(statements, fmt.Sprintf(
+			"DELETE FROM %v WHERE EXISTS (SELECT 1 FROM %v s WHERE %v AND s.%v <> '%v')",
+			table, staging, strings.Join(conditions, " AND "), operationColumn, common.OperationInsert,
+		))
+	}
+	columns := strings.Join(sp.columns(), ", ")
+	statements = append(statements, fmt.Sprintf(
+		"INSERT INTO %v (%v) SELECT %v FROM %v WHERE %v <> '%v'",
+		table, columns, columns, staging, operationColumn, common.OperationDelete,
+	))
+
+	tx, err := sp.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction on %v: %v", sp.name, err)
+	}
+	for _, statement := range statements {
+		log.Debugf("publishing %v with %v", staging, statement)
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			sp.dropStaging()
+			return fmt.Errorf("error publishing staging table %v: %v", staging, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		sp.dropStaging()
+		return fmt.Errorf("error committing staging table %v: %v", staging, err)
+	}
+	return sp.dropStaging()
+}
+
+// Discard rolls back the transaction of a replace load and drops the staging table, leaving the table as it was
+func (sp *SQLProvider) Discard() error {
+	if sp.db == nil {
+		return nil
+	}
+	defer func() {
+		sp.db.Close()
+		sp.db = nil
+	}()
+	if sp.tx != nil {
+		tx := sp.tx
+		sp.tx = nil
+		if err := tx.Rollback(); err != nil {
+			return fmt.Errorf("error rolling back replace of %v: %v", sp.name, err)
+		}
+	}
+	if sp.staging != "" {
+		return sp.dropStaging()
+	}
+	return nil
+}
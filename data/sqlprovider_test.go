@@ -0,0 +1,86 @@
+package data
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ezeriver94/gotransform/common"
+)
+
+func TestNewDataDestinationDrivers(t *testing.T) {
+	tests := []struct {
+		driver  string
+		wantSQL bool
+		wantErr string
+	}{
+		{driver: "postgres", wantSQL: true},
+		{driver: "mysql", wantSQL: true},
+		{driver: "oracle", wantErr: "unknown driver oracle for destination customers; available drivers are file, mysql, postgres"},
+	}
+	for _, test := range tests {
+		t.Run(test.driver, func(t *testing.T) {
+			destination := common.DataDestination{DataEndpoint: common.DataEndpoint{Driver: test.driver, ObjectIdentifier: "customers"}}
+			provider, err := NewDataDestination("customers", destination, "run")
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("NewDataDestination() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewDataDestination() error = %v", err)
+			}
+			if _, ok := provider.(*SQLProvider); ok != test.wantSQL {
+				t.Errorf("NewDataDestination() = %T, want sql provider %v", provider, test.wantSQL)
+			}
+		})
+	}
+}
+
+func TestSQLProviderStagingTable(t *testing.T) {
+	destination := common.DataDestination{DataEndpoint: common.DataEndpoint{Driver: "postgres", ObjectIdentifier: "customers"}}
+	names := map[string]string{}
+	for _, runID := range []string{"", "nightly", "0b7c4f4e-8d4a-4f43-9c2b-6e2f2c0d7a1e", "0b7c4f4e-8d4a-4f43-9c2b-6e2f2c0d7a1f"} {
+		provider, err := NewSQLProvider("customers", destination, runID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := provider.(*SQLProvider).stagingTable()
+		if !strings.HasPrefix(name, "customers_staging_") || len(name) > len("customers_staging_")+16 {
+			t.Errorf("staging table of run %q is %v", runID, name)
+		}
+		if previous, ok := names[name]; ok {
+			t.Errorf("runs %q and %q share staging table %v", previous, runID, name)
+		}
+		names[name] = runID
+		again, _ := NewSQLProvider("customers", destination, runID)
+		if again.(*SQLProvider).stagingTable() != name {
+			t.Errorf("staging table of run %q is not stable", runID)
+		}
+	}
+}
+
+func TestCheckOperation(t *testing.T) {
+	tests := []struct {
+		name      string
+		keys      []string
+		operation common.Operation
+		wantErr   bool
+	}{
+		{"insert without keys", nil, common.OperationInsert, false},
+		{"empty operation without keys", nil, "", false},
+		{"update without keys", nil, common.OperationUpdate, true},
+		{"delete without keys", nil, common.OperationDelete, true},
+		{"update with keys", []string{"id"}, common.OperationUpdate, false},
+		{"delete with keys", []string{"id"}, common.OperationDelete, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := common.NewRecord(false)
+			record.Operation = test.operation
+			if err := checkOperation("customers", test.keys, record); (err != nil) != test.wantErr {
+				t.Errorf("checkOperation() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -1,77 +1,227 @@
 package env
 
 import (
-	"log"
+	"encoding"
+	"fmt"
 	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
+
+	"github.com/ezeriver94/gotransform/secrets"
+)
+
+var (
+	// dotenv holds the variables of the .env file, or of the file at DOTENV_PATH; the environment overrides them
+	dotenv map[string]string
+
+	// dotenvErr is the error reading the .env file, reported by every Load instead of exiting on init
+	dotenvErr error
+
+	// overrides hold the values given on the command line, which override the environment
+	overrides     = map[string]string{}
+	overridesSync sync.Mutex
 )
 
 func init() {
-	var dotenvFile string = os.Getenv("DOTENV_PATH")
-	err := godotenv.Load(dotenvFile)
+	path := os.Getenv("DOTENV_PATH")
+	explicit := path != ""
+	if !explicit {
+		path = ".env"
+	}
+	values, err := godotenv.Read(path)
+	if err != nil {
+		if explicit || !os.IsNotExist(err) {
+			dotenvErr = fmt.Errorf("error loading env file %v: %v", path, err)
+		}
+		return
+	}
+	dotenv = values
+}
+
+// Override sets values that take precedence over the environment and the .env file, as the ones given by cli flags
+func Override(values map[string]string) {
+	overridesSync.Lock()
+	defer overridesSync.Unlock()
+	for key, value := range values {
+		overrides[key] = value
+	}
+}
 
+// Lookup returns the value of a variable, looking it up in the overrides, the environment and the .env file, in that order.
+// Variables that are not set are read from the file named by the variable with the _FILE suffix, when set, as container
+// secrets are; values read from files are registered as secrets
+func Lookup(key string) (string, bool, error) {
+	if value, ok := lookup(key); ok {
+		return value, true, nil
+	}
+	path, ok := lookup(key + "_FILE")
+	if !ok || path == "" {
+		return "", false, nil
+	}
+	value, err := secrets.ReadFile(path)
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		return "", false, fmt.Errorf("error reading %v_FILE envVar: %v", key, err)
+	}
+	secrets.Register(value)
+	return value, true, nil
+}
+
+func lookup(key string) (string, bool) {
+	overridesSync.Lock()
+	value, ok := overrides[key]
+	overridesSync.Unlock()
+	if ok {
+		return value, true
+	}
+	if value, ok := os.LookupEnv(key); ok {
+		return value, true
 	}
+	value, ok = dotenv[key]
+	return value, ok
 }
+
+// GetString returns the value of a variable, or an empty string when it is not set or cannot be read
 func GetString(key string) string {
-	return os.Getenv(key)
+	value, _, _ := Lookup(key)
+	return value
 }
-func Get(key string, out interface{}, def interface{}, convertWith func(string) (interface{}, error)) error {
-	sResult := os.Getenv(key)
 
-	val := reflect.ValueOf(out)
-	if val.Kind() != reflect.Ptr {
-		panic("out must be a pointer")
+// Errors are all the missing or invalid values found by Load
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
 	}
+	return strings.Join(messages, "; ")
+}
 
-	switch out.(type) {
-	case *int:
-		if len(sResult) > 0 {
-			iResult, err := strconv.Atoi(sResult)
-			if err != nil {
-				return err
+// Load fills the fields of the struct pointed by config from the variables named by their env tags, as in
+// `env:"REDIS_CACHE_PORT" default:"6379" required:"true"`. Empty or unset variables take the default of the field, or
+// leave it untouched when it has none; required fields without value are reported, along with the values that cannot be
+// parsed, as Errors. Values of fields tagged `secret:"true"` are registered as secrets, so they are redacted from logs.
+// Nested structs without env tag are loaded too. Supported fields are strings, booleans, numbers, durations, comma
+// separated slices of them and encoding.TextUnmarshaler implementations
+func Load(config interface{}) error {
+	value := reflect.ValueOf(config)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to a struct, received %T", config)
+	}
+	errs := Errors{}
+	if dotenvErr != nil {
+		errs = append(errs, dotenvErr)
+	}
+	errs = load(value.Elem(), errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func load(config reflect.Value, errs Errors) Errors {
+	configType := config.Type()
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			// unexported
+			continue
+		}
+		key, tagged := field.Tag.Lookup("env")
+		if !tagged {
+			if field.Type.Kind() == reflect.Struct {
+				errs = load(config.Field(i), errs)
 			}
-			val.Elem().SetInt(int64(iResult))
-			return nil
+			continue
 		}
-	case *string:
-		if len(sResult) > 0 {
-			val.Elem().SetString(sResult)
-			return nil
+		value, _, err := Lookup(key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
 		}
-	case *bool:
-		switch strings.ToUpper(sResult) {
-		case "TRUE", "1":
-			val.Elem().SetBool(true)
-			return nil
-		case "FALSE", "0":
-			val.Elem().SetBool(false)
-			return nil
+		if value == "" {
+			value = field.Tag.Get("default")
 		}
-	default:
-		if convertWith != nil {
-			value, err := convertWith(sResult)
-			if err != nil {
-				return err
+		if value == "" {
+			if required, _ := strconv.ParseBool(field.Tag.Get("required")); required {
+				errs = append(errs, fmt.Errorf("%v envVar is required", key))
+			}
+			continue
+		}
+		secret, _ := strconv.ParseBool(field.Tag.Get("secret"))
+		if secret {
+			secrets.Register(value)
+		}
+		if err := set(config.Field(i), value); err != nil {
+			if secret {
+				value = secrets.Mask
 			}
-			test := reflect.ValueOf(value)
-			// fmt.Printf("type of val: %v\n", val.Elem().Type().String())
-			// fmt.Printf("type of test: %v\n", test.Type().String())
-			val.Elem().Set(test.Convert(val.Elem().Type()))
-			return nil
+			errs = append(errs, fmt.Errorf("invalid value %q of %v envVar: %v", value, key, err))
+		}
+	}
+	return errs
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses a value into a field according to its type
+func set(field reflect.Value, value string) error {
+	if field.CanAddr() {
+		if unmarshaler, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return unmarshaler.UnmarshalText([]byte(value))
+		}
+	}
+	if field.Type() == durationType {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		result, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(result)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		result, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(result)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		result, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
 		}
-		defVal := reflect.ValueOf(def)
-		if !defVal.IsNil() {
-			if defVal.Elem().Type() != val.Elem().Type() {
-				panic("out and def types dont match")
+		field.SetUint(result)
+	case reflect.Float32, reflect.Float64:
+		result, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(result)
+	case reflect.Slice:
+		parts := strings.Split(value, ",")
+		result := reflect.MakeSlice(field.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			if err := set(result.Index(i), strings.TrimSpace(part)); err != nil {
+				return err
 			}
-			val.Elem().Set(defVal)
 		}
+		field.Set(result)
+	default:
+		return fmt.Errorf("unsupported type %v", field.Type())
 	}
 	return nil
 }
@@ -0,0 +1,177 @@
+package env
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setup replaces the .env file and the overrides with the given values, returning a function restoring them
+func setup(file map[string]string, flags map[string]string) func() {
+	previousDotenv, previousOverrides := dotenv, overrides
+	dotenv = file
+	overrides = map[string]string{}
+	Override(flags)
+	return func() {
+		dotenv, overrides = previousDotenv, previousOverrides
+	}
+}
+
+func TestLookupPrecedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    map[string]string
+		env     string
+		flags   map[string]string
+		want    string
+		wantSet bool
+	}{
+		{name: "unset"},
+		{name: "env file", file: map[string]string{"ENV_TEST_HOST": "file"}, want: "file", wantSet: true},
+		{name: "environment over env file", file: map[string]string{"ENV_TEST_HOST": "file"}, env: "environment", want: "environment", wantSet: true},
+		{name: "flags over environment", env: "environment", flags: map[string]string{"ENV_TEST_HOST": "flag"}, want: "flag", wantSet: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setup(test.file, test.flags)()
+			if test.env != "" {
+				os.Setenv("ENV_TEST_HOST", test.env)
+				defer os.Unsetenv("ENV_TEST_HOST")
+			}
+			got, set, err := Lookup("ENV_TEST_HOST")
+			if err != nil {
+				t.Fatalf("Lookup() error = %v", err)
+			}
+			if got != test.want || set != test.wantSet {
+				t.Errorf("Lookup() = %q, %v, want %q, %v", got, set, test.want, test.wantSet)
+			}
+		})
+	}
+}
+
+func TestLookupFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(path, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		values  map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "value from file", values: map[string]string{"ENV_TEST_PASSWORD_FILE": path}, want: "s3cret"},
+		{name: "value over file", values: map[string]string{"ENV_TEST_PASSWORD": "plain", "ENV_TEST_PASSWORD_FILE": path}, want: "plain"},
+		{name: "missing file", values: map[string]string{"ENV_TEST_PASSWORD_FILE": path + ".missing"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setup(test.values, nil)()
+			got, _, err := Lookup("ENV_TEST_PASSWORD")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Lookup() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("Lookup() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+type testConfig struct {
+	Host     string        `env:"ENV_TEST_HOST" default:"localhost"`
+	Port     int           `env:"ENV_TEST_PORT" required:"true"`
+	Enabled  bool          `env:"ENV_TEST_ENABLED"`
+	Timeout  time.Duration `env:"ENV_TEST_TIMEOUT" default:"5s"`
+	Queues   []string      `env:"ENV_TEST_QUEUES"`
+	Password string        `env:"ENV_TEST_PASSWORD" secret:"true"`
+	Nested   struct {
+		Ratio float64 `env:"ENV_TEST_RATIO"`
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name       string
+		values     map[string]string
+		want       testConfig
+		wantErrors int
+	}{
+		{
+			name:   "defaults",
+			values: map[string]string{"ENV_TEST_PORT": "6379"},
+			want:   testConfig{Host: "localhost", Port: 6379, Timeout: 5 * time.Second},
+		},
+		{
+			name: "every type",
+			values: map[string]string{
+				"ENV_TEST_HOST":     "redis",
+				"ENV_TEST_PORT":     "6380",
+				"ENV_TEST_ENABLED":  "true",
+				"ENV_TEST_TIMEOUT":  "1m",
+				"ENV_TEST_QUEUES":   "extracted, transformed",
+				"ENV_TEST_PASSWORD": "s3cret",
+				"ENV_TEST_RATIO":    "0.5",
+			},
+			want: func() testConfig {
+				result := testConfig{Host: "redis", Port: 6380, Enabled: true, Timeout: time.Minute, Queues: []string{"extracted", "transformed"}, Password: "s3cret"}
+				result.Nested.Ratio = 0.5
+				return result
+			}(),
+		},
+		{
+			name:       "every error at once",
+			values:     map[string]string{"ENV_TEST_ENABLED": "maybe", "ENV_TEST_TIMEOUT": "soon"},
+			want:       testConfig{Host: "localhost"},
+			wantErrors: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setup(test.values, nil)()
+			var got testConfig
+			err := Load(&got)
+			errs, _ := err.(Errors)
+			if len(errs) != test.wantErrors || (err != nil && errs == nil) {
+				t.Fatalf("Load() error = %v, want %v errors", err, test.wantErrors)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Load() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsNonStruct(t *testing.T) {
+	var port int
+	if err := Load(&port); err == nil {
+		t.Error("Load() of a pointer to an int returned no error")
+	}
+	if err := Load(testConfig{}); err == nil {
+		t.Error("Load() of a struct value returned no error")
+	}
+}
+
+func TestLoadReportsEnvFileError(t *testing.T) {
+	defer setup(nil, map[string]string{"ENV_TEST_PORT": "1"})()
+	previous := dotenvErr
+	dotenvErr = os.ErrNotExist
+	defer func() {
+		dotenvErr = previous
+	}()
+	var config testConfig
+	if err := Load(&config); err == nil {
+		t.Error("Load() returned no error when the env file could not be read")
+	}
+	if config.Port != 1 {
+		t.Errorf("Load() did not load the config along with the env file error, Port = %v", config.Port)
+	}
+}
@@ -8,11 +8,13 @@ require (
 	github.com/beevik/guid v0.0.0-20170504223318-d0ea8faecee0
 	github.com/go-redis/cache/v8 v8.0.0-beta.11
 	github.com/go-redis/redis/v8 v8.0.0-beta.6
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/google/wire v0.4.0 // indirect
 	github.com/googleapis/gax-go v1.0.3 // indirect
 	github.com/gorilla/websocket v1.4.2
 	github.com/joho/godotenv v1.3.0
 	github.com/klauspost/compress v1.10.10 // indirect
+	github.com/lib/pq v1.3.0
 	github.com/mmcloughlin/avo v0.0.0-20200523190732-4439b6b2c061 // indirect
 	github.com/sirupsen/logrus v1.6.0
 	github.com/streadway/amqp v1.0.0
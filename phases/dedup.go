@@ -0,0 +1,77 @@
+package phases
+
+import (
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/beevik/guid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/cache"
+)
+
+// DefaultDedupTTL is the time the id of a processed record is remembered
+const DefaultDedupTTL = 24 * time.Hour
+
+// duplicates counts the records skipped by every scope, published as the duplicates expvar
+var duplicates = expvar.NewMap("duplicates")
+
+// Deduplicator remembers the ids of the records processed by the consumers of a job on a cache, whose entries expire
+// and whose memory is bounded, so records delivered again, as after a worker crash, are skipped
+type Deduplicator struct {
+	cache     cache.Cache
+	namespace string
+	ttl       time.Duration
+	skipped   int64
+}
+
+// NewDeduplicator creates a deduplicator remembering ids on c under a namespace, usually the job, during ttl
+func NewDeduplicator(c cache.Cache, namespace string, ttl time.Duration) *Deduplicator {
+	if ttl <= 0 {
+		ttl = DefaultDedupTTL
+	}
+	return &Deduplicator{
+		cache:     c,
+		namespace: namespace,
+		ttl:       ttl,
+	}
+}
+
+func (d *Deduplicator) key(scope string, id *guid.Guid) string {
+	return fmt.Sprintf("dedup:%v:%v:%v", d.namespace, scope, id.String())
+}
+
+// Process runs process unless the record with id was already processed within scope, remembering it once process
+// succeeds. Without deduplicator or id records are always processed, as they are when the cache fails
+func (d *Deduplicator) Process(scope string, id *guid.Guid, process func() error) error {
+	if d == nil || id == nil {
+		return process()
+	}
+	key := d.key(scope, id)
+	_, found, err := d.cache.Get(key)
+	if err != nil {
+		log.Warnf("error checking whether record %v of %v was processed: %v", id.String(), scope, err)
+	} else if found {
+		atomic.AddInt64(&d.skipped, 1)
+		duplicates.Add(scope, 1)
+		log.Infof("skipping record %v of %v, already processed", id.String(), scope)
+		return nil
+	}
+	if err := process(); err != nil {
+		return err
+	}
+	if err := d.cache.Set(key, "1", d.ttl); err != nil {
+		log.Warnf("error remembering record %v of %v: %v", id.String(), scope, err)
+	}
+	return nil
+}
+
+// Skipped returns how many duplicated records were skipped
+func (d *Deduplicator) Skipped() int {
+	if d == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&d.skipped))
+}
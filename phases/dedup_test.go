@@ -0,0 +1,95 @@
+package phases
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/beevik/guid"
+
+	"github.com/ezeriver94/gotransform/cache"
+)
+
+// failingCache is a cache whose every operation fails
+type failingCache struct{}
+
+func (failingCache) Get(key string) (string, bool, error) {
+	return "", false, fmt.Errorf("cache unavailable")
+}
+
+func (failingCache) Set(key string, value string, ttl time.Duration) error {
+	return fmt.Errorf("cache unavailable")
+}
+
+func (failingCache) Delete(key string) error {
+	return fmt.Errorf("cache unavailable")
+}
+
+func TestDeduplicatorProcess(t *testing.T) {
+	id := guid.New()
+	other := guid.New()
+	tests := []struct {
+		name        string
+		dedup       *Deduplicator
+		calls       []*guid.Guid
+		scopes      []string
+		failFirst   bool
+		wantRuns    int
+		wantSkipped int
+	}{
+		{name: "duplicated id", dedup: NewDeduplicator(cache.NewMemoryCache(1<<20), "job", 0), calls: []*guid.Guid{id, id}, wantRuns: 1, wantSkipped: 1},
+		{name: "different ids", dedup: NewDeduplicator(cache.NewMemoryCache(1<<20), "job", 0), calls: []*guid.Guid{id, other}, wantRuns: 2},
+		{name: "different scopes", dedup: NewDeduplicator(cache.NewMemoryCache(1<<20), "job", 0), calls: []*guid.Guid{id, id}, scopes: []string{"load", "transform"}, wantRuns: 2},
+		{name: "failed processing is not remembered", dedup: NewDeduplicator(cache.NewMemoryCache(1<<20), "job", 0), calls: []*guid.Guid{id, id}, failFirst: true, wantRuns: 2},
+		{name: "records without id", dedup: NewDeduplicator(cache.NewMemoryCache(1<<20), "job", 0), calls: []*guid.Guid{nil, nil}, wantRuns: 2},
+		{name: "no deduplicator", calls: []*guid.Guid{id, id}, wantRuns: 2},
+		{name: "failing cache", dedup: NewDeduplicator(failingCache{}, "job", 0), calls: []*guid.Guid{id, id}, wantRuns: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runs := 0
+			for i, id := range test.calls {
+				scope := "load"
+				if test.scopes != nil {
+					scope = test.scopes[i]
+				}
+				fail := test.failFirst && i == 0
+				err := test.dedup.Process(scope, id, func() error {
+					runs++
+					if fail {
+						return fmt.Errorf("error saving record")
+					}
+					return nil
+				})
+				if (err != nil) != fail {
+					t.Fatalf("Process() error = %v, want failure %v", err, fail)
+				}
+			}
+			if runs != test.wantRuns {
+				t.Errorf("processed %v records, want %v", runs, test.wantRuns)
+			}
+			if got := test.dedup.Skipped(); got != test.wantSkipped {
+				t.Errorf("Skipped() = %v, want %v", got, test.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestDeduplicatorTTL(t *testing.T) {
+	if got := NewDeduplicator(nil, "job", 0).ttl; got != DefaultDedupTTL {
+		t.Errorf("default ttl = %v, want %v", got, DefaultDedupTTL)
+	}
+	id := guid.New()
+	dedup := NewDeduplicator(cache.NewMemoryCache(1<<20), "job", 10*time.Millisecond)
+	runs := 0
+	process := func() error {
+		runs++
+		return nil
+	}
+	dedup.Process("load", id, process)
+	time.Sleep(20 * time.Millisecond)
+	dedup.Process("load", id, process)
+	if runs != 2 {
+		t.Errorf("processed %v records after the id expired, want 2", runs)
+	}
+}
@@ -0,0 +1,480 @@
+package phases
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/beevik/guid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/broker"
+	"github.com/ezeriver94/gotransform/cache"
+	"github.com/ezeriver94/gotransform/common"
+	"github.com/ezeriver94/gotransform/state"
+)
+
+const (
+	// StageExtracted is the stage holding the records published by extractor workers
+	StageExtracted = "extracted"
+
+	// StageTransformed is the stage holding the Transformed messages published by transformer workers
+	StageTransformed = "transformed"
+
+	// DefaultExchange is the exchange used by distributed jobs unless their topology says otherwise
+	DefaultExchange = "gotransform"
+
+	// DataSourceHeader carries the primary datasource of an extracted record
+	DataSourceHeader = "datasource"
+)
+
+// Topology names the exchange and the queues that connect the workers of a distributed job; every stage has a queue named
+// after the job, shared by all the workers that consume it. Run identifies the run of the job the workers take part in, so
+// messages left on the queues by other runs are not mistaken for its own
+type Topology struct {
+	Exchange string
+	Job      string
+	Run      string
+}
+
+// NewTopology creates the topology of a new run of a job on the default exchange
+func NewTopology(job string) Topology {
+	return Topology{
+		Exchange: DefaultExchange,
+		Job:      job,
+		Run:      guid.New().String(),
+	}
+}
+
+// Queue returns the name of the queue of a stage, which is also its routing key
+func (t Topology) Queue(stage string) string {
+	return fmt.Sprintf("%v.%v", t.Job, stage)
+}
+
+// Control returns the name of the fanout exchange where the consumers of a stage share its end of stream
+func (t Topology) Control(stage string) string {
+	return fmt.Sprintf("%v.%v.control", t.Job, stage)
+}
+
+// declare creates the exchange of the topology and the queue of a stage
+func (t Topology) declare(declarer broker.Declarer, stage string) error {
+	if err := declarer.DeclareExchange(t.Exchange, broker.ExchangeDirect); err != nil {
+		return err
+	}
+	queue := t.Queue(stage)
+	if _, err := declarer.DeclareQueue(queue, broker.QueueOptions{}); err != nil {
+		return err
+	}
+	return declarer.BindQueue(queue, t.Exchange, queue)
+}
+
+// isEndOfStream indicates whether a delivery announces the end of a stream
+func isEndOfStream(delivery broker.Delivery) bool {
+	value, ok := delivery.Headers[common.EndOfStreamHeader].(bool)
+	return ok && value
+}
+
+// ExtractWorker extracts primary datasources and publishes every record to the extracted stage of a distributed job
+type ExtractWorker struct {
+	metadata  *common.Metadata
+	extractor *Extractor
+	broker    broker.Broker
+	topology  Topology
+}
+
+// NewExtractWorker creates an extractor worker publishing through b
+func NewExtractWorker(metadata *common.Metadata, store state.Store, b broker.Broker, topology Topology) (*ExtractWorker, error) {
+	extractor, err := NewExtractor(metadata, store)
+	if err != nil {
+		return nil, fmt.Errorf("error creating extractor: %v", err)
+	}
+	return &ExtractWorker{
+		metadata:  metadata,
+		extractor: &extractor,
+		broker:    b,
+		topology:  topology,
+	}, nil
+}
+
+// Extractor returns the extractor of the worker, so its watermarks can be managed before running
+func (w *ExtractWorker) Extractor() *Extractor {
+	return w.extractor
+}
+
+// Run extracts the given primary datasources, or all of them if none is given, publishing their records followed by an
+// end-of-stream message per datasource; every datasource is a producer of the extracted stage, so each one must be
+// extracted by a single worker. Watermarks are committed once every datasource was published
+func (w *ExtractWorker) Run(dataSourceNames []string) error {
+	if len(dataSourceNames) == 0 {
+		for dataSourceName := range w.metadata.Extract.PrimaryDataSources {
+			dataSourceNames = append(dataSourceNames, dataSourceName)
+		}
+	}
+	errs := make(chan error, len(dataSourceNames))
+	wait := sync.WaitGroup{}
+	for _, dataSourceName := range dataSourceNames {
+		wait.Add(1)
+		go func(dataSourceName string) {
+			defer wait.Done()
+			errs <- w.extract(dataSourceName)
+		}(dataSourceName)
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return w.extractor.CommitWatermarks()
+}
+
+// extract publishes every record of a datasource, followed by its end-of-stream message
+func (w *ExtractWorker) extract(dataSourceName string) error {
+	producer, err := newStageProducer(dataSourceName, w.broker, w.topology, StageExtracted)
+	if err != nil {
+		return err
+	}
+	records := make(chan common.Record)
+	extracted := make(chan error, 1)
+	go func() {
+		defer close(records)
+		extracted <- w.extractor.Extract(dataSourceName, records)
+	}()
+
+	var (
+		failed  error
+		pending []publishedRecord
+	)
+	headers := map[string]interface{}{DataSourceHeader: dataSourceName}
+	for record := range records {
+		if failed != nil {
+			// keep draining the stream so the extractor can finish
+			continue
+		}
+		body, err := json.Marshal(record)
+		if err != nil {
+			failed = fmt.Errorf(record.Log("error serializing record: %v", err))
+			continue
+		}
+		// confirmations are waited for in batches and at the end of the stream
+		record := record
+		pending = append(pending, publishedRecord{record: &record, confirmation: producer.publish(body, headers)})
+		if len(pending) >= maxPendingConfirmations {
+			failed = confirmRecords(dataSourceName, pending)
+			pending = nil
+		}
+	}
+	if err := confirmRecords(dataSourceName, pending); err != nil && failed == nil {
+		failed = err
+	}
+	if err := <-extracted; err != nil {
+		return err
+	}
+	if failed != nil {
+		return failed
+	}
+	if err := producer.end(); err != nil {
+		return err
+	}
+	log.Infof("published every record of datasource %v", dataSourceName)
+	return nil
+}
+
+// publishedRecord is a record published by an extractor worker, along with the confirmation of its message
+type publishedRecord struct {
+	record       *common.Record
+	confirmation broker.Confirmation
+}
+
+// confirmRecords waits for the confirmations of records of a datasource, logging every record the broker did not take
+// and returning an error naming the first of them
+func confirmRecords(dataSourceName string, published []publishedRecord) error {
+	var failed error
+	for _, p := range published {
+		err := p.confirmation.Wait()
+		if err == nil {
+			continue
+		}
+		message := p.record.Log("error publishing record of datasource %v: %v", dataSourceName, err)
+		log.Errorf("%v", message)
+		if failed == nil {
+			failed = fmt.Errorf("%v", message)
+		}
+	}
+	return failed
+}
+
+// TransformWorker consumes the extracted stage of a distributed job, applying every transformation that reads from the
+// datasource of each record and publishing the results to the transformed stage
+type TransformWorker struct {
+	metadata    *common.Metadata
+	transformer *Transformer
+	consumer    broker.Consumer
+	control     *stageControl
+	producer    *stageProducer
+	dedup       *Deduplicator
+}
+
+// NewTransformWorker creates a transformer worker identified by its consumer tag, processing records as the options say and caching the records fetched by joins on c;
+// every worker of the run of the topology shares the cache of the datasources on the run namespace.
+// Records are consumed from, and published to, b
+func NewTransformWorker(metadata *common.Metadata, c cache.Cache, b broker.Broker, topology Topology, tag string, options broker.ConsumerOptions) (*TransformWorker, error) {
+	transformer, err := NewTransformer(metadata, c, topology.Run)
+	if err != nil {
+		return nil, fmt.Errorf("error creating transformer: %v", err)
+	}
+	consumer, err := newStageConsumer(b, topology, StageExtracted, tag, options)
+	if err != nil {
+		return nil, err
+	}
+	dataSourceNames := make([]string, 0, len(metadata.Extract.PrimaryDataSources))
+	for dataSourceName := range metadata.Extract.PrimaryDataSources {
+		dataSourceNames = append(dataSourceNames, dataSourceName)
+	}
+	control, err := newStageControl(b, topology, StageExtracted, tag, newStreamTracker(dataSourceNames, 0))
+	if err != nil {
+		return nil, err
+	}
+	producer, err := newStageProducer(tag, b, topology, StageTransformed)
+	if err != nil {
+		return nil, err
+	}
+	return &TransformWorker{
+		metadata:    metadata,
+		transformer: &transformer,
+		consumer:    consumer,
+		control:     control,
+		producer:    producer,
+	}, nil
+}
+
+// newStageConsumer declares the queue of a stage and creates a consumer of it
+func newStageConsumer(b broker.Broker, topology Topology, stage, tag string, options broker.ConsumerOptions) (broker.Consumer, error) {
+	if err := topology.declare(b, stage); err != nil {
+		return nil, err
+	}
+	consumer, err := b.Consume(topology.Queue(stage), tag, options)
+	if err != nil {
+		return nil, fmt.Errorf("error consuming stage %v: %v", stage, err)
+	}
+	return consumer, nil
+}
+
+// consumeStage handles the messages of a stage until every producer ended and every message they announced was processed
+// by some consumer. Messages that cannot be handled count as processed once they exhaust their attempts, and the ones left
+// on the queue by other runs of the job are dropped
+func consumeStage(consumer broker.Consumer, control *stageControl, handle func(broker.Delivery) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-control.finished:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := consumer.Process(ctx, func(ctx context.Context, delivery broker.Delivery) error {
+		if run := runOf(delivery); run != control.run {
+			log.Warnf("dropping message of run %v, which is not the current run %v", run, control.run)
+			return nil
+		}
+		if isEndOfStream(delivery) {
+			if err := control.broadcast(delivery); err != nil {
+				return broker.Requeue(err)
+			}
+			return nil
+		}
+		err := handle(delivery)
+		if err != nil && !consumer.FinalAttempt(delivery) {
+			// it will be delivered again, so it is not processed yet
+			return err
+		}
+		if reportErr := control.processed(delivery); reportErr != nil {
+			log.Errorf("%v", reportErr)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case <-control.finished:
+		return nil
+	default:
+		return fmt.Errorf("stream closed before its end")
+	}
+}
+
+// Deduplicate makes the worker skip the records that d remembers as transformed, as the ones delivered again after a crash
+func (w *TransformWorker) Deduplicate(d *Deduplicator) {
+	w.dedup = d
+}
+
+// Run transforms records until every primary datasource ended and all their records were transformed by some worker,
+// then announces the end of this worker as a producer of the transformed stage, along with how many records it published
+func (w *TransformWorker) Run() error {
+	if err := w.transformer.Preload(); err != nil {
+		return err
+	}
+	err := consumeStage(w.consumer, w.control, w.transform)
+	if err == nil {
+		err = w.producer.end()
+	}
+	w.control.close()
+	if shutdownErr := w.consumer.Shutdown(); err == nil {
+		err = shutdownErr
+	}
+	if w.dedup != nil {
+		log.Infof("transformer worker skipped %v duplicated records", w.dedup.Skipped())
+	}
+	return err
+}
+
+// transform applies the transformations of a delivered record and publishes their results, waiting for the broker to
+// confirm them so the record is acked only once its results are safe
+func (w *TransformWorker) transform(delivery broker.Delivery) error {
+	dataSourceName, _ := delivery.Headers[DataSourceHeader].(string)
+	dataSource, ok := w.metadata.Extract.PrimaryDataSources[dataSourceName]
+	if !ok {
+		return fmt.Errorf("received record of unknown primary datasource %v", dataSourceName)
+	}
+	var record common.Record
+	if err := json.Unmarshal(delivery.Body, &record); err != nil {
+		return fmt.Errorf("error deserializing record of datasource %v: %v", dataSourceName, err)
+	}
+	if err := dataSource.Validate(&record); err != nil {
+		return fmt.Errorf("error validating record of datasource %v: %v", dataSourceName, err)
+	}
+	return w.dedup.Process(StageExtracted+":"+dataSourceName, record.ID, func() error {
+		return w.publish(dataSourceName, &record)
+	})
+}
+
+// publish applies the transformations of a record and publishes their results
+func (w *TransformWorker) publish(dataSourceName string, record *common.Record) error {
+	confirmations := make([]broker.Confirmation, 0)
+	for transformationName, transformation := range w.metadata.Transform {
+		if transformation.From != dataSourceName {
+			continue
+		}
+		transformed, err := w.transformer.Transform(transformationName, record)
+		if err != nil {
+			return fmt.Errorf("error applying transformation %v: %v", transformationName, err)
+		}
+		body, err := transformed.Serialize()
+		if err != nil {
+			return fmt.Errorf(record.Log("error serializing transformed record: %v", err))
+		}
+		confirmations = append(confirmations, w.producer.publish(body, nil))
+	}
+	if err := broker.WaitAll(confirmations); err != nil {
+		return fmt.Errorf("error publishing transformed record: %v", err)
+	}
+	return nil
+}
+
+// LoadWorker consumes the transformed stage of a distributed job, saving every record into the targets of its transformation.
+// Write modes that rewrite the whole destination, as replace or staged loads, need a single loader worker
+type LoadWorker struct {
+	loader   *Loader
+	consumer broker.Consumer
+	control  *stageControl
+	dedup    *Deduplicator
+}
+
+// NewLoadWorker creates a loader worker consuming from b with the given tag and options, which waits for the end of that amount of
+// transformer workers
+func NewLoadWorker(metadata *common.Metadata, b broker.Broker, topology Topology, tag string, transformers int, options broker.ConsumerOptions) (*LoadWorker, error) {
+	if transformers <= 0 {
+		return nil, fmt.Errorf("a loader worker needs to know how many transformer workers produce its records")
+	}
+	loader, err := NewLoader(metadata, topology.Run)
+	if err != nil {
+		return nil, fmt.Errorf("error creating loader: %v", err)
+	}
+	consumer, err := newStageConsumer(b, topology, StageTransformed, tag, options)
+	if err != nil {
+		return nil, err
+	}
+	control, err := newStageControl(b, topology, StageTransformed, tag, newStreamTracker(nil, transformers))
+	if err != nil {
+		return nil, err
+	}
+	return &LoadWorker{
+		loader:   &loader,
+		consumer: consumer,
+		control:  control,
+	}, nil
+}
+
+// Loader returns the loader of the worker, so quality checks can be added before running
+func (w *LoadWorker) Loader() *Loader {
+	return w.loader
+}
+
+// Deduplicate makes the worker skip the records that d remembers as loaded, as the ones delivered again after a crash
+func (w *LoadWorker) Deduplicate(d *Deduplicator) {
+	w.dedup = d
+}
+
+// AddCheck registers a quality check that every load target must pass before its staged output is published
+func (w *LoadWorker) AddCheck(check QualityCheck) {
+	w.loader.AddCheck(check)
+}
+
+// Run saves records until every transformer worker ended and all their records were saved by some worker; the load is
+// finished if every record was saved, otherwise, if some record failed its last attempt, it is aborted
+func (w *LoadWorker) Run() error {
+	if err := w.loader.Initialize(); err != nil {
+		return fmt.Errorf("error initializing loader: %v", err)
+	}
+	var (
+		failed     error
+		failedSync sync.Mutex
+	)
+	err := consumeStage(w.consumer, w.control, func(delivery broker.Delivery) error {
+		err := w.load(delivery)
+		// messages delivered again may still be saved, so only the ones out of attempts fail the load
+		if err != nil && w.consumer.FinalAttempt(delivery) {
+			failedSync.Lock()
+			if failed == nil {
+				failed = err
+			}
+			failedSync.Unlock()
+		}
+		return err
+	})
+	w.control.close()
+	if shutdownErr := w.consumer.Shutdown(); err == nil {
+		err = shutdownErr
+	}
+	if w.dedup != nil {
+		log.Infof("loader worker skipped %v duplicated records", w.dedup.Skipped())
+	}
+	if err == nil {
+		err = failed
+	}
+	if err != nil {
+		if abortErr := w.loader.Abort(); abortErr != nil {
+			log.Errorf("error aborting loader: %v", abortErr)
+		}
+		return err
+	}
+	if err := w.loader.Finish(); err != nil {
+		return fmt.Errorf("error finishing loader: %v", err)
+	}
+	return nil
+}
+
+// load saves a delivered Transformed message
+func (w *LoadWorker) load(delivery broker.Delivery) error {
+	transformed, err := DeserializeTransformed(delivery.Body)
+	if err != nil {
+		return fmt.Errorf("error deserializing transformed record: %v", err)
+	}
+	return w.dedup.Process(StageTransformed+":"+transformed.TransformationName, transformed.Record.ID, func() error {
+		return w.loader.Load(transformed)
+	})
+}
@@ -0,0 +1,327 @@
+package phases
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ezeriver94/gotransform/broker"
+	"github.com/ezeriver94/gotransform/common"
+)
+
+func TestTopology(t *testing.T) {
+	topology := NewTopology("orders")
+	tests := []struct {
+		stage       string
+		wantQueue   string
+		wantControl string
+	}{
+		{StageExtracted, "orders.extracted", "orders.extracted.control"},
+		{StageTransformed, "orders.transformed", "orders.transformed.control"},
+	}
+	for _, test := range tests {
+		if got := topology.Queue(test.stage); got != test.wantQueue {
+			t.Errorf("Queue(%v) = %v, want %v", test.stage, got, test.wantQueue)
+		}
+		if got := topology.Control(test.stage); got != test.wantControl {
+			t.Errorf("Control(%v) = %v, want %v", test.stage, got, test.wantControl)
+		}
+	}
+	if topology.Exchange != DefaultExchange {
+		t.Errorf("Exchange = %v, want %v", topology.Exchange, DefaultExchange)
+	}
+}
+
+func TestIsEndOfStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]interface{}
+		want    bool
+	}{
+		{"end of stream", map[string]interface{}{common.EndOfStreamHeader: true}, true},
+		{"record", map[string]interface{}{DataSourceHeader: "orders"}, false},
+		{"false header", map[string]interface{}{common.EndOfStreamHeader: false}, false},
+		{"non boolean header", map[string]interface{}{common.EndOfStreamHeader: "true"}, false},
+		{"no headers", nil, false},
+	}
+	for _, test := range tests {
+		if got := isEndOfStream(broker.Delivery{Headers: test.headers}); got != test.want {
+			t.Errorf("%v: isEndOfStream() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTransformedSerialize(t *testing.T) {
+	record := common.NewRecord(false)
+	record.Set("id", 7)
+	record.Set("name", "john")
+	record.Operation = common.OperationDelete
+	transformed := Transformed{TransformationName: "customers", Record: record}
+
+	body, err := transformed.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DeserializeTransformed(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TransformationName != transformed.TransformationName {
+		t.Errorf("TransformationName = %v, want %v", got.TransformationName, transformed.TransformationName)
+	}
+	if got.Record.ID.String() != record.ID.String() || got.Record.Operation != record.Operation {
+		t.Errorf("Record = %v, want %v", got.Record, record)
+	}
+	for field, want := range map[string]interface{}{"id": float64(7), "name": "john"} {
+		if value, err := got.Record.Get(field); err != nil || value != want {
+			t.Errorf("Record.Get(%v) = %v, %v, want %v", field, value, err, want)
+		}
+	}
+	if _, err := DeserializeTransformed([]byte("{")); err == nil {
+		t.Errorf("DeserializeTransformed() of invalid json returned no error")
+	}
+}
+
+// saveServer is an accessor service failing the first failures saves it receives, counting the ones it accepts
+func saveServer(failures int32, saved *int32) *httptest.Server {
+	var received int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/save" {
+			return
+		}
+		if atomic.AddInt32(&received, 1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		atomic.AddInt32(saved, 1)
+	}))
+}
+
+// accessorTarget is a load target of the customers transformation saving through the accessor service of server
+func accessorTarget(server *httptest.Server) common.DataDestination {
+	return common.DataDestination{
+		DataEndpoint:       common.DataEndpoint{AccessorURL: strings.TrimPrefix(server.URL, "http://")},
+		TransformationName: "customers",
+	}
+}
+
+// publishTransformed publishes records of the customers transformation into the transformed stage as a single
+// transformer worker, followed by its end of stream
+func publishTransformed(t *testing.T, b broker.Broker, topology Topology, records int) {
+	producer, err := newStageProducer("transformer", b, topology, StageTransformed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= records; i++ {
+		record := common.NewRecord(false)
+		record.Set("id", i)
+		transformed := Transformed{TransformationName: "customers", Record: record}
+		body, err := transformed.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		producer.publish(body, nil)
+	}
+	if err := producer.end(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadWorkerRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int32
+		wantErr   bool
+		wantSaved int32
+	}{
+		{name: "no failures", failures: 0, wantSaved: 3},
+		{name: "failure saved on retry", failures: 1, wantSaved: 3},
+		{name: "failure out of attempts", failures: 100, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var saved int32
+			server := saveServer(test.failures, &saved)
+			defer server.Close()
+			metadata := &common.Metadata{Load: map[string]common.DataDestination{"customers": accessorTarget(server)}}
+			b := broker.NewMemory()
+			defer b.Close()
+			topology := NewTopology("retries")
+			options := broker.ConsumerOptions{Retry: &broker.RetryOptions{MaxAttempts: 2, Delays: []time.Duration{10 * time.Millisecond}}}
+			worker, err := NewLoadWorker(metadata, b, topology, "loader", 1, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ran := make(chan error, 1)
+			go func() {
+				ran <- worker.Run()
+			}()
+			publishTransformed(t, b, topology, 3)
+
+			select {
+			case err := <-ran:
+				if (err != nil) != test.wantErr {
+					t.Fatalf("Run() error = %v, wantErr %v", err, test.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run() did not finish")
+			}
+			if !test.wantErr && atomic.LoadInt32(&saved) != test.wantSaved {
+				t.Errorf("saved %v records, want %v", saved, test.wantSaved)
+			}
+		})
+	}
+}
+
+func TestLoadWorkerDropsOtherRuns(t *testing.T) {
+	var saved int32
+	server := saveServer(0, &saved)
+	defer server.Close()
+	metadata := &common.Metadata{Load: map[string]common.DataDestination{"customers": accessorTarget(server)}}
+	b := broker.NewMemory()
+	defer b.Close()
+	previous := NewTopology("runs")
+	topology := NewTopology("runs")
+	if previous.Run == topology.Run {
+		t.Fatalf("NewTopology() reused run %v", topology.Run)
+	}
+	// messages of a previous run of the job, left on its queue
+	publishTransformed(t, b, previous, 2)
+	worker, err := NewLoadWorker(metadata, b, topology, "loader", 1, broker.ConsumerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan error, 1)
+	go func() {
+		ran <- worker.Run()
+	}()
+	publishTransformed(t, b, topology, 3)
+
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not finish")
+	}
+	if got := atomic.LoadInt32(&saved); got != 3 {
+		t.Errorf("saved %v records, want the 3 of the current run", got)
+	}
+}
+
+// nackingBroker is a broker refusing the message of a sequence published into a queue, keeping its body
+type nackingBroker struct {
+	broker.Broker
+	queue    string
+	sequence int
+	nacked   []byte
+}
+
+func (b *nackingBroker) Publish(exchange, routingKey string, body []byte, headers map[string]interface{}) broker.Confirmation {
+	if sequence, ok := broker.ToInt(headers[sequenceHeader]); ok && routingKey == b.queue && sequence == b.sequence {
+		b.nacked = body
+		return broker.Resolved(fmt.Errorf("message nacked"))
+	}
+	return b.Broker.Publish(exchange, routingKey, body, headers)
+}
+
+func TestExtractWorkerReportsNackedRecord(t *testing.T) {
+	finished := make(chan bool, 1)
+	source := endlessServer(t, 5, finished)
+	defer source.Close()
+	metadata := &common.Metadata{
+		Extract: common.Extract{PrimaryDataSources: map[string]common.DataEndpoint{
+			"customers": {
+				AccessorURL: strings.TrimPrefix(source.URL, "http://"),
+				Fields:      common.Fields{{Name: "id", ExpectedType: "int"}},
+			},
+		}},
+	}
+	memory := broker.NewMemory()
+	defer memory.Close()
+	topology := NewTopology("nacks")
+	b := &nackingBroker{Broker: memory, queue: topology.Queue(StageExtracted), sequence: 3}
+	extractor, err := NewExtractWorker(metadata, nil, b, topology)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = extractor.Run(nil)
+	if err == nil {
+		t.Fatal("Run() returned no error, want the nacked record reported")
+	}
+	var nacked common.Record
+	if err := json.Unmarshal(b.nacked, &nacked); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(err.Error(), nacked.ID.String()) || !strings.Contains(err.Error(), "message nacked") {
+		t.Errorf("Run() error = %v, want it to name record %v", err, nacked.ID.String())
+	}
+}
+
+func TestWorkersEndToEnd(t *testing.T) {
+	finished := make(chan bool, 1)
+	source := endlessServer(t, 5, finished)
+	defer source.Close()
+	var saved int32
+	target := saveServer(0, &saved)
+	defer target.Close()
+	metadata := &common.Metadata{
+		Extract: common.Extract{PrimaryDataSources: map[string]common.DataEndpoint{
+			"customers": {
+				AccessorURL: strings.TrimPrefix(source.URL, "http://"),
+				Fields:      common.Fields{{Name: "id", ExpectedType: "int"}},
+			},
+		}},
+		Transform: map[string]common.DataTransformation{
+			"customers": {From: "customers", Select: map[string]common.SelectClause{"id": "customers.id"}},
+		},
+		Load: map[string]common.DataDestination{"customers": accessorTarget(target)},
+	}
+	b := broker.NewMemory()
+	defer b.Close()
+	topology := NewTopology("end to end")
+
+	loader, err := NewLoadWorker(metadata, b, topology, "loader", 1, broker.ConsumerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformer, err := NewTransformWorker(metadata, nil, b, topology, "transformer", broker.ConsumerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	extractor, err := NewExtractWorker(metadata, nil, b, topology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan error, 3)
+	go func() {
+		ran <- loader.Run()
+	}()
+	go func() {
+		ran <- transformer.Run()
+	}()
+	go func() {
+		ran <- extractor.Run(nil)
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-ran:
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("workers did not finish")
+		}
+	}
+	if got := atomic.LoadInt32(&saved); got != 5 {
+		t.Errorf("saved %v records, want 5", got)
+	}
+}
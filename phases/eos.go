@@ -0,0 +1,443 @@
+package phases
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/broker"
+	"github.com/ezeriver94/gotransform/common"
+)
+
+const (
+	// producerHeader carries the id of the producer of a message
+	producerHeader = "producer"
+
+	// sequenceHeader carries the position of a message among the ones published by its producer, starting from 1, so
+	// consumers count every message once no matter how many times it is delivered
+	sequenceHeader = "sequence"
+
+	// countHeader carries the amount of messages published by a producer on its end-of-stream message
+	countHeader = "count"
+
+	// runHeader carries the run of the job a message belongs to
+	runHeader = "run"
+
+	// consumerHeader carries the id of the consumer reporting its progress on the control exchange of a stage
+	consumerHeader = "consumer"
+)
+
+// sequences is a set of message sequences kept as sorted, disjoint and non adjacent ranges, so the messages of a producer
+// processed mostly in order take little room
+type sequences [][2]int
+
+// add inserts a sequence into the set, returning false if it was already there
+func (s *sequences) add(sequence int) bool {
+	ranges := *s
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i][1] >= sequence })
+	if i < len(ranges) && ranges[i][0] <= sequence {
+		return false
+	}
+	joinsPrevious := i > 0 && ranges[i-1][1] == sequence-1
+	joinsNext := i < len(ranges) && ranges[i][0] == sequence+1
+	switch {
+	case joinsPrevious && joinsNext:
+		ranges[i-1][1] = ranges[i][1]
+		ranges = append(ranges[:i], ranges[i+1:]...)
+	case joinsPrevious:
+		ranges[i-1][1] = sequence
+	case joinsNext:
+		ranges[i][0] = sequence
+	default:
+		ranges = append(ranges, [2]int{})
+		copy(ranges[i+1:], ranges[i:])
+		ranges[i] = [2]int{sequence, sequence}
+	}
+	*s = ranges
+	return true
+}
+
+// union returns a new set with the sequences of both sets
+func (s sequences) union(other sequences) sequences {
+	all := make(sequences, 0, len(s)+len(other))
+	all = append(all, s...)
+	all = append(all, other...)
+	sort.Slice(all, func(a, b int) bool { return all[a][0] < all[b][0] })
+	result := make(sequences, 0, len(all))
+	for _, r := range all {
+		if last := len(result) - 1; last >= 0 && r[0] <= result[last][1]+1 {
+			if r[1] > result[last][1] {
+				result[last][1] = r[1]
+			}
+			continue
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// size returns how many sequences are in the set
+func (s sequences) size() int {
+	result := 0
+	for _, r := range s {
+		result += r[1] - r[0] + 1
+	}
+	return result
+}
+
+// streamTracker follows the end of the stream of a stage: every producer announces how many messages it published, and
+// every consumer reports which of them it processed. The stage is complete once every expected producer announced its end
+// and the consumers processed every message announced; messages are identified by their producer and sequence, so the
+// ones delivered more than once, to the same or to different consumers, are counted once
+type streamTracker struct {
+	expected  map[string]bool
+	producers int
+	announced map[string]int
+	reports   map[string]map[string]sequences
+	sync      sync.Mutex
+}
+
+// newStreamTracker creates a tracker expecting the end of the named producers or, if none is named, of that amount of
+// distinct producers
+func newStreamTracker(expected []string, producers int) *streamTracker {
+	result := streamTracker{
+		expected:  make(map[string]bool, len(expected)),
+		producers: producers,
+		announced: make(map[string]int),
+		reports:   make(map[string]map[string]sequences),
+	}
+	for _, producer := range expected {
+		result.expected[producer] = true
+	}
+	if len(result.expected) > 0 {
+		result.producers = len(result.expected)
+	}
+	return &result
+}
+
+// announce records the end of a producer, returning false if it was already known
+func (t *streamTracker) announce(producer string, count int) bool {
+	t.sync.Lock()
+	defer t.sync.Unlock()
+	if len(t.expected) > 0 && !t.expected[producer] {
+		log.Warnf("ignoring end of stream of unexpected producer %v", producer)
+		return false
+	}
+	if previous, ok := t.announced[producer]; ok && previous == count {
+		return false
+	}
+	t.announced[producer] = count
+	return true
+}
+
+// process records a message of a producer processed by a consumer, returning false if the consumer had already processed it
+func (t *streamTracker) process(consumer, producer string, sequence int) bool {
+	t.sync.Lock()
+	defer t.sync.Unlock()
+	progress, ok := t.reports[consumer]
+	if !ok {
+		progress = make(map[string]sequences)
+		t.reports[consumer] = progress
+	}
+	processed := progress[producer]
+	added := processed.add(sequence)
+	progress[producer] = processed
+	return added
+}
+
+// progress returns which messages of every producer a consumer processed
+func (t *streamTracker) progress(consumer string) map[string]sequences {
+	t.sync.Lock()
+	defer t.sync.Unlock()
+	result := make(map[string]sequences, len(t.reports[consumer]))
+	for producer, processed := range t.reports[consumer] {
+		result[producer] = processed.union(nil)
+	}
+	return result
+}
+
+// report adds the messages a consumer reported as processed; reports may arrive out of order, so they are merged with
+// the known ones
+func (t *streamTracker) report(consumer string, progress map[string]sequences) {
+	t.sync.Lock()
+	defer t.sync.Unlock()
+	current, ok := t.reports[consumer]
+	if !ok {
+		current = make(map[string]sequences, len(progress))
+		t.reports[consumer] = current
+	}
+	for producer, processed := range progress {
+		current[producer] = current[producer].union(processed)
+	}
+}
+
+// ended indicates whether every expected producer announced its end
+func (t *streamTracker) ended() bool {
+	t.sync.Lock()
+	defer t.sync.Unlock()
+	return t.producers > 0 && len(t.announced) >= t.producers
+}
+
+// complete indicates whether every expected producer announced its end and every announced message was processed by
+// some consumer
+func (t *streamTracker) complete() bool {
+	t.sync.Lock()
+	defer t.sync.Unlock()
+	if t.producers <= 0 || len(t.announced) < t.producers {
+		return false
+	}
+	for producer, announced := range t.announced {
+		var processed sequences
+		for _, progress := range t.reports {
+			processed = processed.union(progress[producer])
+		}
+		if processed.size() < announced {
+			return false
+		}
+	}
+	return true
+}
+
+// maxPendingConfirmations bounds the messages a producer publishes before waiting for their confirmations
+const maxPendingConfirmations = 1024
+
+// stageProducer publishes the messages of a producer into a stage, counting them for its end-of-stream message
+type stageProducer struct {
+	id       string
+	broker   broker.Broker
+	topology Topology
+	stage    string
+	count    int
+	pending  []broker.Confirmation
+	failed   error
+	sync     sync.Mutex
+}
+
+// newStageProducer creates a producer identified by id publishing into a stage
+func newStageProducer(id string, b broker.Broker, topology Topology, stage string) (*stageProducer, error) {
+	if err := topology.declare(b, stage); err != nil {
+		return nil, err
+	}
+	return &stageProducer{
+		id:       id,
+		broker:   b,
+		topology: topology,
+		stage:    stage,
+	}, nil
+}
+
+// publish sends a message into the stage, tagging it with its run, the id of the producer and its sequence; the result can be
+// waited for to know whether the broker took it. Once too many messages wait for their confirmations, it waits for them
+func (p *stageProducer) publish(body []byte, headers map[string]interface{}) broker.Confirmation {
+	p.sync.Lock()
+	p.count++
+	sequence := p.count
+	p.sync.Unlock()
+	tagged := map[string]interface{}{runHeader: p.topology.Run, producerHeader: p.id, sequenceHeader: int64(sequence)}
+	for key, value := range headers {
+		tagged[key] = value
+	}
+	confirmation := p.broker.Publish(p.topology.Exchange, p.topology.Queue(p.stage), body, tagged)
+	p.sync.Lock()
+	p.pending = append(p.pending, confirmation)
+	var pending []broker.Confirmation
+	if len(p.pending) >= maxPendingConfirmations {
+		pending, p.pending = p.pending, nil
+	}
+	p.sync.Unlock()
+	if len(pending) > 0 {
+		p.confirm(pending)
+	}
+	return confirmation
+}
+
+// confirm waits for confirmations, keeping the first error found
+func (p *stageProducer) confirm(confirmations []broker.Confirmation) error {
+	err := broker.WaitAll(confirmations)
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	if err != nil && p.failed == nil {
+		p.failed = err
+	}
+	return p.failed
+}
+
+// end waits for the confirmation of every message of the producer and announces that it will not publish anymore, along
+// with the amount of messages it published
+func (p *stageProducer) end() error {
+	p.sync.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.sync.Unlock()
+	if err := p.confirm(pending); err != nil {
+		return fmt.Errorf("error confirming messages of producer %v: %v", p.id, err)
+	}
+	p.sync.Lock()
+	count := p.count
+	p.sync.Unlock()
+	headers := map[string]interface{}{
+		common.EndOfStreamHeader: true,
+		runHeader:                p.topology.Run,
+		producerHeader:           p.id,
+		countHeader:              int64(count),
+	}
+	if err := p.broker.Publish(p.topology.Exchange, p.topology.Queue(p.stage), nil, headers).Wait(); err != nil {
+		return fmt.Errorf("error publishing end of stream of producer %v: %v", p.id, err)
+	}
+	log.Infof("producer %v published %v messages into stage %v", p.id, count, p.stage)
+	return nil
+}
+
+// stageControl shares the end of the stream of a stage among all its consumers. End-of-stream messages travel on the
+// queue of the stage, so they are never lost, but only one consumer receives each of them; that consumer broadcasts it
+// through the control exchange of the stage, along with the progress of every consumer, so all of them know when the
+// stage is complete. Only the messages of its run are taken into account. Consumers must be started before the producers
+// of their stage finish
+type stageControl struct {
+	id       string
+	run      string
+	broker   broker.Broker
+	consumer broker.Consumer
+	exchange string
+	tracker  *streamTracker
+	finished chan struct{}
+	once     sync.Once
+}
+
+// newStageControl subscribes a consumer identified by id to the control exchange of a stage
+func newStageControl(b broker.Broker, topology Topology, stage, id string, tracker *streamTracker) (*stageControl, error) {
+	exchange := topology.Control(stage)
+	if err := b.DeclareExchange(exchange, broker.ExchangeFanout); err != nil {
+		return nil, err
+	}
+	queue, err := b.DeclareQueue("", broker.QueueOptions{Exclusive: true})
+	if err != nil {
+		return nil, fmt.Errorf("error declaring control queue: %v", err)
+	}
+	if err := b.BindQueue(queue, exchange, ""); err != nil {
+		return nil, fmt.Errorf("error binding control queue: %v", err)
+	}
+	consumer, err := b.Consume(queue, id, broker.ConsumerOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error consuming control queue: %v", err)
+	}
+	result := &stageControl{
+		id:       id,
+		run:      topology.Run,
+		broker:   b,
+		consumer: consumer,
+		exchange: exchange,
+		tracker:  tracker,
+		finished: make(chan struct{}),
+	}
+	go func() {
+		if err := consumer.Process(context.Background(), result.listen); err != nil {
+			log.Errorf("error listening to control exchange %v: %v", exchange, err)
+		}
+	}()
+	return result, nil
+}
+
+// listen applies every end-of-stream and progress message broadcasted by the consumers of the stage
+func (c *stageControl) listen(ctx context.Context, delivery broker.Delivery) error {
+	if run := runOf(delivery); run != c.run {
+		log.Debugf("ignoring control message of run %v", run)
+		return nil
+	}
+	defer c.check()
+	if isEndOfStream(delivery) {
+		producer, count := endOfStreamOf(delivery)
+		if c.tracker.announce(producer, count) {
+			log.Infof("producer %v ended after publishing %v messages", producer, count)
+		}
+		// let every consumer know how far this one got, so idle consumers are counted too
+		if err := c.report(); err != nil {
+			log.Errorf("%v", err)
+		}
+	} else if consumer, ok := delivery.Headers[consumerHeader].(string); ok && consumer != c.id {
+		var progress map[string]sequences
+		if err := json.Unmarshal(delivery.Body, &progress); err != nil {
+			log.Errorf("error reading progress of consumer %v: %v", consumer, err)
+			return nil
+		}
+		c.tracker.report(consumer, progress)
+	}
+	return nil
+}
+
+// check closes the finished channel once the stage is complete
+func (c *stageControl) check() {
+	if c.tracker.complete() {
+		c.once.Do(func() {
+			close(c.finished)
+		})
+	}
+}
+
+// runOf reads the run a message belongs to
+func runOf(delivery broker.Delivery) string {
+	run, _ := delivery.Headers[runHeader].(string)
+	return run
+}
+
+// endOfStreamOf reads the producer and the amount of messages announced by an end-of-stream message
+func endOfStreamOf(delivery broker.Delivery) (string, int) {
+	producer, _ := delivery.Headers[producerHeader].(string)
+	count, _ := broker.ToInt(delivery.Headers[countHeader])
+	return producer, count
+}
+
+// broadcast shares an end-of-stream message received from the queue of the stage with every consumer
+func (c *stageControl) broadcast(delivery broker.Delivery) error {
+	producer, count := endOfStreamOf(delivery)
+	headers := map[string]interface{}{
+		common.EndOfStreamHeader: true,
+		runHeader:                c.run,
+		producerHeader:           producer,
+		countHeader:              int64(count),
+	}
+	if err := c.broker.Publish(c.exchange, "", nil, headers).Wait(); err != nil {
+		return fmt.Errorf("error broadcasting end of stream of producer %v: %v", producer, err)
+	}
+	return nil
+}
+
+// processed records a message of the stage processed by this consumer; once every producer ended, the progress is
+// reported to the other consumers after every new message
+func (c *stageControl) processed(delivery broker.Delivery) error {
+	producer, _ := delivery.Headers[producerHeader].(string)
+	sequence, ok := broker.ToInt(delivery.Headers[sequenceHeader])
+	if !ok {
+		return fmt.Errorf("message of producer %v has no sequence; it cannot be counted", producer)
+	}
+	if !c.tracker.process(c.id, producer, sequence) {
+		log.Debugf("message %v of producer %v was already processed", sequence, producer)
+		return nil
+	}
+	defer c.check()
+	if !c.tracker.ended() {
+		return nil
+	}
+	return c.report()
+}
+
+// report sends the progress of this consumer to the other consumers of the stage
+func (c *stageControl) report() error {
+	body, err := json.Marshal(c.tracker.progress(c.id))
+	if err != nil {
+		return fmt.Errorf("error serializing progress: %v", err)
+	}
+	if err := c.broker.Publish(c.exchange, "", body, map[string]interface{}{runHeader: c.run, consumerHeader: c.id}).Wait(); err != nil {
+		return fmt.Errorf("error reporting progress of consumer %v: %v", c.id, err)
+	}
+	return nil
+}
+
+// close stops listening to the control exchange
+func (c *stageControl) close() error {
+	return c.consumer.Shutdown()
+}
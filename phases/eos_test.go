@@ -0,0 +1,136 @@
+package phases
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSequencesAdd(t *testing.T) {
+	tests := []struct {
+		name  string
+		added []int
+		want  sequences
+		size  int
+	}{
+		{"in order", []int{1, 2, 3}, sequences{{1, 3}}, 3},
+		{"out of order", []int{3, 1, 2}, sequences{{1, 3}}, 3},
+		{"gaps", []int{1, 5, 3}, sequences{{1, 1}, {3, 3}, {5, 5}}, 3},
+		{"filling a gap", []int{1, 3, 2}, sequences{{1, 3}}, 3},
+		{"duplicated", []int{1, 2, 2, 1}, sequences{{1, 2}}, 2},
+		{"extending a range backwards", []int{5, 4, 1}, sequences{{1, 1}, {4, 5}}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got sequences
+			seen := make(map[int]bool)
+			for _, sequence := range test.added {
+				if added := got.add(sequence); added == seen[sequence] {
+					t.Errorf("add(%v) = %v, want %v", sequence, added, !seen[sequence])
+				}
+				seen[sequence] = true
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("sequences = %v, want %v", got, test.want)
+			}
+			if got.size() != test.size {
+				t.Errorf("size() = %v, want %v", got.size(), test.size)
+			}
+		})
+	}
+}
+
+func TestSequencesUnion(t *testing.T) {
+	tests := []struct {
+		name string
+		a    sequences
+		b    sequences
+		want sequences
+	}{
+		{"disjoint", sequences{{1, 2}}, sequences{{5, 6}}, sequences{{1, 2}, {5, 6}}},
+		{"adjacent", sequences{{1, 2}}, sequences{{3, 4}}, sequences{{1, 4}}},
+		{"overlapping", sequences{{1, 5}}, sequences{{3, 8}}, sequences{{1, 8}}},
+		{"contained", sequences{{1, 10}}, sequences{{3, 4}}, sequences{{1, 10}}},
+		{"empty", nil, sequences{{2, 3}}, sequences{{2, 3}}},
+	}
+	for _, test := range tests {
+		if got := test.a.union(test.b); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: union() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestStreamTrackerComplete(t *testing.T) {
+	type processed struct {
+		consumer string
+		producer string
+		sequence int
+	}
+	tests := []struct {
+		name      string
+		announced map[string]int
+		processed []processed
+		want      bool
+	}{
+		{
+			name:      "every message processed",
+			announced: map[string]int{"a": 2, "b": 1},
+			processed: []processed{{"c1", "a", 1}, {"c2", "a", 2}, {"c1", "b", 1}},
+			want:      true,
+		},
+		{
+			name:      "producer not ended",
+			announced: map[string]int{"a": 2},
+			processed: []processed{{"c1", "a", 1}, {"c2", "a", 2}},
+		},
+		{
+			name:      "message redelivered to the same consumer",
+			announced: map[string]int{"a": 2, "b": 0},
+			processed: []processed{{"c1", "a", 1}, {"c1", "a", 1}},
+		},
+		{
+			name:      "message redelivered to another consumer",
+			announced: map[string]int{"a": 2, "b": 0},
+			processed: []processed{{"c1", "a", 1}, {"c2", "a", 1}},
+		},
+		{
+			name:      "redelivered messages along with every other one",
+			announced: map[string]int{"a": 3, "b": 0},
+			processed: []processed{{"c1", "a", 1}, {"c2", "a", 1}, {"c2", "a", 2}, {"c1", "a", 3}, {"c1", "a", 2}},
+			want:      true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newStreamTracker([]string{"a", "b"}, 0)
+			for producer, count := range test.announced {
+				tracker.announce(producer, count)
+			}
+			for _, message := range test.processed {
+				tracker.process(message.consumer, message.producer, message.sequence)
+			}
+			if got := tracker.complete(); got != test.want {
+				t.Errorf("complete() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStreamTrackerReport(t *testing.T) {
+	local := newStreamTracker(nil, 1)
+	remote := newStreamTracker(nil, 1)
+	local.announce("a", 3)
+	remote.process("c2", "a", 1)
+	remote.process("c2", "a", 2)
+	progress := remote.progress("c2")
+	remote.process("c2", "a", 3)
+
+	// the latest report arrives before an older one
+	local.report("c2", remote.progress("c2"))
+	local.report("c2", progress)
+	if !local.complete() {
+		t.Errorf("complete() = false after out of order reports, want true")
+	}
+	if got := local.progress("c2")["a"]; !reflect.DeepEqual(got, sequences{{1, 3}}) {
+		t.Errorf("progress = %v, want [[1 3]]", got)
+	}
+}
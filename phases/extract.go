@@ -1,41 +1,166 @@
 package phases
 
 import (
+	"context"
 	"fmt"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/ezeriver94/gotransform/common"
 	"github.com/ezeriver94/gotransform/data"
+	"github.com/ezeriver94/gotransform/state"
 )
 
 // Extractor parses all the primary datasources and streams every row into the channel
 type Extractor struct {
-	metadata *common.Metadata
+	metadata   *common.Metadata
+	watermarks state.Store
+	highest    map[string]interface{}
+	sync       *sync.Mutex
 }
 
-// NewExtractor creates an extractor using the passed metadata
-func NewExtractor(metadata *common.Metadata) (Extractor, error) {
+// NewExtractor creates an extractor using the passed metadata; watermarks of incremental datasources are read from and committed to the store
+func NewExtractor(metadata *common.Metadata, watermarks state.Store) (Extractor, error) {
+	for name, dataSource := range metadata.Extract.PrimaryDataSources {
+		if dataSource.Watermark == "" {
+			continue
+		}
+		if _, err := dataSource.Fields.Find(dataSource.Watermark); err != nil {
+			return Extractor{}, fmt.Errorf("invalid watermark on primary datasource %v: %v", name, err)
+		}
+		if watermarks == nil {
+			return Extractor{}, fmt.Errorf("primary datasource %v has a watermark but no state store was provided", name)
+		}
+	}
 	return Extractor{
-		metadata: metadata,
+		metadata:   metadata,
+		watermarks: watermarks,
+		highest:    make(map[string]interface{}),
+		sync:       &sync.Mutex{},
 	}, nil
 }
 
+func watermarkKey(dataSourceName string) string {
+	return fmt.Sprintf("watermark:%v", dataSourceName)
+}
+
 // Extract reads every record of a dataSource and streams it into the records channel
 func (e *Extractor) Extract(dataSourceName string, records chan<- common.Record) error {
+	return e.ExtractContext(context.Background(), dataSourceName, records)
+}
+
+// ExtractContext extracts like Extract until ctx is done, stopping the stream of the datasource and returning the error
+// of ctx; the watermark of a stopped datasource does not move
+func (e *Extractor) ExtractContext(ctx context.Context, dataSourceName string, records chan<- common.Record) error {
 	dataSource, ok := e.metadata.Extract.PrimaryDataSources[dataSourceName]
 	if !ok {
 		return fmt.Errorf("missing primary datasource %v on extract metadata", dataSourceName)
 	}
-	accessor := data.NewDataAccessor(dataSource.AccessorURL, dataSourceName)
+	accessor := data.NewDataAccessor(dataSource.AccessorURL, dataSourceName, nil)
 
 	request := data.NewRequest(nil)
+	if dataSource.Watermark != "" {
+		value, found, err := e.watermarks.Get(watermarkKey(dataSourceName))
+		if err != nil {
+			return fmt.Errorf("error reading watermark of datasource %v: %v", dataSourceName, err)
+		}
+		if found {
+			log.Infof("extracting datasource %v from %v greater than %v", dataSourceName, dataSource.Watermark, value)
+			request.Watermark = &data.Watermark{
+				Field: dataSource.Watermark,
+				Value: value,
+			}
+		}
+	}
 
-	err := accessor.Stream(records, request)
+	buffer := make(chan common.Record)
+	forwarded := make(chan struct{})
+	var highest interface{}
+	go func() {
+		defer close(forwarded)
+		for record := range buffer {
+			highest = track(dataSource, &record, highest)
+			records <- record
+		}
+	}()
+
+	err := accessor.StreamContext(ctx, buffer, request)
+	close(buffer)
+	<-forwarded
+	if err != nil && err == ctx.Err() {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("error streaming datasource %v: %v", dataSourceName, err)
 	}
+	if highest != nil {
+		// watermarks only move once the whole stream was read, so a failed stream is extracted again from where it began
+		e.sync.Lock()
+		if current, ok := e.highest[dataSourceName]; !ok || common.CompareValues(highest, current) > 0 {
+			e.highest[dataSourceName] = highest
+		}
+		e.sync.Unlock()
+	}
 	log.Infof("extraction for datasource %v finished successfully", dataSourceName)
 	return nil
 
 }
+
+// track returns the highest of the watermark field of a record and the highest value seen so far
+func track(dataSource common.DataEndpoint, record *common.Record, highest interface{}) interface{} {
+	if dataSource.Watermark == "" {
+		return highest
+	}
+	index := 0
+	for i, field := range dataSource.Fields {
+		if field.Name == dataSource.Watermark {
+			index = i
+			break
+		}
+	}
+	value, err := record.TryGet(dataSource.Watermark, index)
+	if err != nil || value == nil {
+		log.Warnf(record.Log("cannot read watermark field %v: %v", dataSource.Watermark, err))
+		return highest
+	}
+	if highest == nil || common.CompareValues(value, highest) > 0 {
+		return value
+	}
+	return highest
+}
+
+// CommitWatermarks stores the highest watermark value extracted of every datasource; it must be called only after a successful run
+func (e *Extractor) CommitWatermarks() error {
+	e.sync.Lock()
+	defer e.sync.Unlock()
+	for dataSourceName, value := range e.highest {
+		if err := e.watermarks.Set(watermarkKey(dataSourceName), value); err != nil {
+			return fmt.Errorf("error committing watermark of datasource %v: %v", dataSourceName, err)
+		}
+		log.Infof("committed watermark %v for datasource %v", value, dataSourceName)
+	}
+	return nil
+}
+
+// ResetWatermark removes the stored watermark of a datasource, so the next extraction reads it entirely
+func (e *Extractor) ResetWatermark(dataSourceName string) error {
+	if e.watermarks == nil {
+		return fmt.Errorf("cannot change watermark of datasource %v without a state store", dataSourceName)
+	}
+	if _, ok := e.metadata.Extract.PrimaryDataSources[dataSourceName]; !ok {
+		return fmt.Errorf("missing primary datasource %v on extract metadata", dataSourceName)
+	}
+	return e.watermarks.Delete(watermarkKey(dataSourceName))
+}
+
+// OverrideWatermark replaces the stored watermark of a datasource with the given value
+func (e *Extractor) OverrideWatermark(dataSourceName string, value interface{}) error {
+	if e.watermarks == nil {
+		return fmt.Errorf("cannot change watermark of datasource %v without a state store", dataSourceName)
+	}
+	if _, ok := e.metadata.Extract.PrimaryDataSources[dataSourceName]; !ok {
+		return fmt.Errorf("missing primary datasource %v on extract metadata", dataSourceName)
+	}
+	return e.watermarks.Set(watermarkKey(dataSourceName), value)
+}
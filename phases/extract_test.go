@@ -0,0 +1,106 @@
+package phases
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/ezeriver94/gotransform/common"
+	"github.com/ezeriver94/gotransform/state"
+)
+
+// recordServer streams records with the given ids through a websocket, ending the stream with a normal closure, or
+// dropping the connection when drop is set
+func recordServer(t *testing.T, ids []int, drop bool) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("error upgrading connection: %v", err)
+			return
+		}
+		defer c.Close()
+		if _, _, err := c.ReadMessage(); err != nil {
+			t.Errorf("error reading request: %v", err)
+			return
+		}
+		for _, id := range ids {
+			record := common.NewRecord(false)
+			record.Set("id", id)
+			if err := c.WriteJSON(record); err != nil {
+				t.Errorf("error writing record: %v", err)
+				return
+			}
+		}
+		if !drop {
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			c.ReadMessage()
+		}
+	}))
+}
+
+func TestExtractorWatermarks(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     []int
+		drop    bool
+		wantErr bool
+		want    interface{}
+	}{
+		{"clean stream commits its highest value", []int{3, 7, 5}, false, false, float64(7)},
+		{"failed stream keeps the previous watermark", []int{3, 7, 5}, true, true, float64(1)},
+		{"empty stream keeps the previous watermark", nil, false, false, float64(1)},
+	}
+	for _, test := range tests {
+		name := "customers"
+		t.Run(test.name, func(t *testing.T) {
+			server := recordServer(t, test.ids, test.drop)
+			defer server.Close()
+			dir, err := ioutil.TempDir("", "watermarks")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			store, err := state.NewFileStore(filepath.Join(dir, "state.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Set(watermarkKey(name), float64(1)); err != nil {
+				t.Fatal(err)
+			}
+			metadata := &common.Metadata{Extract: common.Extract{PrimaryDataSources: map[string]common.DataEndpoint{
+				name: {
+					AccessorURL: strings.TrimPrefix(server.URL, "http://"),
+					Fields:      common.Fields{{Name: "id"}},
+					Watermark:   "id",
+				},
+			}}}
+			extractor, err := NewExtractor(metadata, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records := make(chan common.Record, len(test.ids))
+			err = extractor.Extract(name, records)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Extract() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err := extractor.CommitWatermarks(); err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := store.Get(watermarkKey(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("watermark = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
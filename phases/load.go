@@ -1,6 +1,7 @@
 package phases
 
 import (
+	"fmt"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
@@ -9,55 +10,202 @@ import (
 	"github.com/ezeriver94/gotransform/data"
 )
 
+// QualityCheck validates the output of a load target, given the amount of records saved into it, before it is published
+type QualityCheck func(target string, saved int) error
+
+// MinRecords is a QualityCheck failing the load targets that received fewer than min records
+func MinRecords(min int) QualityCheck {
+	return func(target string, saved int) error {
+		if saved < min {
+			return fmt.Errorf("%v records saved, expected at least %v", saved, min)
+		}
+		return nil
+	}
+}
+
 // Loader handles loading data to a destination
 type Loader struct {
 	metadata  *common.Metadata
-	records   map[string]chan common.Record
-	wait      sync.WaitGroup
-	accessors map[string]data.DataAccessor
+	runID     string
+	providers map[string]data.DataProvider
+	closed    map[string]bool
+	saved     map[string]int
+	checks    []QualityCheck
+	sync      sync.Mutex
 }
 
-// NewLoader creates a loader using the passed metadata
-func NewLoader(metadata *common.Metadata) (Loader, error) {
+// NewLoader creates a loader using the passed metadata for the run identified by runID
+func NewLoader(metadata *common.Metadata, runID string) (Loader, error) {
 	return Loader{
 		metadata:  metadata,
-		records:   make(map[string]chan common.Record),
-		wait:      sync.WaitGroup{},
-		accessors: make(map[string]data.DataAccessor),
+		runID:     runID,
+		providers: make(map[string]data.DataProvider),
+		closed:    make(map[string]bool),
+		saved:     make(map[string]int),
+		checks:    make([]QualityCheck, 0),
+		sync:      sync.Mutex{},
 	}, nil
 }
 
-// Initialize begins the saving of every provider that acts as a destination
+// AddCheck registers a quality check that every load target must pass before it is closed and its staged output is
+// published; targets that fail it are discarded, so only the records written directly into a destination, as on non
+// staged append and truncate-insert files, are kept
+func (l *Loader) AddCheck(check QualityCheck) {
+	l.checks = append(l.checks, check)
+}
+
+// Initialize begins the saving of every provider that acts as a destination; when any of them fails, the ones already
+// connected are discarded
 func (l *Loader) Initialize() error {
+	if err := l.initialize(); err != nil {
+		l.discard()
+		l.providers = make(map[string]data.DataProvider)
+		return err
+	}
+	return nil
+}
+
+func (l *Loader) initialize() error {
 	for key, target := range l.metadata.Load {
-		accessor := data.NewDataAccessor(target.DataEndpoint.AccessorURL, key)
+		if err := target.ValidateKeys(); err != nil {
+			return fmt.Errorf("error on load target %v: %v", key, err)
+		}
+		if err := target.ValidateMode(); err != nil {
+			return fmt.Errorf("error on load target %v: %v", key, err)
+		}
+		provider, err := data.NewDataDestination(key, target, l.runID)
+		if err != nil {
+			return err
+		}
+		if _, ok := provider.(data.StagedProvider); target.Staged && !ok {
+			return fmt.Errorf("load target %v does not support staged loads", key)
+		}
+		if err := provider.Connect(data.ConenctionModeWrite); err != nil {
+			if discardable, ok := provider.(data.DiscardableProvider); ok {
+				// drops what a partial connect opened, as a started transaction or a created staging table
+				discardable.Discard()
+			} else {
+				provider.Close()
+			}
+			return fmt.Errorf("error connecting to load target %v: %v", key, err)
+		}
+
+		l.providers[key] = provider
+	}
+	return nil
+}
 
-		l.accessors[key] = accessor
-		if _, ok := l.records[target.TransformationName]; !ok {
-			l.records[target.TransformationName] = make(chan common.Record)
+// Load the transformed data to every data endpoint that receives its transformation
+func (l *Loader) Load(record Transformed) error {
+	for key, target := range l.metadata.Load {
+		if target.TransformationName != record.TransformationName {
+			continue
+		}
+		provider := l.providers[key]
+		if err := provider.Save(record.Record); err != nil {
+			return fmt.Errorf("error loading record to %v: %v", key, err)
 		}
-		l.wait.Add(1)
+		l.sync.Lock()
+		l.saved[key]++
+		l.sync.Unlock()
 	}
 	return nil
 }
 
-// Load the transformed data to a data endpoint
-func (l *Loader) Load(record Transformed) {
-	accessor, _ := l.accessors[record.TransformationName]
-	accessor.Save(record.Record)
+// Saved returns the amount of records saved into every load target
+func (l *Loader) Saved() map[string]int {
+	l.sync.Lock()
+	defer l.sync.Unlock()
+	result := make(map[string]int, len(l.saved))
+	for key, saved := range l.saved {
+		result[key] = saved
+	}
+	return result
 }
 
-// Finish closes the loading channels and wait for every provider to finish writing
+// Finish runs every quality check before closing the providers, since closing targets that are not staged commits their
+// output; once the checks pass and every provider is closed, the output of staged targets is published, otherwise
+// every output is discarded
 func (l *Loader) Finish() error {
+	if err := l.check(); err != nil {
+		l.discard()
+		return err
+	}
+	var result error
+	for key, provider := range l.providers {
+		l.closed[key] = true
+		if err := provider.Close(); err != nil {
+			log.Errorf("error closing load target %v: %v", key, err)
+			if result == nil {
+				result = fmt.Errorf("error closing load target %v: %v", key, err)
+			}
+		}
+	}
+	if result != nil {
+		l.discard()
+		return result
+	}
 
-	transformations := make(map[string]interface{}, len(l.metadata.Load))
-	for _, target := range l.metadata.Load {
-		transformationName := target.TransformationName
-		if _, ok := transformations[transformationName]; !ok {
-			log.Infof("closing channel for transformation %v", transformationName)
-			close(l.records[transformationName])
-			transformations[transformationName] = nil
+	for key, provider := range l.providers {
+		if staged, ok := provider.(data.StagedProvider); ok && l.metadata.Load[key].Staged {
+			if err := staged.Publish(); err != nil {
+				log.Errorf("error publishing load target %v: %v", key, err)
+				if result == nil {
+					result = fmt.Errorf("error publishing load target %v: %v", key, err)
+				}
+				continue
+			}
+			log.Infof("published staged output of load target %v", key)
+		}
+	}
+	return result
+}
+
+// check runs every quality check over every load target
+func (l *Loader) check() error {
+	for key := range l.metadata.Load {
+		for _, check := range l.checks {
+			if err := check(key, l.saved[key]); err != nil {
+				return fmt.Errorf("load target %v failed quality check: %v", key, err)
+			}
 		}
 	}
 	return nil
 }
+
+// Abort discards every output that was not written directly into its destination
+func (l *Loader) Abort() error {
+	return l.discard()
+}
+
+// discard removes the staged and temporary output of every target able to do it; the other targets are closed, so their
+// connections and files are released, even though whatever they received stays written
+func (l *Loader) discard() error {
+	var result error
+	for key, provider := range l.providers {
+		discardable, ok := provider.(data.DiscardableProvider)
+		if !ok {
+			if l.closed[key] {
+				continue
+			}
+			l.closed[key] = true
+			log.Warnf("output of load target %v cannot be discarded; closing it", key)
+			if err := provider.Close(); err != nil {
+				log.Errorf("error closing load target %v: %v", key, err)
+				if result == nil {
+					result = fmt.Errorf("error closing load target %v: %v", key, err)
+				}
+			}
+			continue
+		}
+		if err := discardable.Discard(); err != nil {
+			log.Errorf("error discarding output of load target %v: %v", key, err)
+			if result == nil {
+				result = fmt.Errorf("error discarding output of load target %v: %v", key, err)
+			}
+			continue
+		}
+		log.Infof("discarded output of load target %v", key)
+	}
+	return result
+}
@@ -0,0 +1,266 @@
+package phases
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ezeriver94/gotransform/common"
+	"github.com/ezeriver94/gotransform/data"
+)
+
+// fileTarget is a staged file load target of the records of the customers transformation
+func fileTarget(path string) common.DataDestination {
+	return common.DataDestination{
+		DataEndpoint: common.DataEndpoint{
+			Driver:           "file",
+			ConnectionString: path,
+			Fields:           common.Fields{{Name: "id", MaxLength: 10, EndCharacter: ";"}},
+		},
+		TransformationName: "customers",
+		Mode:               common.WriteModeReplace,
+		Staged:             true,
+	}
+}
+
+func TestLoaderStagedFinish(t *testing.T) {
+	tests := []struct {
+		name        string
+		records     int
+		minRecords  int
+		abort       bool
+		wantErr     bool
+		wantContent string
+	}{
+		{"checks pass", 2, 2, false, false, "1;\n2;\n"},
+		{"failed check discards", 1, 2, false, true, "previous;\n"},
+		{"abort discards", 2, 0, true, false, "previous;\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "load")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "customers.txt")
+			if err := ioutil.WriteFile(path, []byte("previous;\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			metadata := &common.Metadata{Load: map[string]common.DataDestination{"customers": fileTarget(path)}}
+			loader, err := NewLoader(metadata, "run")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.minRecords > 0 {
+				loader.AddCheck(MinRecords(test.minRecords))
+			}
+			if err := loader.Initialize(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= test.records; i++ {
+				record := common.NewRecord(false)
+				record.Set("id", i)
+				if err := loader.Load(Transformed{TransformationName: "customers", Record: record}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.abort {
+				err = loader.Abort()
+			} else {
+				err = loader.Finish()
+			}
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, test.wantErr)
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != test.wantContent {
+				t.Errorf("content = %q, want %q", content, test.wantContent)
+			}
+			if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+				t.Errorf("%v files left in the directory of the target, want only the target", len(files))
+			}
+		})
+	}
+}
+
+func TestLoaderInitializeFailureDiscards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	broken := fileTarget(filepath.Join(dir, "missing", "orders.txt"))
+	metadata := &common.Metadata{Load: map[string]common.DataDestination{
+		"customers": fileTarget(filepath.Join(dir, "customers.txt")),
+		"orders":    broken,
+	}}
+	for i := 0; i < 5; i++ {
+		// targets are initialized in map order, so the failing one comes first on some attempts
+		loader, err := NewLoader(metadata, "run")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := loader.Initialize(); err == nil {
+			t.Fatal("Initialize() with a target in a missing directory returned no error")
+		}
+		if len(loader.providers) != 0 {
+			t.Errorf("Initialize() kept %v providers after failing", len(loader.providers))
+		}
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Errorf("Initialize() left %v files after failing", len(files))
+		}
+	}
+}
+
+func TestLoaderAbortRollsBackAccessorLoads(t *testing.T) {
+	var (
+		paths []string
+		lock  sync.Mutex
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		paths = append(paths, r.URL.Path)
+		lock.Unlock()
+	}))
+	defer server.Close()
+	metadata := &common.Metadata{Load: map[string]common.DataDestination{"customers": {
+		DataEndpoint:       common.DataEndpoint{AccessorURL: strings.TrimPrefix(server.URL, "http://")},
+		TransformationName: "customers",
+		Mode:               common.WriteModeReplace,
+	}}}
+	loader, err := NewLoader(metadata, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(paths, " "); got != "/begin /rollback" {
+		t.Errorf("accessor service received %v, want /begin /rollback", got)
+	}
+}
+
+func TestLoaderFailedCheckBeforeClosing(t *testing.T) {
+	tests := []struct {
+		name       string
+		minRecords int
+		wantErr    bool
+		wantPaths  string
+	}{
+		{name: "checks pass", minRecords: 1, wantPaths: "/begin /save /commit"},
+		{name: "failed check rolls back", minRecords: 2, wantErr: true, wantPaths: "/begin /save /rollback"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				paths []string
+				lock  sync.Mutex
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				paths = append(paths, r.URL.Path)
+				lock.Unlock()
+			}))
+			defer server.Close()
+			target := accessorTarget(server)
+			target.Mode = common.WriteModeReplace
+			metadata := &common.Metadata{Load: map[string]common.DataDestination{"customers": target}}
+			loader, err := NewLoader(metadata, "run")
+			if err != nil {
+				t.Fatal(err)
+			}
+			loader.AddCheck(MinRecords(test.minRecords))
+			if err := loader.Initialize(); err != nil {
+				t.Fatal(err)
+			}
+			record := common.NewRecord(false)
+			record.Set("id", 1)
+			if err := loader.Load(Transformed{TransformationName: "customers", Record: record}); err != nil {
+				t.Fatal(err)
+			}
+			if err := loader.Finish(); (err != nil) != test.wantErr {
+				t.Fatalf("Finish() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if got := strings.Join(paths, " "); got != test.wantPaths {
+				t.Errorf("accessor service received %v, want %v", got, test.wantPaths)
+			}
+		})
+	}
+}
+
+// closingProvider is a load target that cannot discard its output, counting how many times it is closed
+type closingProvider struct {
+	closed *int32
+}
+
+func (p closingProvider) Connect(connectionMode data.ConnectionMode) error {
+	return nil
+}
+
+func (p closingProvider) Fetch(r data.Request) (*common.Record, error) {
+	return nil, nil
+}
+
+func (p closingProvider) Stream(buffer chan<- common.Record, r data.Request) error {
+	return nil
+}
+
+func (p closingProvider) Save(r common.Record) error {
+	return nil
+}
+
+func (p closingProvider) Close() error {
+	atomic.AddInt32(p.closed, 1)
+	return nil
+}
+
+func TestLoaderClosesTargetsThatCannotDiscard(t *testing.T) {
+	var closed int32
+	data.RegisterDriver("closing", func(name string, destination common.DataDestination) (data.DataProvider, error) {
+		return closingProvider{closed: &closed}, nil
+	})
+	tests := []struct {
+		name   string
+		finish func(*Loader) error
+	}{
+		{name: "abort", finish: (*Loader).Abort},
+		{name: "failed check", finish: func(l *Loader) error {
+			l.AddCheck(MinRecords(1))
+			return l.Finish()
+		}},
+		{name: "finish", finish: (*Loader).Finish},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt32(&closed, 0)
+			metadata := &common.Metadata{Load: map[string]common.DataDestination{"customers": {
+				DataEndpoint:       common.DataEndpoint{Driver: "closing"},
+				TransformationName: "customers",
+			}}}
+			loader, err := NewLoader(metadata, "run")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := loader.Initialize(); err != nil {
+				t.Fatal(err)
+			}
+			test.finish(&loader)
+			if got := atomic.LoadInt32(&closed); got != 1 {
+				t.Errorf("target closed %v times, want 1", got)
+			}
+		})
+	}
+}
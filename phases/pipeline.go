@@ -0,0 +1,208 @@
+package phases
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/beevik/guid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/cache"
+	"github.com/ezeriver94/gotransform/common"
+	"github.com/ezeriver94/gotransform/state"
+)
+
+// Pipeline runs every phase of a job within a single process
+type Pipeline struct {
+	RunID       string
+	metadata    *common.Metadata
+	Extractor   *Extractor
+	Transformer *Transformer
+	Loader      *Loader
+	started     time.Time
+	finished    time.Time
+	extracted   map[string]int
+	cacheStats  map[string]cache.Stats
+	failed      error
+	sync        sync.Mutex
+}
+
+// NewPipeline creates a pipeline using the passed metadata, the store for its persistent state and the cache for join lookups,
+// identified by runID; an empty runID is replaced by a random one
+func NewPipeline(metadata *common.Metadata, store state.Store, c cache.Cache, runID string) (*Pipeline, error) {
+	extractor, err := NewExtractor(metadata, store)
+	if err != nil {
+		return nil, fmt.Errorf("error creating extractor: %v", err)
+	}
+	if runID == "" {
+		runID = guid.New().String()
+	}
+	transformer, err := NewTransformer(metadata, c, runID)
+	if err != nil {
+		return nil, fmt.Errorf("error creating transformer: %v", err)
+	}
+	loader, err := NewLoader(metadata, runID)
+	if err != nil {
+		return nil, fmt.Errorf("error creating loader: %v", err)
+	}
+	return &Pipeline{
+		RunID:       runID,
+		metadata:    metadata,
+		Extractor:   &extractor,
+		Transformer: &transformer,
+		Loader:      &loader,
+		extracted:   make(map[string]int),
+	}, nil
+}
+
+// Run preloads the additional datasources that ask for it, extracts every primary datasource, transforms its records and
+// loads them; watermarks are committed only if every phase succeeded
+func (p *Pipeline) Run() error {
+	p.begin()
+	err := p.run()
+	p.end(err)
+	return err
+}
+
+func (p *Pipeline) run() error {
+	if err := p.Transformer.Preload(); err != nil {
+		return err
+	}
+	if err := p.Loader.Initialize(); err != nil {
+		return fmt.Errorf("error initializing loader: %v", err)
+	}
+
+	if failed := p.processAll(0, p.Loader.Load); failed != nil {
+		if err := p.Loader.Abort(); err != nil {
+			log.Errorf("error aborting loader: %v", err)
+		}
+		return failed
+	}
+	if err := p.Loader.Finish(); err != nil {
+		return fmt.Errorf("error finishing loader: %v", err)
+	}
+	return p.Extractor.CommitWatermarks()
+}
+
+// Warm populates the cache with the join lookups of the first sample records of every primary datasource, transforming
+// them without loading them nor committing watermarks; the stream of every datasource is stopped once its sample is read.
+// Preloaded datasources are not preloaded, so their lookups are cached too. A sample of zero or less warms with every record
+func (p *Pipeline) Warm(sample int) error {
+	p.begin()
+	err := p.processAll(sample, func(Transformed) error { return nil })
+	p.end(err)
+	return err
+}
+
+// begin resets the counters of the pipeline before a run; cache stats are counted by the whole process, so the ones seen
+// when the run begins are kept to report only what changed during it
+func (p *Pipeline) begin() {
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	p.started = time.Now()
+	p.finished = time.Time{}
+	p.extracted = make(map[string]int)
+	p.cacheStats = cache.Statistics()
+	p.failed = nil
+}
+
+// end records the outcome of a run
+func (p *Pipeline) end(err error) {
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	p.finished = time.Now()
+	p.failed = err
+}
+
+// processAll processes every primary datasource concurrently, returning the first error found
+func (p *Pipeline) processAll(sample int, handle func(Transformed) error) error {
+	errs := make(chan error, len(p.metadata.Extract.PrimaryDataSources))
+	wait := sync.WaitGroup{}
+	for dataSourceName := range p.metadata.Extract.PrimaryDataSources {
+		wait.Add(1)
+		go func(dataSourceName string) {
+			defer wait.Done()
+			errs <- p.process(dataSourceName, sample, handle)
+		}(dataSourceName)
+	}
+	wait.Wait()
+	close(errs)
+
+	var failed error
+	for err := range errs {
+		if err != nil {
+			log.Errorf("%v", err)
+			if failed == nil {
+				failed = err
+			}
+		}
+	}
+	return failed
+}
+
+// process runs every transformation that reads from a primary datasource over each one of its first sample records, or
+// all of them if sample is not positive, and hands the results to handle; the extraction is stopped once the sample is
+// read or a record fails
+func (p *Pipeline) process(dataSourceName string, sample int, handle func(Transformed) error) error {
+	dataSource := p.metadata.Extract.PrimaryDataSources[dataSourceName]
+	transformations := make([]string, 0)
+	for name, transformation := range p.metadata.Transform {
+		if transformation.From == dataSourceName {
+			transformations = append(transformations, name)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	records := make(chan common.Record)
+	extracted := make(chan error, 1)
+	go func() {
+		defer close(records)
+		extracted <- p.Extractor.ExtractContext(ctx, dataSourceName, records)
+	}()
+
+	var (
+		failed error
+		count  int
+	)
+	for record := range records {
+		if failed != nil || (sample > 0 && count >= sample) {
+			// the extraction was stopped; drain what was already sent
+			continue
+		}
+		count++
+		if sample > 0 && count >= sample {
+			cancel()
+		}
+		p.sync.Lock()
+		p.extracted[dataSourceName]++
+		p.sync.Unlock()
+		if err := dataSource.Validate(&record); err != nil {
+			failed = fmt.Errorf("error validating record of datasource %v: %v", dataSourceName, err)
+			cancel()
+			continue
+		}
+		for _, transformationName := range transformations {
+			transformed, err := p.Transformer.Transform(transformationName, &record)
+			if err != nil {
+				failed = fmt.Errorf("error applying transformation %v: %v", transformationName, err)
+				cancel()
+				break
+			}
+			if err := handle(*transformed); err != nil {
+				failed = err
+				cancel()
+				break
+			}
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	if err := <-extracted; err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
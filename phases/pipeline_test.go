@@ -0,0 +1,94 @@
+package phases
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ezeriver94/gotransform/cache"
+	"github.com/ezeriver94/gotransform/common"
+)
+
+func TestPipelineWarmSample(t *testing.T) {
+	tests := []struct {
+		name        string
+		total       int
+		sample      int
+		wantCount   int
+		wantStopped bool
+	}{
+		{name: "sample of an endless datasource", total: -1, sample: 2, wantCount: 2, wantStopped: true},
+		{name: "sample bigger than the datasource", total: 3, sample: 10, wantCount: 3},
+		{name: "whole datasource", total: 5, sample: 0, wantCount: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			finished := make(chan bool, 1)
+			server := endlessServer(t, test.total, finished)
+			defer server.Close()
+			metadata := &common.Metadata{Extract: common.Extract{PrimaryDataSources: map[string]common.DataEndpoint{
+				"orders": {
+					AccessorURL: strings.TrimPrefix(server.URL, "http://"),
+					Fields:      common.Fields{{Name: "id", ExpectedType: "int"}},
+				},
+			}}}
+			pipeline, err := NewPipeline(metadata, nil, nil, "warm")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pipeline.Warm(test.sample); err != nil {
+				t.Fatalf("Warm() error = %v", err)
+			}
+			if got := pipeline.Report().Extracted["orders"]; got != test.wantCount {
+				t.Errorf("Warm() extracted %v records, want %v", got, test.wantCount)
+			}
+			select {
+			case stopped := <-finished:
+				if stopped != test.wantStopped {
+					t.Errorf("stream stopped = %v, want %v", stopped, test.wantStopped)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("stream kept running after Warm() returned")
+			}
+		})
+	}
+}
+
+func TestPipelineReportCacheStats(t *testing.T) {
+	metadata := &common.Metadata{Extract: common.Extract{AdditionalDataSources: map[string]common.DataEndpoint{
+		"report customers": {},
+	}}}
+	pipeline, err := NewPipeline(metadata, nil, nil, "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.NewMemoryCache(cache.DefaultMemorySize)
+	policy := cache.Policy{Source: "report customers"}
+	get := func() (interface{}, error) { return "value", nil }
+
+	tests := []struct {
+		name       string
+		keys       []string
+		wantHits   int64
+		wantMisses int64
+	}{
+		{name: "warm up", keys: []string{"a", "b"}, wantMisses: 2},
+		{name: "run after the warm up", keys: []string{"a", "b", "c"}, wantHits: 2, wantMisses: 1},
+		{name: "run without lookups"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pipeline.begin()
+			for _, key := range test.keys {
+				if _, err := cache.Retrieve(c, policy, key, get); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pipeline.end(nil)
+			stats := pipeline.Report().Cache["report customers"]
+			if stats.Hits != test.wantHits || stats.Misses != test.wantMisses {
+				t.Errorf("Report() cache stats = %+v, want %v hits and %v misses", stats, test.wantHits, test.wantMisses)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package phases
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/common"
+	"github.com/ezeriver94/gotransform/data"
+)
+
+const (
+	// DefaultPreloadLimit is the max amount of records of a preloaded datasource kept in memory when it sets no preloadlimit
+	DefaultPreloadLimit = 100000
+
+	// DefaultPreloadMaxBytes is the max amount of bytes of a preloaded datasource kept in memory when it sets no
+	// preloadmaxbytes; records are measured by their json encoding
+	DefaultPreloadMaxBytes = 256 << 20 // 256 MB
+)
+
+// lookupIndex answers the join lookups of a preloaded datasource from memory
+type lookupIndex struct {
+	entries map[string]*common.Record
+}
+
+// lookupKey identifies a set of field values; names are sorted so it does not depend on the order of the filters
+func lookupKey(values map[string]interface{}) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+common.FieldToString(values[name]))
+	}
+	return strings.Join(parts, "\x1f")
+}
+
+// lookup returns the record matching every filter, or an empty record if there is none
+func (li *lookupIndex) lookup(filters map[string]interface{}) *common.Record {
+	if found, ok := li.entries[lookupKey(filters)]; ok {
+		return found
+	}
+	result := common.NewRecord(false)
+	return &result
+}
+
+// joinFields returns every set of fields of a datasource used by the OnClauses of the joins that target it
+func (t *Transformer) joinFields(dataSourceName string) ([][]string, error) {
+	result := make([][]string, 0)
+	seen := make(map[string]bool)
+	for _, transformation := range t.metadata.Transform {
+		for _, join := range transformation.Joins {
+			if join.To != dataSourceName {
+				continue
+			}
+			fields := make([]string, 0, len(join.On))
+			for _, onClause := range join.On {
+				source, target, err := onClause.Parse()
+				if err != nil {
+					return nil, err
+				}
+				sourceName, sourceField, err := source.Parse()
+				if err != nil {
+					return nil, err
+				}
+				_, targetField, err := target.Parse()
+				if err != nil {
+					return nil, err
+				}
+				if sourceName == join.To {
+					fields = append(fields, sourceField)
+				} else {
+					fields = append(fields, targetField)
+				}
+			}
+			sort.Strings(fields)
+			if signature := strings.Join(fields, ","); !seen[signature] {
+				seen[signature] = true
+				result = append(result, fields)
+			}
+		}
+	}
+	return result, nil
+}
+
+// Preload streams every additional datasource marked with preload into memory, indexed by the fields its joins use, so
+// lookups on it are answered locally. Datasources exceeding their preload limit keep using remote lookups
+func (t *Transformer) Preload() error {
+	for name, dataSource := range t.metadata.Extract.AdditionalDataSources {
+		if !dataSource.Preload {
+			continue
+		}
+		fieldSets, err := t.joinFields(name)
+		if err != nil {
+			return fmt.Errorf("error reading joins of datasource %v: %v", name, err)
+		}
+		if len(fieldSets) == 0 {
+			log.Warnf("datasource %v is marked for preload but no join uses it", name)
+			continue
+		}
+		index, err := t.preload(name, dataSource, fieldSets)
+		if err != nil {
+			return fmt.Errorf("error preloading datasource %v: %v", name, err)
+		}
+		if index == nil {
+			continue
+		}
+		t.sync.Lock()
+		t.indexes[name] = index
+		t.sync.Unlock()
+	}
+	return nil
+}
+
+// preload builds the index of a datasource, returning nil if it has more records or bytes than its limits; the stream is
+// stopped as soon as a limit is exceeded
+func (t *Transformer) preload(name string, dataSource common.DataEndpoint, fieldSets [][]string) (*lookupIndex, error) {
+	limit := dataSource.PreloadLimit
+	if limit <= 0 {
+		limit = DefaultPreloadLimit
+	}
+	maxBytes := dataSource.PreloadMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultPreloadMaxBytes
+	}
+	index := &lookupIndex{
+		entries: make(map[string]*common.Record),
+	}
+	accessor := data.NewDataAccessor(dataSource.AccessorURL, name, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	records := make(chan common.Record)
+	streamed := make(chan error, 1)
+	go func() {
+		defer close(records)
+		streamed <- accessor.StreamContext(ctx, records, data.NewRequest(nil))
+	}()
+
+	count := 0
+	var size int64
+	var failed error
+	for record := range records {
+		count++
+		if index == nil || failed != nil {
+			// the stream was stopped; drain what was already sent
+			continue
+		}
+		if count > limit {
+			log.Warnf("datasource %v has more than %v records; falling back to remote lookups", name, limit)
+			index = nil
+			cancel()
+			continue
+		}
+		record := record
+		if encoded, err := json.Marshal(record); err == nil {
+			size += int64(len(encoded))
+		}
+		if size > maxBytes {
+			log.Warnf("datasource %v uses more than %v bytes; falling back to remote lookups", name, maxBytes)
+			index = nil
+			cancel()
+			continue
+		}
+		if record.IsRaw() {
+			// raw records are validated to get their values by name
+			if err := dataSource.Validate(&record); err != nil {
+				failed = err
+				cancel()
+				continue
+			}
+		}
+		for _, fields := range fieldSets {
+			values := make(map[string]interface{}, len(fields))
+			for _, field := range fields {
+				value, err := record.Get(field)
+				if err != nil {
+					values = nil
+					break
+				}
+				values[field] = value
+			}
+			if values == nil {
+				continue
+			}
+			key := lookupKey(values)
+			if _, exists := index.entries[key]; !exists {
+				index.entries[key] = &record
+			}
+		}
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	if err := <-streamed; err != nil && err != context.Canceled {
+		return nil, err
+	}
+	if index != nil {
+		log.Infof("preloaded %v records of datasource %v", count, name)
+	}
+	return index, nil
+}
@@ -0,0 +1,104 @@
+package phases
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/ezeriver94/gotransform/common"
+)
+
+// endlessServer streams records through a websocket until total are sent, closing it normally, or forever when total is
+// negative; it reports on finished once the stream ends, whether the client stopped it or not
+func endlessServer(t *testing.T, total int, finished chan<- bool) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("error upgrading connection: %v", err)
+			return
+		}
+		defer c.Close()
+		if _, _, err := c.ReadMessage(); err != nil {
+			t.Errorf("error reading request: %v", err)
+			return
+		}
+		for i := 0; total < 0 || i < total; i++ {
+			record := common.NewRecord(false)
+			record.Set("id", i)
+			if err := c.WriteJSON(record); err != nil {
+				finished <- true
+				return
+			}
+		}
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		c.ReadMessage()
+		finished <- false
+	}))
+}
+
+func TestPreload(t *testing.T) {
+	tests := []struct {
+		name        string
+		total       int
+		limit       int
+		maxBytes    int64
+		wantEntries int
+		wantStopped bool
+	}{
+		{name: "whole datasource", total: 3, limit: 10, wantEntries: 3},
+		{name: "over record limit", total: -1, limit: 2, wantEntries: -1, wantStopped: true},
+		{name: "over byte limit", total: -1, maxBytes: 1024, wantEntries: -1, wantStopped: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			finished := make(chan bool, 1)
+			server := endlessServer(t, test.total, finished)
+			defer server.Close()
+			metadata := &common.Metadata{
+				Extract: common.Extract{AdditionalDataSources: map[string]common.DataEndpoint{
+					"customers": {
+						AccessorURL:     strings.TrimPrefix(server.URL, "http://"),
+						Fields:          common.Fields{{Name: "id"}},
+						Preload:         true,
+						PreloadLimit:    test.limit,
+						PreloadMaxBytes: test.maxBytes,
+					},
+				}},
+				Transform: map[string]common.DataTransformation{
+					"orders": {
+						From:  "orders",
+						Joins: map[string]common.Join{"customer": {To: "customers", On: []common.OnClause{"orders.customer=customers.id"}}},
+					},
+				},
+			}
+			transformer, err := NewTransformer(metadata, nil, "run")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := transformer.Preload(); err != nil {
+				t.Fatalf("Preload() error = %v", err)
+			}
+			index, found := transformer.indexes["customers"]
+			if test.wantEntries < 0 {
+				if found {
+					t.Errorf("Preload() indexed %v entries, want none", len(index.entries))
+				}
+			} else if !found || len(index.entries) != test.wantEntries {
+				t.Errorf("Preload() indexed %v, want %v entries", index, test.wantEntries)
+			}
+			select {
+			case stopped := <-finished:
+				if stopped != test.wantStopped {
+					t.Errorf("stream stopped = %v, want %v", stopped, test.wantStopped)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("stream kept running after Preload() returned")
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package phases
+
+import (
+	"time"
+
+	"github.com/ezeriver94/gotransform/cache"
+	"github.com/ezeriver94/gotransform/secrets"
+)
+
+// Report summarizes a run of a pipeline: how many records were extracted from every primary datasource, how many were saved
+// into every load target and how the cache behaved for the lookups of every additional datasource during the run
+type Report struct {
+	RunID     string                 `json:"runID"`
+	Started   time.Time              `json:"started"`
+	Finished  time.Time              `json:"finished"`
+	Error     string                 `json:"error,omitempty"`
+	Extracted map[string]int         `json:"extracted"`
+	Loaded    map[string]int         `json:"loaded"`
+	Cache     map[string]cache.Stats `json:"cache"`
+}
+
+// HitRatio returns the fraction of the lookups of a datasource answered by the cache
+func (r *Report) HitRatio(dataSourceName string) float64 {
+	stats := r.Cache[dataSourceName]
+	total := stats.Hits + stats.Misses + stats.Coalesced
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.Hits+stats.Coalesced) / float64(total)
+}
+
+// Report builds the report of the last run, or warm up, of the pipeline
+func (p *Pipeline) Report() Report {
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	result := Report{
+		RunID:     p.RunID,
+		Started:   p.started,
+		Finished:  p.finished,
+		Extracted: make(map[string]int, len(p.extracted)),
+		Loaded:    p.Loader.Saved(),
+		Cache:     make(map[string]cache.Stats),
+	}
+	if p.failed != nil {
+		result.Error = secrets.Redact(p.failed.Error())
+	}
+	for dataSourceName, extracted := range p.extracted {
+		result.Extracted[dataSourceName] = extracted
+	}
+	statistics := cache.Statistics()
+	for dataSourceName := range p.metadata.Extract.AdditionalDataSources {
+		if stats := statistics[dataSourceName].Since(p.cacheStats[dataSourceName]); stats != (cache.Stats{}) {
+			result.Cache[dataSourceName] = stats
+		}
+	}
+	return result
+}
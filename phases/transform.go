@@ -8,6 +8,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/ezeriver94/gotransform/cache"
 	"github.com/ezeriver94/gotransform/common"
 	"github.com/ezeriver94/gotransform/data"
 )
@@ -24,17 +25,48 @@ type Transformed struct {
 type Transformer struct {
 	metadata  *common.Metadata
 	accessors map[string]data.DataAccessor
+	indexes   map[string]*lookupIndex
+	cache     cache.Cache
+	runID     string
 	sync      sync.Mutex
 }
 
-// NewTransformer creates a transformer using the passed metadata
-func NewTransformer(metadata *common.Metadata) (Transformer, error) {
+// NewTransformer creates a transformer using the passed metadata, caching the records fetched by joins on c; the runID
+// scopes the cache of the datasources that use the run namespace
+func NewTransformer(metadata *common.Metadata, c cache.Cache, runID string) (Transformer, error) {
+	if c == nil {
+		c = cache.NewNoopCache()
+	}
 	return Transformer{
 		metadata:  metadata,
 		accessors: make(map[string]data.DataAccessor),
+		indexes:   make(map[string]*lookupIndex),
+		cache:     c,
+		runID:     runID,
 		sync:      sync.Mutex{},
 	}, nil
 }
+
+// cachePolicy builds the cache policy of an additional datasource from its settings, counting its lookups under its name
+func (t *Transformer) cachePolicy(dataSourceName string, dataSource common.DataEndpoint) cache.Policy {
+	if dataSource.Cache == nil {
+		return cache.Policy{Source: dataSourceName}
+	}
+	namespace := dataSource.Cache.Namespace
+	switch namespace {
+	case common.CacheNamespaceRun:
+		namespace = "run:" + t.runID
+	case common.CacheNamespaceVersion:
+		namespace = "version:" + t.metadata.Version
+	}
+	return cache.Policy{
+		Source:      dataSourceName,
+		TTL:         dataSource.Cache.TTL,
+		CacheMisses: dataSource.Cache.CacheMisses,
+		MissTTL:     dataSource.Cache.MissTTL,
+		Namespace:   namespace,
+	}
+}
 func (t *Transformer) join(
 	joins map[string]*common.Record,
 	transformation common.DataTransformation,
@@ -52,23 +84,18 @@ func (t *Transformer) join(
 		return &result, fmt.Errorf("join %v not found in metadata", dataSourceName)
 	}
 	targetJoinName := join.To
-	targetJoin, ok := t.metadata.Extract.AditionalDataSources[targetJoinName]
+	targetJoin, ok := t.metadata.Extract.AdditionalDataSources[targetJoinName]
 	if !ok {
 		return &result, fmt.Errorf("datasource %v not found in metadata", targetJoinName)
 	}
+	t.sync.Lock()
 	accessor, ok := t.accessors[targetJoinName]
-	var err error
 	if !ok {
-		accessor = data.NewDataAccessor(targetJoin.AccessorURL, targetJoinName)
-		if err != nil {
-			return &result, fmt.Errorf("error building dataProvider for %v: %v", targetJoin.Driver, err)
-		}
-		t.sync.Lock()
-		if _, ok := t.accessors[dataSourceName]; !ok {
-			t.accessors[dataSourceName] = accessor
-		}
-		t.sync.Unlock()
+		accessor = data.NewDataAccessor(targetJoin.AccessorURL, targetJoinName, t.cache)
+		accessor.CachePolicy = t.cachePolicy(targetJoinName, targetJoin)
+		t.accessors[targetJoinName] = accessor
 	}
+	t.sync.Unlock()
 	filters := make(map[string]interface{})
 	for _, onClause := range join.On {
 		source, target, err := onClause.Parse()
@@ -122,6 +149,13 @@ func (t *Transformer) join(
 			filters[field.Name] = data
 		}
 	}
+	t.sync.Lock()
+	index, preloaded := t.indexes[targetJoinName]
+	t.sync.Unlock()
+	if preloaded {
+		log.Debugf(record.Log("looking up %v on preloaded records using %v filters", join.To, common.PrettyPrint(filters)))
+		return index.lookup(filters), nil
+	}
 	log.Debugf(record.Log("trying to join %v using %v filters", join.To, common.PrettyPrint(filters)))
 	request := data.NewRequest(filters)
 	joinedRecord, err := accessor.Fetch(request)
@@ -140,6 +174,8 @@ func (t *Transformer) Transform(transformationName string, record *common.Record
 	}
 	joins := make(map[string]*common.Record)
 	fields := common.NewRecord(false)
+	fields.ID = record.ID
+	fields.Operation = record.Operation
 
 	keepLooking := true
 
@@ -5,18 +5,21 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/ezeriver94/gotransform/env"
+	"github.com/ezeriver94/gotransform/secrets"
 	"github.com/streadway/amqp"
 )
 
 // NewConnection builds a rabbitMq connection
 func NewConnection(host, user, pass string, port int, vhost string) (*amqp.Connection, error) {
 
+	secrets.Register(pass)
 	amqpURI := fmt.Sprintf("amqp://%v:%v@%v:%v/%v", user, pass, host, port, vhost)
-	log.Infof("dialing %q", amqpURI)
+	log.Infof("dialing %q", secrets.Redact(amqpURI))
 	connection, err := amqp.Dial(amqpURI)
 
 	if err != nil {
-		return nil, fmt.Errorf("Dial: %s", err)
+		return nil, fmt.Errorf("Dial: %s", secrets.Redact(err.Error()))
 	}
 
 	return connection, nil
@@ -38,3 +41,46 @@ func DeclareExchange(channel *amqp.Channel, exchange, exchangeType string) error
 	}
 	return nil
 }
+
+// connectionConfig holds the settings of a rabbitMq connection
+type connectionConfig struct {
+	Host     string `env:"RABBIT_HOST" required:"true"`
+	Port     int    `env:"RABBIT_PORT" default:"5672"`
+	User     string `env:"RABBIT_USER"`
+	Password string `env:"RABBIT_PASSWORD" secret:"true"`
+	VHost    string `env:"RABBIT_VHOST"`
+}
+
+// NewConnectionFromEnv builds a rabbitMq connection configured by the RABBIT_HOST, RABBIT_PORT, RABBIT_USER, RABBIT_PASSWORD
+// and RABBIT_VHOST envVars
+func NewConnectionFromEnv() (*amqp.Connection, error) {
+	config := connectionConfig{}
+	if err := env.Load(&config); err != nil {
+		return nil, fmt.Errorf("error configuring rabbitMq connection: %v", err)
+	}
+	return NewConnection(config.Host, config.User, config.Password, config.Port, config.VHost)
+}
+
+// DeclareQueue creates a durable queue bound to an exchange with a routing key
+func DeclareQueue(channel *amqp.Channel, exchange, queueName, key string) error {
+	if _, err := channel.QueueDeclare(
+		queueName, // name of the queue
+		true,      // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // noWait
+		nil,       // arguments
+	); err != nil {
+		return fmt.Errorf("Queue Declare: %s", err)
+	}
+	if err := channel.QueueBind(
+		queueName, // name of the queue
+		key,       // bindingKey
+		exchange,  // sourceExchange
+		false,     // noWait
+		nil,       // arguments
+	); err != nil {
+		return fmt.Errorf("Queue Bind: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,358 @@
+package rabbit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/beevik/guid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/broker"
+	"github.com/streadway/amqp"
+)
+
+// channelDeclarer declares the topology of a broker on a rabbitMq channel
+type channelDeclarer struct {
+	channel *amqp.Channel
+}
+
+func (d channelDeclarer) DeclareExchange(name, kind string) error {
+	return DeclareExchange(d.channel, name, kind)
+}
+
+func (d channelDeclarer) DeclareQueue(name string, options broker.QueueOptions) (string, error) {
+	log.Infof("declaring Queue %q", name)
+	queue, err := d.channel.QueueDeclare(
+		name,               // name of the queue
+		!options.Exclusive, // durable
+		options.Exclusive,  // delete when unused
+		options.Exclusive,  // exclusive
+		false,              // noWait
+		queueArguments(options),
+	)
+	if err != nil {
+		return "", fmt.Errorf("Queue Declare: %s", err)
+	}
+	log.Infof("declared Queue (%q %d messages, %d consumers)", queue.Name, queue.Messages, queue.Consumers)
+	return queue.Name, nil
+}
+
+func (d channelDeclarer) BindQueue(queue, exchange, key string) error {
+	log.Infof("binding Queue %q to Exchange %q (key %q)", queue, exchange, key)
+	if err := d.channel.QueueBind(
+		queue,    // name of the queue
+		key,      // bindingKey
+		exchange, // sourceExchange
+		false,    // noWait
+		nil,      // arguments
+	); err != nil {
+		return fmt.Errorf("Queue Bind: %s", err)
+	}
+	return nil
+}
+
+// queueArguments translates the options of a queue into the arguments rabbitMq declares it with
+func queueArguments(options broker.QueueOptions) amqp.Table {
+	if options.MessageTTL <= 0 && options.DeadLetterExchange == nil {
+		return nil
+	}
+	arguments := amqp.Table{}
+	if options.MessageTTL > 0 {
+		arguments["x-message-ttl"] = int64(options.MessageTTL / time.Millisecond)
+	}
+	if options.DeadLetterExchange != nil {
+		arguments["x-dead-letter-exchange"] = *options.DeadLetterExchange
+		if options.DeadLetterRoutingKey != "" {
+			arguments["x-dead-letter-routing-key"] = options.DeadLetterRoutingKey
+		}
+	}
+	return arguments
+}
+
+// acknowledger settles the deliveries of a rabbitMq channel one at a time
+type acknowledger struct {
+	acknowledger amqp.Acknowledger
+}
+
+func (a acknowledger) Ack(tag uint64) error {
+	return a.acknowledger.Ack(tag, false)
+}
+
+func (a acknowledger) Nack(tag uint64, requeue bool) error {
+	return a.acknowledger.Nack(tag, false, requeue)
+}
+
+// toDelivery adapts a rabbitMq delivery to the broker one, leaving out the headers the publisher adds for itself
+func toDelivery(delivery amqp.Delivery) broker.Delivery {
+	var headers map[string]interface{}
+	if delivery.Headers != nil {
+		headers = make(map[string]interface{}, len(delivery.Headers))
+		for key, value := range delivery.Headers {
+			if key != publishTagHeader {
+				headers[key] = value
+			}
+		}
+	}
+	return broker.Delivery{
+		Body:         delivery.Body,
+		Headers:      headers,
+		Exchange:     delivery.Exchange,
+		RoutingKey:   delivery.RoutingKey,
+		Redelivered:  delivery.Redelivered,
+		DeliveryTag:  delivery.DeliveryTag,
+		Acknowledger: acknowledger{acknowledger: delivery.Acknowledger},
+	}
+}
+
+// binding is the exchange and routing key a queue is bound with
+type binding struct {
+	exchange string
+	key      string
+}
+
+// Broker implements broker.Broker on rabbitMq. It declares and publishes through a connection of its own, and every
+// consumer opens its own connection with dial, so it can reconnect and declare its queue again; exclusive queues are
+// declared by their consumer, as they belong to its connection. When the connection of the broker is lost, it reconnects
+// with backoff and declares again every exchange, queue and binding; meanwhile, declarations and publishings wait for the
+// new connection
+type Broker struct {
+	dial              Dialer
+	connection        *amqp.Connection
+	channel           *amqp.Channel
+	publisher         *Publisher
+	exchanges         map[string]string
+	queues            map[string]broker.QueueOptions
+	bindings          map[string]binding
+	connected         chan struct{}
+	closed            chan struct{}
+	closing           bool
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	sync              sync.Mutex
+}
+
+// NewBroker creates a broker on connections opened by dial
+func NewBroker(dial Dialer) (*Broker, error) {
+	b := &Broker{
+		dial:              dial,
+		exchanges:         make(map[string]string),
+		queues:            make(map[string]broker.QueueOptions),
+		bindings:          make(map[string]binding),
+		connected:         make(chan struct{}),
+		closed:            make(chan struct{}),
+		ReconnectDelay:    DefaultReconnectDelay,
+		MaxReconnectDelay: DefaultMaxReconnectDelay,
+	}
+	if err := b.open(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// open dials a new connection, declares on it the topology declared so far and watches it to reconnect once it is lost
+func (b *Broker) open() error {
+	connection, err := b.dial()
+	if err != nil {
+		return err
+	}
+	channel, err := connection.Channel()
+	if err != nil {
+		connection.Close()
+		return fmt.Errorf("Channel: %s", err)
+	}
+	publisher, err := NewPublisher(connection)
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	if b.closing {
+		connection.Close()
+		return broker.ErrClosed
+	}
+	if err := b.redeclare(channelDeclarer{channel: channel}); err != nil {
+		connection.Close()
+		return err
+	}
+	b.connection = connection
+	b.channel = channel
+	b.publisher = publisher
+	close(b.connected)
+	go b.watch(connection.NotifyClose(make(chan *amqp.Error, 1)))
+	return nil
+}
+
+// redeclare declares every exchange, queue and binding known by the broker on a new connection
+func (b *Broker) redeclare(declarer channelDeclarer) error {
+	for name, kind := range b.exchanges {
+		if err := declarer.DeclareExchange(name, kind); err != nil {
+			return err
+		}
+	}
+	for name, options := range b.queues {
+		if options.Exclusive {
+			continue
+		}
+		if _, err := declarer.DeclareQueue(name, options); err != nil {
+			return err
+		}
+	}
+	for queue, bound := range b.bindings {
+		if b.queues[queue].Exclusive {
+			continue
+		}
+		if err := declarer.BindQueue(queue, bound.exchange, bound.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watch waits for the connection to close and, unless the broker was closed, reconnects waiting longer after every
+// failed attempt
+func (b *Broker) watch(closed <-chan *amqp.Error) {
+	reason := <-closed
+	b.sync.Lock()
+	if b.closing {
+		b.sync.Unlock()
+		return
+	}
+	b.connected = make(chan struct{})
+	b.sync.Unlock()
+	log.Errorf("broker connection lost: %v; reconnecting", reason)
+
+	delay := b.ReconnectDelay
+	for {
+		select {
+		case <-b.closed:
+			return
+		case <-time.After(delay):
+		}
+		err := b.open()
+		if err == nil {
+			log.Infof("broker reconnected")
+			return
+		}
+		if err == broker.ErrClosed {
+			return
+		}
+		log.Errorf("error reconnecting broker: %v", err)
+		delay = backoff(delay, b.MaxReconnectDelay)
+	}
+}
+
+// current waits for the broker to be connected, returning its channel and publisher
+func (b *Broker) current() (*amqp.Channel, *Publisher, error) {
+	b.sync.Lock()
+	connected := b.connected
+	b.sync.Unlock()
+	select {
+	case <-connected:
+	case <-b.closed:
+		return nil, nil, broker.ErrClosed
+	}
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	return b.channel, b.publisher, nil
+}
+
+// DeclareExchange creates a durable exchange of a kind
+func (b *Broker) DeclareExchange(name, kind string) error {
+	channel, _, err := b.current()
+	if err != nil {
+		return err
+	}
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	if err := (channelDeclarer{channel: channel}).DeclareExchange(name, kind); err != nil {
+		return err
+	}
+	b.exchanges[name] = kind
+	return nil
+}
+
+// DeclareQueue creates a queue; exclusive queues are only named, and created later by their consumer
+func (b *Broker) DeclareQueue(name string, options broker.QueueOptions) (string, error) {
+	channel, _, err := b.current()
+	if err != nil {
+		return "", err
+	}
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	if options.Exclusive {
+		if name == "" {
+			name = fmt.Sprintf("exclusive.%v", guid.New().String())
+		}
+	} else {
+		declared, err := (channelDeclarer{channel: channel}).DeclareQueue(name, options)
+		if err != nil {
+			return "", err
+		}
+		name = declared
+	}
+	b.queues[name] = options
+	return name, nil
+}
+
+// BindQueue binds a queue to an exchange; consumers declare their queues again bound with the last binding of each one
+func (b *Broker) BindQueue(queue, exchange, key string) error {
+	channel, _, err := b.current()
+	if err != nil {
+		return err
+	}
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	if !b.queues[queue].Exclusive {
+		if err := (channelDeclarer{channel: channel}).BindQueue(queue, exchange, key); err != nil {
+			return err
+		}
+	}
+	b.bindings[queue] = binding{exchange: exchange, key: key}
+	return nil
+}
+
+// Publish sends a message through the publisher of the broker, waiting for the broker to reconnect if its connection
+// was lost; messages waiting for their confirmation when the connection is lost fail with ErrPublisherClosed
+func (b *Broker) Publish(exchange, routingKey string, body []byte, headers map[string]interface{}) broker.Confirmation {
+	_, publisher, err := b.current()
+	if err != nil {
+		return broker.Resolved(err)
+	}
+	return publisher.Publish(exchange, routingKey, body, headers)
+}
+
+// Consume creates a consumer of a queue on a connection of its own
+func (b *Broker) Consume(queue, tag string, options broker.ConsumerOptions) (broker.Consumer, error) {
+	b.sync.Lock()
+	queueOptions := b.queues[queue]
+	bound := b.bindings[queue]
+	exchangeType := b.exchanges[bound.exchange]
+	b.sync.Unlock()
+	consumer, err := newConsumer(b.dial, bound.exchange, exchangeType, queue, bound.key, tag, queueOptions, options)
+	if err != nil {
+		return nil, err
+	}
+	return consumer, nil
+}
+
+// Close waits for the confirmations of the messages published and closes the connection of the broker
+func (b *Broker) Close() error {
+	b.sync.Lock()
+	if b.closing {
+		b.sync.Unlock()
+		return nil
+	}
+	b.closing = true
+	close(b.closed)
+	connection, publisher := b.connection, b.publisher
+	b.sync.Unlock()
+
+	err := publisher.Close()
+	if closeErr := connection.Close(); closeErr != nil && closeErr != amqp.ErrClosed && err == nil {
+		err = fmt.Errorf("AMQP connection close error: %s", closeErr)
+	}
+	return err
+}
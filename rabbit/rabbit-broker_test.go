@@ -0,0 +1,113 @@
+package rabbit
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/ezeriver94/gotransform/broker"
+)
+
+// disconnectedBroker builds a broker whose connection was lost, dialing with dial to reconnect
+func disconnectedBroker(dial Dialer) *Broker {
+	return &Broker{
+		dial:              dial,
+		exchanges:         make(map[string]string),
+		queues:            make(map[string]broker.QueueOptions),
+		bindings:          make(map[string]binding),
+		connected:         make(chan struct{}),
+		closed:            make(chan struct{}),
+		ReconnectDelay:    time.Millisecond,
+		MaxReconnectDelay: 2 * time.Millisecond,
+	}
+}
+
+func TestBrokerWaitsForConnection(t *testing.T) {
+	b := disconnectedBroker(nil)
+	published := make(chan error)
+	go func() {
+		published <- b.Publish("exchange", "key", nil, nil).Wait()
+	}()
+	select {
+	case err := <-published:
+		t.Fatalf("Publish() returned %v while disconnected, want it to wait", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.closing = true
+	close(b.closed)
+	select {
+	case err := <-published:
+		if err != broker.ErrClosed {
+			t.Errorf("Publish() = %v, want %v", err, broker.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Publish() kept waiting after the broker was closed")
+	}
+	if err := b.DeclareExchange("exchange", "topic"); err != broker.ErrClosed {
+		t.Errorf("DeclareExchange() = %v, want %v", err, broker.ErrClosed)
+	}
+	if _, err := b.DeclareQueue("queue", broker.QueueOptions{}); err != broker.ErrClosed {
+		t.Errorf("DeclareQueue() = %v, want %v", err, broker.ErrClosed)
+	}
+	if err := b.BindQueue("queue", "exchange", "key"); err != broker.ErrClosed {
+		t.Errorf("BindQueue() = %v, want %v", err, broker.ErrClosed)
+	}
+}
+
+func TestBrokerReconnectUntilClosed(t *testing.T) {
+	var attempts int32
+	b := disconnectedBroker(func() (*amqp.Connection, error) {
+		atomic.AddInt32(&attempts, 1)
+		return nil, fmt.Errorf("connection refused")
+	})
+	lost := make(chan *amqp.Error, 1)
+	watching := make(chan struct{})
+	go func() {
+		b.watch(lost)
+		close(watching)
+	}()
+	lost <- amqp.ErrClosed
+	time.Sleep(50 * time.Millisecond)
+
+	b.sync.Lock()
+	b.closing = true
+	close(b.closed)
+	b.sync.Unlock()
+	select {
+	case <-watching:
+	case <-time.After(time.Second):
+		t.Fatal("watch() kept reconnecting after the broker was closed")
+	}
+	if atomic.LoadInt32(&attempts) < 2 {
+		t.Errorf("watch() dialed %v times, want several attempts", attempts)
+	}
+}
+
+func TestBrokerWatchAfterClose(t *testing.T) {
+	b := disconnectedBroker(func() (*amqp.Connection, error) {
+		t.Error("watch() dialed after the broker was closed")
+		return nil, fmt.Errorf("connection refused")
+	})
+	b.closing = true
+	close(b.closed)
+	lost := make(chan *amqp.Error, 1)
+	lost <- nil
+	b.watch(lost)
+}
+
+func TestToDeliveryStripsPublishTag(t *testing.T) {
+	delivery := toDelivery(amqp.Delivery{Headers: amqp.Table{publishTagHeader: int64(3), "producer": "orders"}})
+	if _, ok := delivery.Headers[publishTagHeader]; ok {
+		t.Errorf("Headers = %v, want no %v header", delivery.Headers, publishTagHeader)
+	}
+	if delivery.Headers["producer"] != "orders" {
+		t.Errorf("Headers = %v, want the producer header kept", delivery.Headers)
+	}
+	if delivery := toDelivery(amqp.Delivery{}); delivery.Headers != nil {
+		t.Errorf("Headers = %v, want nil", delivery.Headers)
+	}
+}
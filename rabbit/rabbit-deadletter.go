@@ -0,0 +1,93 @@
+package rabbit
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/broker"
+	"github.com/streadway/amqp"
+)
+
+// DeadLetter is a message held by a dead-letter queue, along with the details of its last failure
+type DeadLetter struct {
+	Delivery           amqp.Delivery
+	Attempts           int
+	LastError          string
+	OriginalExchange   string
+	OriginalRoutingKey string
+	FailedAt           string
+}
+
+// DeadLetterBrowser reads the messages of a dead-letter queue one by one without removing them; the messages that are
+// neither replayed nor discarded go back to the queue on Close
+type DeadLetterBrowser struct {
+	channel *amqp.Channel
+	queue   string
+}
+
+// NewDeadLetterBrowser opens a channel to browse a dead-letter queue
+func NewDeadLetterBrowser(connection *amqp.Connection, queue string) (*DeadLetterBrowser, error) {
+	channel, err := connection.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Channel: %s", err)
+	}
+	if _, err := channel.QueueInspect(queue); err != nil {
+		return nil, fmt.Errorf("Queue Inspect %v: %s", queue, err)
+	}
+	return &DeadLetterBrowser{
+		channel: channel,
+		queue:   queue,
+	}, nil
+}
+
+// Next returns the following message of the queue, or false once every message was read
+func (b *DeadLetterBrowser) Next() (DeadLetter, bool, error) {
+	delivery, ok, err := b.channel.Get(b.queue, false)
+	if err != nil {
+		return DeadLetter{}, false, fmt.Errorf("Queue Get %v: %s", b.queue, err)
+	}
+	if !ok {
+		return DeadLetter{}, false, nil
+	}
+	result := DeadLetter{
+		Delivery: delivery,
+		Attempts: broker.Attempts(delivery.Headers),
+	}
+	result.LastError, _ = delivery.Headers[broker.LastErrorHeader].(string)
+	result.OriginalExchange, _ = delivery.Headers[broker.OriginalExchangeHeader].(string)
+	result.OriginalRoutingKey, _ = delivery.Headers[broker.OriginalRoutingKeyHeader].(string)
+	result.FailedAt, _ = delivery.Headers[broker.FailedAtHeader].(string)
+	return result, true, nil
+}
+
+// Replay publishes a message again to its original exchange and routing key, without the headers of its failures, and
+// removes it from the dead-letter queue once the broker confirms it
+func (b *DeadLetterBrowser) Replay(letter DeadLetter) error {
+	if letter.OriginalRoutingKey == "" {
+		return fmt.Errorf("message %v has no original routing key", letter.Delivery.DeliveryTag)
+	}
+	headers := amqp.Table{}
+	for key, value := range letter.Delivery.Headers {
+		switch key {
+		case broker.AttemptsHeader, broker.LastErrorHeader, broker.OriginalExchangeHeader, broker.OriginalRoutingKeyHeader, broker.FailedAtHeader, publishTagHeader:
+		default:
+			headers[key] = value
+		}
+	}
+	if err := Publish(b.channel, letter.OriginalExchange, letter.OriginalRoutingKey, letter.Delivery.Body, true, headers); err != nil {
+		return fmt.Errorf("error replaying message to %v: %v", letter.OriginalRoutingKey, err)
+	}
+	log.Infof("replayed message %v to %v", letter.Delivery.DeliveryTag, letter.OriginalRoutingKey)
+	return letter.Delivery.Ack(false)
+}
+
+// Discard removes a message from the dead-letter queue
+func (b *DeadLetterBrowser) Discard(letter DeadLetter) error {
+	return letter.Delivery.Ack(false)
+}
+
+// Close returns every message that was neither replayed nor discarded to the queue
+func (b *DeadLetterBrowser) Close() error {
+	return b.channel.Close()
+}
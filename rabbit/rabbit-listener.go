@@ -1,83 +1,196 @@
 package rabbit
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/ezeriver94/gotransform/broker"
 	"github.com/streadway/amqp"
 )
 
-// Consumer represent a rabbit mq consumer wich subscribes to a channel and handles messages
+const (
+	// DefaultReconnectDelay is the time a consumer waits before its first reconnection attempt
+	DefaultReconnectDelay = time.Second
+
+	// DefaultMaxReconnectDelay bounds the time a consumer waits between reconnection attempts, which doubles after every failure
+	DefaultMaxReconnectDelay = 30 * time.Second
+)
+
+// Dialer opens a new connection to rabbitMq; consumers use it to reconnect after the broker closes their connection
+type Dialer func() (*amqp.Connection, error)
+
+// State indicates the status of the connection of a consumer
+type State int
+
+const (
+	// StateConnecting indicates that the consumer is dialing and declaring its topology
+	StateConnecting State = iota
+
+	// StateConnected indicates that the consumer is receiving messages
+	StateConnected
+
+	// StateDisconnected indicates that the consumer lost its connection and will try to reconnect
+	StateDisconnected
+
+	// StateClosed indicates that the consumer was shut down
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+}
+
+// Consumer represent a rabbit mq consumer wich subscribes to a channel and handles messages. When the broker closes its
+// connection, it reconnects with backoff, declares its exchange, queue and binding again and resumes consuming under the
+// same tag, so its handle keeps reading from the same deliveries channel
 type Consumer struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
-	queue   string
-	tag     string
-	Done    chan error
+	dial              Dialer
+	conn              *amqp.Connection
+	channel           *amqp.Channel
+	exchange          string
+	exchangeType      string
+	queue             string
+	key               string
+	tag               string
+	queueOptions      broker.QueueOptions
+	options           broker.ConsumerOptions
+	deliveries        chan amqp.Delivery
+	states            []chan State
+	consuming         bool
+	closing           bool
+	closed            chan struct{}
+	stopped           chan struct{}
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	Done              chan error
+	sync              sync.Mutex
 }
 
-// Handle is a function that keeps listening for messages in a rabbit mq excahnge and performs and action
+// Handle is a function that keeps listening for messages in a rabbit mq excahnge and performs and action; the deliveries
+// channel is closed once the consumer is shut down
 type Handle func(deliveries <-chan amqp.Delivery)
 
-// NewConsumer creates a rabbitmq consumer
-func NewConsumer(connection *amqp.Connection, channel *amqp.Channel, exchange, exchangeType, queueName, key, ctag string) (*Consumer, error) {
+// NewConsumer creates a rabbitmq consumer on a connection opened by dial, declaring its exchange, queue and binding
+func NewConsumer(dial Dialer, exchange, exchangeType, queueName, key, ctag string, options broker.ConsumerOptions) (*Consumer, error) {
+	return newConsumer(dial, exchange, exchangeType, queueName, key, ctag, broker.QueueOptions{}, options)
+}
+
+// newConsumer creates a consumer of a queue declared with queueOptions; without exchange, the queue is not bound
+func newConsumer(dial Dialer, exchange, exchangeType, queueName, key, ctag string, queueOptions broker.QueueOptions, options broker.ConsumerOptions) (*Consumer, error) {
 	c := &Consumer{
-		conn:    connection,
-		channel: channel,
-		tag:     ctag,
-		queue:   queueName,
-		Done:    make(chan error),
+		dial:              dial,
+		exchange:          exchange,
+		exchangeType:      exchangeType,
+		queue:             queueName,
+		key:               key,
+		tag:               ctag,
+		queueOptions:      queueOptions,
+		options:           options,
+		deliveries:        make(chan amqp.Delivery),
+		closed:            make(chan struct{}),
+		stopped:           make(chan struct{}),
+		ReconnectDelay:    DefaultReconnectDelay,
+		MaxReconnectDelay: DefaultMaxReconnectDelay,
+		Done:              make(chan error, 1),
 	}
+	c.setState(StateConnecting)
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
-	var err error
+// NotifyState registers a listener for the state changes of the consumer; changes are dropped if the listener is not
+// ready to receive them, so it should be buffered
+func (c *Consumer) NotifyState(receiver chan State) chan State {
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	c.states = append(c.states, receiver)
+	return receiver
+}
 
-	log.Infof("got Channel, declaring Exchange (%q)", exchange)
-	if err = c.channel.ExchangeDeclare(
-		exchange,     // name of the exchange
-		exchangeType, // type
-		true,         // durable
-		false,        // delete when complete
-		false,        // internal
-		false,        // noWait
-		nil,          // arguments
-	); err != nil {
-		return nil, fmt.Errorf("Exchange Declare: %s", err)
-	}
-
-	log.Infof("declared Exchange, declaring Queue %q", queueName)
-	queue, err := c.channel.QueueDeclare(
-		queueName, // name of the queue
-		true,      // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // noWait
-		nil,       // arguments
-	)
-	if err != nil {
-		return nil, fmt.Errorf("Queue Declare: %s", err)
+func (c *Consumer) setState(state State) {
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	log.Infof("consumer %q is %v", c.tag, state)
+	for _, receiver := range c.states {
+		select {
+		case receiver <- state:
+		default:
+		}
 	}
+}
 
-	log.Infof("declared Queue (%q %d messages, %d consumers), binding to Exchange (key %q)",
-		queue.Name, queue.Messages, queue.Consumers, key)
-
-	if err = c.channel.QueueBind(
-		queue.Name, // name of the queue
-		key,        // bindingKey
-		exchange,   // sourceExchange
-		false,      // noWait
-		nil,        // arguments
-	); err != nil {
-		return nil, fmt.Errorf("Queue Bind: %s", err)
+// open dials a new connection and declares the topology of the consumer on it
+func (c *Consumer) open() error {
+	connection, err := c.dial()
+	if err != nil {
+		return err
+	}
+	channel, err := connection.Channel()
+	if err != nil {
+		connection.Close()
+		return fmt.Errorf("Channel: %s", err)
 	}
+	if err := channel.Qos(c.options.PrefetchCount(), 0, false); err != nil {
+		connection.Close()
+		return fmt.Errorf("Channel Qos: %s", err)
+	}
+	if err := c.declare(channel); err != nil {
+		connection.Close()
+		return err
+	}
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	c.conn = connection
+	c.channel = channel
+	return nil
+}
 
-	return c, nil
+// declare creates the exchange and the queue of the consumer and binds them
+func (c *Consumer) declare(channel *amqp.Channel) error {
+	declarer := channelDeclarer{channel: channel}
+	if c.exchange != "" {
+		if err := declarer.DeclareExchange(c.exchange, c.exchangeType); err != nil {
+			return err
+		}
+	}
+	if _, err := declarer.DeclareQueue(c.queue, c.queueOptions); err != nil {
+		return err
+	}
+	if c.exchange != "" {
+		if err := declarer.BindQueue(c.queue, c.exchange, c.key); err != nil {
+			return err
+		}
+	}
+	if c.options.Retry != nil {
+		return broker.DeclareRetry(declarer, c.queue, c.options.Retry)
+	}
+	return nil
 }
 
-// Consume starts listening for messages in a consumer by the execution of the handle function
-func (c *Consumer) Consume(handle Handle) error {
+// subscribe starts consuming the queue on the current channel
+func (c *Consumer) subscribe() (<-chan amqp.Delivery, error) {
+	c.sync.Lock()
+	channel := c.channel
+	c.sync.Unlock()
 	log.Infof("Queue bound to Exchange, starting Consume (consumer tag %q)", c.tag)
-	deliveries, err := c.channel.Consume(
+	deliveries, err := channel.Consume(
 		c.queue, // name
 		c.tag,   // consumerTag,
 		false,   // noAck
@@ -87,38 +200,166 @@ func (c *Consumer) Consume(handle Handle) error {
 		nil,     // arguments
 	)
 	if err != nil {
-		return fmt.Errorf("Queue Consume: %s", err)
+		return nil, fmt.Errorf("Queue Consume: %s", err)
+	}
+	return deliveries, nil
+}
+
+// Consume starts listening for messages in a consumer by the execution of the handle function, and blocks until it returns
+func (c *Consumer) Consume(handle Handle) error {
+	deliveries, err := c.subscribe()
+	if err != nil {
+		return err
+	}
+	c.sync.Lock()
+	c.consuming = true
+	c.sync.Unlock()
+	c.setState(StateConnected)
+
+	go c.forward(deliveries)
+	handle(c.deliveries)
+	close(c.stopped)
+	c.Done <- nil
+	return nil
+}
+
+// Process handles every message with as many concurrent handlers as the options of the consumer say, acking the ones
+// processed successfully and nacking, retrying or dead-lettering the rest; it blocks until ctx is cancelled or the
+// consumer is shut down
+func (c *Consumer) Process(ctx context.Context, handler broker.Handler) error {
+	return c.Consume(func(deliveries <-chan amqp.Delivery) {
+		adapted := make(chan broker.Delivery)
+		go func() {
+			defer close(adapted)
+			for delivery := range deliveries {
+				select {
+				case adapted <- toDelivery(delivery):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		c.dispatcher().Dispatch(ctx, adapted, handler)
+	})
+}
+
+// dispatcher runs the handlers of the consumer, sending failed messages through the current channel
+func (c *Consumer) dispatcher() broker.Dispatcher {
+	return broker.Dispatcher{
+		Queue:   c.queue,
+		Options: c.options,
+		Publish: func(exchange, routingKey string, body []byte, headers map[string]interface{}) error {
+			c.sync.Lock()
+			channel := c.channel
+			c.sync.Unlock()
+			return Publish(channel, exchange, routingKey, body, true, headers)
+		},
 	}
-	rabbitCloseError := make(chan *amqp.Error)
-	c.conn.NotifyClose(rabbitCloseError)
-	handled := false
+}
+
+// FinalAttempt indicates whether a failure processing the delivery would be the last one, after which it is dropped or
+// dead-lettered instead of delivered again
+func (c *Consumer) FinalAttempt(delivery broker.Delivery) bool {
+	return c.dispatcher().FinalAttempt(delivery)
+}
+
+// forward sends every delivery received from the broker to the handle, reconnecting whenever the connection is lost,
+// until the consumer is shut down
+func (c *Consumer) forward(deliveries <-chan amqp.Delivery) {
+	defer close(c.deliveries)
 	for {
-		select {
-		case rabbitErr := <-rabbitCloseError:
-			return rabbitErr
-		default:
-			if handled {
-				return nil
+		for delivery := range deliveries {
+			select {
+			case c.deliveries <- delivery:
+			case <-c.stopped:
+				return
 			}
-			handled = true
-			handle(deliveries)
+		}
+		if c.isClosing() {
+			return
+		}
+		c.setState(StateDisconnected)
+		deliveries = c.reconnect()
+		if deliveries == nil {
+			return
 		}
 	}
 }
 
-// Shutdown closes a consumer connection
-func (c *Consumer) Shutdown() error {
-	// will close() the deliveries channel
-	if err := c.channel.Cancel(c.tag, true); err != nil {
-		return fmt.Errorf("Consumer cancel failed: %s", err)
+// reconnect opens a new connection and subscribes again, waiting longer after every failed attempt; it returns nil if the
+// consumer is shut down meanwhile
+func (c *Consumer) reconnect() <-chan amqp.Delivery {
+	delay := c.ReconnectDelay
+	for {
+		select {
+		case <-c.closed:
+			return nil
+		case <-time.After(delay):
+		}
+		c.setState(StateConnecting)
+		err := c.open()
+		var deliveries <-chan amqp.Delivery
+		if err == nil {
+			deliveries, err = c.subscribe()
+		}
+		if err == nil && c.isClosing() {
+			// shut down while reconnecting; Shutdown may have missed this connection
+			c.sync.Lock()
+			c.conn.Close()
+			c.sync.Unlock()
+			return nil
+		}
+		if err == nil {
+			c.setState(StateConnected)
+			return deliveries
+		}
+		log.Errorf("error reconnecting consumer %q: %v", c.tag, err)
+		c.setState(StateDisconnected)
+		delay = backoff(delay, c.MaxReconnectDelay)
 	}
+}
 
-	if err := c.conn.Close(); err != nil {
-		return fmt.Errorf("AMQP connection close error: %s", err)
+// backoff doubles the delay between reconnection attempts, up to max
+func backoff(delay, max time.Duration) time.Duration {
+	delay *= 2
+	if delay > max {
+		return max
 	}
+	return delay
+}
 
-	defer log.Infof("AMQP shutdown OK")
+func (c *Consumer) isClosing() bool {
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	return c.closing
+}
 
-	// wait for handle() to exit
-	return <-c.Done
+// Shutdown stops consuming, waits for the handle to process the deliveries already received and closes the connection
+func (c *Consumer) Shutdown() error {
+	c.sync.Lock()
+	if c.closing {
+		c.sync.Unlock()
+		return nil
+	}
+	c.closing = true
+	close(c.closed)
+	connection, channel, consuming := c.conn, c.channel, c.consuming
+	c.sync.Unlock()
+
+	var err error
+	if consuming {
+		// will close() the deliveries channel
+		if cancelErr := channel.Cancel(c.tag, false); cancelErr != nil {
+			log.Warnf("Consumer cancel failed: %s", cancelErr)
+		}
+		// wait for handle() to exit
+		err = <-c.Done
+	}
+
+	if closeErr := connection.Close(); closeErr != nil && closeErr != amqp.ErrClosed && err == nil {
+		err = fmt.Errorf("AMQP connection close error: %s", closeErr)
+	}
+	c.setState(StateClosed)
+	log.Infof("AMQP shutdown OK")
+	return err
 }
@@ -0,0 +1,106 @@
+package rabbit
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		delay time.Duration
+		max   time.Duration
+		want  time.Duration
+	}{
+		{time.Second, 30 * time.Second, 2 * time.Second},
+		{16 * time.Second, 30 * time.Second, 30 * time.Second},
+		{30 * time.Second, 30 * time.Second, 30 * time.Second},
+	}
+	for _, test := range tests {
+		if got := backoff(test.delay, test.max); got != test.want {
+			t.Errorf("backoff(%v, %v) = %v, want %v", test.delay, test.max, got, test.want)
+		}
+	}
+}
+
+func TestStateString(t *testing.T) {
+	tests := []struct {
+		state State
+		want  string
+	}{
+		{StateConnecting, "connecting"},
+		{StateConnected, "connected"},
+		{StateDisconnected, "disconnected"},
+		{StateClosed, "closed"},
+		{State(9), "state(9)"},
+	}
+	for _, test := range tests {
+		if got := test.state.String(); got != test.want {
+			t.Errorf("String() = %v, want %v", got, test.want)
+		}
+	}
+}
+
+func TestConsumerReconnectUntilShutdown(t *testing.T) {
+	var attempts int32
+	c := &Consumer{
+		dial: func() (*amqp.Connection, error) {
+			atomic.AddInt32(&attempts, 1)
+			return nil, fmt.Errorf("connection refused")
+		},
+		tag:               "reconnecting",
+		closed:            make(chan struct{}),
+		ReconnectDelay:    time.Millisecond,
+		MaxReconnectDelay: 2 * time.Millisecond,
+	}
+	states := c.NotifyState(make(chan State, 100))
+
+	reconnected := make(chan (<-chan amqp.Delivery))
+	go func() {
+		reconnected <- c.reconnect()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(c.closed)
+	select {
+	case deliveries := <-reconnected:
+		if deliveries != nil {
+			t.Errorf("reconnect() returned deliveries after shutdown")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("reconnect() kept running after shutdown")
+	}
+	if atomic.LoadInt32(&attempts) < 2 {
+		t.Errorf("reconnect() dialed %v times, want several attempts", attempts)
+	}
+
+	close(states)
+	previous := StateDisconnected
+	for state := range states {
+		want := StateConnecting
+		if previous == StateConnecting {
+			want = StateDisconnected
+		}
+		if state != want {
+			t.Fatalf("state %v after %v, want %v", state, previous, want)
+		}
+		previous = state
+	}
+}
+
+func TestNotifyStateDropsWhenNotReady(t *testing.T) {
+	c := &Consumer{tag: "notifying"}
+	ready := c.NotifyState(make(chan State, 1))
+	blocked := c.NotifyState(make(chan State))
+	c.setState(StateConnected)
+	if state := <-ready; state != StateConnected {
+		t.Errorf("state = %v, want %v", state, StateConnected)
+	}
+	select {
+	case state := <-blocked:
+		t.Errorf("unbuffered listener received %v", state)
+	default:
+	}
+}
@@ -1,27 +1,326 @@
 package rabbit
 
 import (
+	"errors"
 	"fmt"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/streadway/amqp"
 )
 
-// Publish sends a message to a rabbit connection
-func Publish(channel *amqp.Channel, exchange, routingKey string, body []byte, reliable bool, headers map[string]interface{}) error {
+// publishTagHeader carries the delivery tag of a message, so the publisher can match it when the broker returns it
+const publishTagHeader = "x-publish-tag"
+
+var (
+	// ErrNacked indicates that the broker could not take responsibility for a message
+	ErrNacked = errors.New("message nacked by the broker")
+
+	// ErrReturned indicates that a mandatory message could not be routed to any queue
+	ErrReturned = errors.New("message returned by the broker")
+
+	// ErrPublisherClosed indicates that the channel of the publisher was closed before the confirmation of a message
+	ErrPublisherClosed = errors.New("publisher closed before confirmation")
+)
+
+// Confirmation is the result of a message sent by a Publisher, resolved once the broker confirms it
+type Confirmation struct {
+	DeliveryTag uint64
+	done        chan struct{}
+	err         error
+}
+
+func newConfirmation(tag uint64) *Confirmation {
+	return &Confirmation{
+		DeliveryTag: tag,
+		done:        make(chan struct{}),
+	}
+}
+
+// resolve sets the outcome of the message
+func (c *Confirmation) resolve(err error) {
+	c.err = err
+	close(c.done)
+}
+
+// Done is closed once the message is confirmed, nacked or returned
+func (c *Confirmation) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait blocks until the broker confirms the message, returning an error if it was nacked, returned or never confirmed
+func (c *Confirmation) Wait() error {
+	<-c.done
+	return c.err
+}
+
+// Publisher sends messages through its own channel, put in confirm mode once, and tracks the delivery tag of every
+// message so each publishing gets the outcome the broker reports for it
+type Publisher struct {
+	channel  *amqp.Channel
+	next     uint64
+	pending  map[uint64]*Confirmation
+	returned map[uint64]amqp.Return
+	closed   error
+	sending  sync.Mutex
+	sync     sync.Mutex
+}
+
+// NewPublisher opens a channel on connection and puts it in confirm mode
+func NewPublisher(connection *amqp.Connection) (*Publisher, error) {
+	channel, err := connection.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Channel: %s", err)
+	}
+	publisher, err := newPublisher(channel)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+	return publisher, nil
+}
+
+func newPublisher(channel *amqp.Channel) (*Publisher, error) {
+	log.Debug("enabling publishing confirms.")
+	if err := channel.Confirm(false); err != nil {
+		return nil, fmt.Errorf("Channel could not be put into confirm mode: %s", err)
+	}
+	p := &Publisher{
+		channel:  channel,
+		next:     1,
+		pending:  make(map[uint64]*Confirmation),
+		returned: make(map[uint64]amqp.Return),
+	}
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 64))
+	returns := channel.NotifyReturn(make(chan amqp.Return, 64))
+	go p.listen(confirms, returns)
+	return p, nil
+}
+
+// listen resolves the confirmation of every message; returns arrive before the confirmation of the same message, so they
+// are drained before handling each confirmation
+func (p *Publisher) listen(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for confirmed := range confirms {
+		p.drain(returns)
+		p.confirm(confirmed)
+	}
+	p.drain(returns)
+	p.close(ErrPublisherClosed)
+}
+
+// drain records every returned message received so far
+func (p *Publisher) drain(returns <-chan amqp.Return) {
+	for {
+		select {
+		case returned, ok := <-returns:
+			if !ok {
+				return
+			}
+			tag, ok := toDeliveryTag(returned.Headers[publishTagHeader])
+			if !ok {
+				log.Warnf("received returned message without %v header", publishTagHeader)
+				continue
+			}
+			p.sync.Lock()
+			p.returned[tag] = returned
+			p.sync.Unlock()
+		default:
+			return
+		}
+	}
+}
+
+func toDeliveryTag(value interface{}) (uint64, bool) {
+	switch tag := value.(type) {
+	case int64:
+		return uint64(tag), true
+	case int32:
+		return uint64(tag), true
+	case int:
+		return uint64(tag), true
+	default:
+		return 0, false
+	}
+}
+
+// confirm resolves the confirmation of a message with the outcome reported by the broker
+func (p *Publisher) confirm(confirmed amqp.Confirmation) {
+	p.sync.Lock()
+	confirmation, ok := p.pending[confirmed.DeliveryTag]
+	returned, wasReturned := p.returned[confirmed.DeliveryTag]
+	delete(p.pending, confirmed.DeliveryTag)
+	delete(p.returned, confirmed.DeliveryTag)
+	p.sync.Unlock()
+	if !ok {
+		return
+	}
+	switch {
+	case !confirmed.Ack:
+		log.Errorf("failed delivery of delivery tag: %d", confirmed.DeliveryTag)
+		confirmation.resolve(ErrNacked)
+	case wasReturned:
+		log.Errorf("returned delivery of delivery tag %d: %v %v", confirmed.DeliveryTag, returned.ReplyCode, returned.ReplyText)
+		confirmation.resolve(fmt.Errorf("%w: %v %v", ErrReturned, returned.ReplyCode, returned.ReplyText))
+	default:
+		log.Debugf("confirmed delivery with delivery tag: %d", confirmed.DeliveryTag)
+		confirmation.resolve(nil)
+	}
+}
+
+// close resolves every pending confirmation with err and rejects later publishings
+func (p *Publisher) close(err error) {
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	if p.closed == nil {
+		p.closed = err
+	}
+	for tag, confirmation := range p.pending {
+		confirmation.resolve(p.closed)
+		delete(p.pending, tag)
+	}
+}
 
-	// Reliable publisher confirms require confirm.select support from the
-	// connection.
-	if reliable {
-		log.Debug("enabling publishing confirms.")
-		if err := channel.Confirm(false); err != nil {
-			return fmt.Errorf("Channel could not be put into confirm mode: %s", err)
+// Publish sends a message and returns its confirmation right away, so many messages can be waited for at once
+func (p *Publisher) Publish(exchange, routingKey string, body []byte, headers map[string]interface{}) *Confirmation {
+	tagged := amqp.Table{}
+	for key, value := range headers {
+		tagged[key] = value
+	}
+
+	// delivery tags follow the order of publishings on the channel, so publishings are sent one at a time
+	p.sending.Lock()
+	defer p.sending.Unlock()
+	p.sync.Lock()
+	tag := p.next
+	confirmation := newConfirmation(tag)
+	if p.closed != nil {
+		confirmation.resolve(p.closed)
+		p.sync.Unlock()
+		return confirmation
+	}
+	p.pending[tag] = confirmation
+	p.next++
+	p.sync.Unlock()
+	tagged[publishTagHeader] = int64(tag)
+
+	log.Debugf("publishing %dB body (%v)", len(body), string(body))
+	if err := p.channel.Publish(
+		exchange,   // publish to an exchange
+		routingKey, // routing to 0 or more queues
+		true,       // mandatory
+		false,      // immediate
+		amqp.Publishing{
+			Headers:         tagged,
+			ContentType:     "text/plain",
+			ContentEncoding: "",
+			Body:            body,
+			DeliveryMode:    amqp.Persistent, // 1=non-persistent, 2=persistent
+			Priority:        0,               // 0-9
+		},
+	); err != nil {
+		// the message never reached the broker, so its delivery tag goes to the next one
+		p.sync.Lock()
+		_, pending := p.pending[tag]
+		delete(p.pending, tag)
+		p.next = tag
+		p.sync.Unlock()
+		if pending {
+			confirmation.resolve(fmt.Errorf("Exchange Publish: %s", err))
 		}
+	}
+	return confirmation
+}
 
-		confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+// PublishBatch sends every message body with the same headers and waits for all their confirmations, returning the
+// first error found
+func (p *Publisher) PublishBatch(exchange, routingKey string, bodies [][]byte, headers map[string]interface{}) error {
+	confirmations := make([]*Confirmation, 0, len(bodies))
+	for _, body := range bodies {
+		confirmations = append(confirmations, p.Publish(exchange, routingKey, body, headers))
+	}
+	return WaitAll(confirmations)
+}
 
-		defer confirmOne(confirms)
+// Wait blocks until every message published so far is confirmed, returning the first error found
+func (p *Publisher) Wait() error {
+	p.sync.Lock()
+	confirmations := make([]*Confirmation, 0, len(p.pending))
+	for _, confirmation := range p.pending {
+		confirmations = append(confirmations, confirmation)
+	}
+	p.sync.Unlock()
+	return WaitAll(confirmations)
+}
+
+// Close waits for every pending confirmation and closes the channel of the publisher
+func (p *Publisher) Close() error {
+	err := p.Wait()
+	if closeErr := p.channel.Close(); closeErr != nil && closeErr != amqp.ErrClosed && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// WaitAll blocks until every confirmation is resolved, returning the first error found
+func WaitAll(confirmations []*Confirmation) error {
+	var result error
+	for _, confirmation := range confirmations {
+		if err := confirmation.Wait(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+var (
+	// publishers keeps the publisher of every channel used by reliable calls to Publish
+	publishers     = make(map[*amqp.Channel]*Publisher)
+	publishersSync sync.Mutex
+)
+
+// publisherOf returns the publisher of a channel, creating it the first time
+func publisherOf(channel *amqp.Channel) (*Publisher, error) {
+	publishersSync.Lock()
+	defer publishersSync.Unlock()
+	if publisher, ok := publishers[channel]; ok {
+		return publisher, nil
+	}
+	publisher, err := newPublisher(channel)
+	if err != nil {
+		return nil, err
+	}
+	publishers[channel] = publisher
+	closed := channel.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		<-closed
+		publishersSync.Lock()
+		delete(publishers, channel)
+		publishersSync.Unlock()
+	}()
+	return publisher, nil
+}
+
+// Publish sends a message to a rabbit connection; reliable publishings wait for the confirmation of the broker, which
+// puts the channel in confirm mode the first time. Once in confirm mode, every publishing on the channel goes through
+// its publisher, so delivery tags stay in sync
+func Publish(channel *amqp.Channel, exchange, routingKey string, body []byte, reliable bool, headers map[string]interface{}) error {
+	publishersSync.Lock()
+	publisher, confirming := publishers[channel]
+	publishersSync.Unlock()
+	if reliable && !confirming {
+		var err error
+		if publisher, err = publisherOf(channel); err != nil {
+			return err
+		}
+		confirming = true
+	}
+	if confirming {
+		confirmation := publisher.Publish(exchange, routingKey, body, headers)
+		if !reliable {
+			return nil
+		}
+		return confirmation.Wait()
 	}
 
 	log.Infof("publishing %dB body (%v)", len(body), string(body))
@@ -45,16 +344,3 @@ func Publish(channel *amqp.Channel, exchange, routingKey string, body []byte, re
 
 	return nil
 }
-
-// One would typically keep a channel of publishings, a sequence number, and a
-// set of unacknowledged sequence numbers and loop until the publishing channel
-// is closed.
-func confirmOne(confirms <-chan amqp.Confirmation) {
-	log.Debugf("waiting for confirmation of one publishing")
-
-	if confirmed := <-confirms; confirmed.Ack {
-		log.Infof("confirmed delivery with delivery tag: %d", confirmed.DeliveryTag)
-	} else {
-		log.Errorf("failed delivery of delivery tag: %d", confirmed.DeliveryTag)
-	}
-}
@@ -0,0 +1,122 @@
+package rabbit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// pendingPublisher creates a publisher, without channel, waiting for the confirmation of the given delivery tags
+func pendingPublisher(tags ...uint64) (*Publisher, map[uint64]*Confirmation) {
+	p := &Publisher{
+		next:     1,
+		pending:  make(map[uint64]*Confirmation),
+		returned: make(map[uint64]amqp.Return),
+	}
+	confirmations := make(map[uint64]*Confirmation, len(tags))
+	for _, tag := range tags {
+		confirmations[tag] = newConfirmation(tag)
+		p.pending[tag] = confirmations[tag]
+	}
+	return p, confirmations
+}
+
+func TestPublisherListen(t *testing.T) {
+	tests := []struct {
+		name      string
+		confirmed []amqp.Confirmation
+		returned  []amqp.Return
+		want      map[uint64]error
+	}{
+		{
+			name:      "acked",
+			confirmed: []amqp.Confirmation{{DeliveryTag: 1, Ack: true}, {DeliveryTag: 2, Ack: true}},
+			want:      map[uint64]error{1: nil, 2: nil},
+		},
+		{
+			name:      "nacked",
+			confirmed: []amqp.Confirmation{{DeliveryTag: 1, Ack: true}, {DeliveryTag: 2, Ack: false}},
+			want:      map[uint64]error{1: nil, 2: ErrNacked},
+		},
+		{
+			name:      "returned",
+			confirmed: []amqp.Confirmation{{DeliveryTag: 1, Ack: true}, {DeliveryTag: 2, Ack: true}},
+			returned:  []amqp.Return{{ReplyCode: 312, ReplyText: "NO_ROUTE", Headers: amqp.Table{publishTagHeader: int64(1)}}},
+			want:      map[uint64]error{1: ErrReturned, 2: nil},
+		},
+		{
+			name:      "closed before confirmation",
+			confirmed: []amqp.Confirmation{{DeliveryTag: 1, Ack: true}},
+			want:      map[uint64]error{1: nil, 2: ErrPublisherClosed},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, confirmations := pendingPublisher(1, 2)
+			confirms := make(chan amqp.Confirmation, len(test.confirmed))
+			returns := make(chan amqp.Return, len(test.returned))
+			for _, returned := range test.returned {
+				returns <- returned
+			}
+			for _, confirmed := range test.confirmed {
+				confirms <- confirmed
+			}
+			close(confirms)
+			close(returns)
+			p.listen(confirms, returns)
+
+			for tag, want := range test.want {
+				if err := confirmations[tag].Wait(); !errors.Is(err, want) {
+					t.Errorf("confirmation %v = %v, want %v", tag, err, want)
+				}
+			}
+			if len(p.pending) != 0 || len(p.returned) != 0 {
+				t.Errorf("publisher kept %v pending and %v returned messages", len(p.pending), len(p.returned))
+			}
+		})
+	}
+}
+
+func TestPublisherClosed(t *testing.T) {
+	p, _ := pendingPublisher()
+	p.close(ErrPublisherClosed)
+	if err := p.Publish("exchange", "key", nil, nil).Wait(); err != ErrPublisherClosed {
+		t.Errorf("Publish() on a closed publisher = %v, want %v", err, ErrPublisherClosed)
+	}
+	if err := p.Wait(); err != nil {
+		t.Errorf("Wait() = %v, want nil", err)
+	}
+}
+
+func TestWaitAll(t *testing.T) {
+	confirmations := []*Confirmation{newConfirmation(1), newConfirmation(2), newConfirmation(3)}
+	confirmations[0].resolve(nil)
+	confirmations[1].resolve(ErrNacked)
+	confirmations[2].resolve(ErrReturned)
+	if err := WaitAll(confirmations); err != ErrNacked {
+		t.Errorf("WaitAll() = %v, want %v", err, ErrNacked)
+	}
+	if err := WaitAll(confirmations[:1]); err != nil {
+		t.Errorf("WaitAll() = %v, want nil", err)
+	}
+}
+
+func TestToDeliveryTag(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		want   uint64
+		wantOk bool
+	}{
+		{int64(7), 7, true},
+		{int32(7), 7, true},
+		{7, 7, true},
+		{"7", 0, false},
+		{nil, 0, false},
+	}
+	for _, test := range tests {
+		if got, ok := toDeliveryTag(test.value); got != test.want || ok != test.wantOk {
+			t.Errorf("toDeliveryTag(%#v) = %v, %v, want %v, %v", test.value, got, ok, test.want, test.wantOk)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps the state of a job as a json document in a local file
+type FileStore struct {
+	path   string
+	values map[string]interface{}
+	sync   sync.Mutex
+}
+
+// NewFileStore creates a store backed by the file on path, loading its values if it already exists
+func NewFileStore(path string) (*FileStore, error) {
+	result := FileStore{
+		path:   path,
+		values: make(map[string]interface{}),
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file %v: %v", path, err)
+	}
+	if len(bytes.TrimSpace(content)) == 0 {
+		return &result, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result.values); err != nil {
+		return nil, fmt.Errorf("error deserializing state file %v: %v", path, err)
+	}
+	return &result, nil
+}
+
+// Get returns the value stored for a key and whether it was found
+func (s *FileStore) Get(key string) (interface{}, bool, error) {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+	value, ok := s.values[key]
+	return value, ok, nil
+}
+
+// Set stores a value for a key and flushes the state file
+func (s *FileStore) Set(key string, value interface{}) error {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+	s.values[key] = value
+	return s.flush()
+}
+
+// Delete removes a key and flushes the state file
+func (s *FileStore) Delete(key string) error {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+	delete(s.values, key)
+	return s.flush()
+}
+
+// flush writes the values to a temporary file and renames it, so the state file is never left half written
+func (s *FileStore) flush() error {
+	content, err := json.MarshalIndent(s.values, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializing state: %v", err)
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary state file: %v", err)
+	}
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return fmt.Errorf("error writing state file %v: %v", temp.Name(), err)
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("error closing state file %v: %v", temp.Name(), err)
+	}
+	if err := os.Rename(temp.Name(), s.path); err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("error replacing state file %v: %v", s.path, err)
+	}
+	return nil
+}
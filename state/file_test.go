@@ -0,0 +1,62 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]interface{}{
+		"watermark:orders":    float64(42),
+		"watermark:customers": "2020-01-02",
+		"watermark:deleted":   "removed",
+	}
+	for key, value := range values {
+		if err := store.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("watermark:deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key       string
+		want      interface{}
+		wantFound bool
+	}{
+		{"watermark:orders", json.Number("42"), true},
+		{"watermark:customers", "2020-01-02", true},
+		{"watermark:deleted", nil, false},
+		{"watermark:missing", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			got, found, err := reopened.Get(test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != test.wantFound || got != test.want {
+				t.Errorf("Get(%v) = %v, %v, want %v, %v", test.key, got, found, test.want, test.wantFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// keyPrefix is prepended to every key stored in redis to avoid collisions with the lookup cache
+const keyPrefix = "gotransform:state:"
+
+// RedisStore keeps the state of a job in a redis server
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore creates a store connected to the redis server described by a redis:// url
+func NewRedisStore(url string) (*RedisStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing redis url: %v", err)
+	}
+	return &RedisStore{
+		client: redis.NewClient(options),
+	}, nil
+}
+
+// Get returns the value stored for a key and whether it was found
+func (s *RedisStore) Get(key string) (interface{}, bool, error) {
+	content, err := s.client.Get(context.TODO(), keyPrefix+key).Result()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting state key %v: %v", key, err)
+	}
+	var result interface{}
+	decoder := json.NewDecoder(strings.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, false, fmt.Errorf("error deserializing state key %v: %v", key, err)
+	}
+	return result, true, nil
+}
+
+// Set stores a value for a key without expiration
+func (s *RedisStore) Set(key string, value interface{}) error {
+	var content bytes.Buffer
+	if err := json.NewEncoder(&content).Encode(value); err != nil {
+		return fmt.Errorf("error serializing state key %v: %v", key, err)
+	}
+	if err := s.client.Set(context.TODO(), keyPrefix+key, content.String(), 0).Err(); err != nil {
+		return fmt.Errorf("error setting state key %v: %v", key, err)
+	}
+	return nil
+}
+
+// Delete removes a key from redis
+func (s *RedisStore) Delete(key string) error {
+	if err := s.client.Del(context.TODO(), keyPrefix+key).Err(); err != nil {
+		return fmt.Errorf("error deleting state key %v: %v", key, err)
+	}
+	return nil
+}
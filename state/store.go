@@ -0,0 +1,20 @@
+package state
+
+import (
+	"strings"
+)
+
+// Store persists values between runs of a job, such as the watermarks of incremental extractions
+type Store interface {
+	Get(key string) (interface{}, bool, error)
+	Set(key string, value interface{}) error
+	Delete(key string) error
+}
+
+// NewStore builds a store from a location; redis:// urls are stored in redis, any other value is used as a local file path
+func NewStore(location string) (Store, error) {
+	if strings.HasPrefix(location, "redis://") {
+		return NewRedisStore(location)
+	}
+	return NewFileStore(location)
+}
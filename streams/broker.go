@@ -0,0 +1,565 @@
+package streams
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/guid"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/broker"
+)
+
+const (
+	// keyPrefix is prepended to every key stored in redis to avoid collisions with the lookup cache and the state
+	keyPrefix = "gotransform:broker:"
+
+	// group is the consumer group every consumer of a queue joins, so they compete for its messages
+	group = "consumers"
+
+	// DefaultReclaimIdle is the time a message stays delivered to a consumer without being acked before other consumers
+	// of its queue claim it, as its consumer is assumed to have crashed
+	DefaultReclaimIdle = time.Minute
+
+	// routesTTL is the time the queues bound to a direct exchange are cached before reading them again
+	routesTTL = 5 * time.Second
+
+	// promoteInterval is the time between checks for expired messages of delay queues
+	promoteInterval = 100 * time.Millisecond
+
+	// exclusiveTTL is the time an exclusive queue outlives its consumer if it stops without removing the queue
+	exclusiveTTL = time.Minute
+)
+
+// promoteScript moves a message from a delay queue to its destination streams, unless another broker already did
+var promoteScript = redis.NewScript(`
+if redis.call('zrem', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+for i = 2, #KEYS do
+	redis.call('xadd', KEYS[i], '*', unpack(ARGV, 2))
+end
+return 1
+`)
+
+// message is a message as stored in a stream, or in a delay queue along with an id that keeps it unique
+type message struct {
+	ID          string                 `json:"id,omitempty"`
+	Body        []byte                 `json:"body"`
+	Headers     map[string]interface{} `json:"headers"`
+	Exchange    string                 `json:"exchange"`
+	RoutingKey  string                 `json:"routingKey"`
+	Redelivered bool                   `json:"redelivered,omitempty"`
+}
+
+// fields returns the fields of a stream entry holding the message
+func (m message) fields() ([]interface{}, error) {
+	headers, err := json.Marshal(m.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing headers: %v", err)
+	}
+	redelivered := "0"
+	if m.Redelivered {
+		redelivered = "1"
+	}
+	return []interface{}{
+		"body", m.Body,
+		"headers", string(headers),
+		"exchange", m.Exchange,
+		"routingkey", m.RoutingKey,
+		"redelivered", redelivered,
+	}, nil
+}
+
+// fromEntry reads a message from the fields of a stream entry
+func fromEntry(values map[string]interface{}) (message, error) {
+	result := message{}
+	body, _ := values["body"].(string)
+	result.Body = []byte(body)
+	result.Exchange, _ = values["exchange"].(string)
+	result.RoutingKey, _ = values["routingkey"].(string)
+	result.Redelivered = values["redelivered"] == "1"
+	headers, _ := values["headers"].(string)
+	var err error
+	result.Headers, err = decodeHeaders(headers)
+	return result, err
+}
+
+// decodeHeaders deserializes headers keeping integer numbers as int64, as rabbitMq delivers them
+func decodeHeaders(content string) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	if content == "" {
+		return result, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("error deserializing headers: %v", err)
+	}
+	for key, value := range result {
+		number, ok := value.(json.Number)
+		if !ok {
+			continue
+		}
+		if integer, err := number.Int64(); err == nil {
+			result[key] = integer
+		} else if float, err := number.Float64(); err == nil {
+			result[key] = float
+		}
+	}
+	return result, nil
+}
+
+func streamKey(queue string) string {
+	return keyPrefix + "queue:" + queue
+}
+
+func delayedKey(queue string) string {
+	return keyPrefix + "delayed:" + queue
+}
+
+func bindingsKey(exchange string) string {
+	return keyPrefix + "bindings:" + exchange
+}
+
+// route is the list of queues a direct exchange sends a routing key to, cached until it expires
+type route struct {
+	queues  []string
+	expires time.Time
+}
+
+// Broker implements broker.Broker on redis streams. Every queue is a stream read by a consumer group, so its consumers
+// compete for its messages, and exchanges, bindings and queues are kept in redis, so every worker routes messages the
+// same way. Queues with a MessageTTL are delay queues: their messages wait in a sorted set until they expire and are
+// moved to their dead-letter exchange, as rabbitMq does with the messages of queues without consumers, so they cannot be
+// consumed. Messages delivered to a consumer that crashes are claimed by the other consumers of their queue once they
+// were not acked for ReclaimIdle, so handlers should take less than that
+type Broker struct {
+	client      *redis.Client
+	ReclaimIdle time.Duration
+	exchanges   map[string]string
+	queues      map[string]broker.QueueOptions
+	routes      map[string]route
+	promoting   map[string]bool
+	closed      chan struct{}
+	wait        sync.WaitGroup
+	sync        sync.Mutex
+}
+
+// NewBroker creates a broker on the redis server described by a redis:// url
+func NewBroker(url string) (*Broker, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing redis url: %v", err)
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.TODO()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error connecting to redis: %v", err)
+	}
+	return &Broker{
+		client:      client,
+		ReclaimIdle: DefaultReclaimIdle,
+		exchanges:   make(map[string]string),
+		queues:      make(map[string]broker.QueueOptions),
+		routes:      make(map[string]route),
+		promoting:   make(map[string]bool),
+		closed:      make(chan struct{}),
+	}, nil
+}
+
+// DeclareExchange creates an exchange of a kind, failing if it exists with another kind
+func (b *Broker) DeclareExchange(name, kind string) error {
+	if kind != broker.ExchangeDirect && kind != broker.ExchangeFanout {
+		return fmt.Errorf("error declaring exchange %v: unsupported kind %v", name, kind)
+	}
+	if _, err := b.client.HSetNX(context.TODO(), keyPrefix+"exchanges", name, kind).Result(); err != nil {
+		return fmt.Errorf("error declaring exchange %v: %v", name, err)
+	}
+	declared, err := b.exchangeKind(name)
+	if err != nil {
+		return err
+	}
+	if declared != kind {
+		return fmt.Errorf("error declaring exchange %v: already declared as %v", name, declared)
+	}
+	return nil
+}
+
+// exchangeKind returns the kind of an exchange, or an empty string if it does not exist
+func (b *Broker) exchangeKind(name string) (string, error) {
+	b.sync.Lock()
+	kind, ok := b.exchanges[name]
+	b.sync.Unlock()
+	if ok {
+		return kind, nil
+	}
+	kind, err := b.client.HGet(context.TODO(), keyPrefix+"exchanges", name).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading exchange %v: %v", name, err)
+	}
+	b.sync.Lock()
+	b.exchanges[name] = kind
+	b.sync.Unlock()
+	return kind, nil
+}
+
+// DeclareQueue creates the stream of a queue and its consumer group, generating its name if empty; exclusive queues
+// expire unless their consumer keeps them alive
+func (b *Broker) DeclareQueue(name string, options broker.QueueOptions) (string, error) {
+	if name == "" {
+		name = fmt.Sprintf("exclusive.%v", guid.New().String())
+	}
+	serialized, err := json.Marshal(options)
+	if err != nil {
+		return "", fmt.Errorf("error serializing options of queue %v: %v", name, err)
+	}
+	ctx := context.TODO()
+	if err := b.client.HSet(ctx, keyPrefix+"queues", name, string(serialized)).Err(); err != nil {
+		return "", fmt.Errorf("error declaring queue %v: %v", name, err)
+	}
+	if options.MessageTTL <= 0 {
+		err := b.client.XGroupCreateMkStream(ctx, streamKey(name), group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return "", fmt.Errorf("error creating consumer group of queue %v: %v", name, err)
+		}
+		if options.Exclusive {
+			if err := b.client.Expire(ctx, streamKey(name), exclusiveTTL).Err(); err != nil {
+				return "", fmt.Errorf("error setting expiration of queue %v: %v", name, err)
+			}
+		}
+	}
+
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	b.queues[name] = options
+	if options.MessageTTL > 0 && !b.promoting[name] {
+		b.promoting[name] = true
+		b.wait.Add(1)
+		go b.promote(name, options)
+	}
+	return name, nil
+}
+
+// queueOptions returns the options a queue was declared with, and whether it exists
+func (b *Broker) queueOptions(name string) (broker.QueueOptions, bool, error) {
+	b.sync.Lock()
+	options, ok := b.queues[name]
+	b.sync.Unlock()
+	if ok {
+		return options, true, nil
+	}
+	serialized, err := b.client.HGet(context.TODO(), keyPrefix+"queues", name).Result()
+	if err == redis.Nil {
+		return options, false, nil
+	}
+	if err != nil {
+		return options, false, fmt.Errorf("error reading queue %v: %v", name, err)
+	}
+	if err := json.Unmarshal([]byte(serialized), &options); err != nil {
+		return options, false, fmt.Errorf("error deserializing options of queue %v: %v", name, err)
+	}
+	b.sync.Lock()
+	b.queues[name] = options
+	b.sync.Unlock()
+	return options, true, nil
+}
+
+// BindQueue routes the messages an exchange receives with key to a queue
+func (b *Broker) BindQueue(queue, exchange, key string) error {
+	if err := b.client.SAdd(context.TODO(), bindingsKey(exchange), queue+"\n"+key).Err(); err != nil {
+		return fmt.Errorf("error binding queue %v to exchange %v: %v", queue, exchange, err)
+	}
+	b.sync.Lock()
+	defer b.sync.Unlock()
+	for cached := range b.routes {
+		if strings.HasPrefix(cached, exchange+"\n") {
+			delete(b.routes, cached)
+		}
+	}
+	return nil
+}
+
+// route returns the queues a message published to exchange with routingKey goes to
+func (b *Broker) route(exchange, routingKey string) ([]string, error) {
+	if exchange == "" {
+		_, ok, err := b.queueOptions(routingKey)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return []string{routingKey}, nil
+	}
+	kind, err := b.exchangeKind(exchange)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "" {
+		return nil, fmt.Errorf("error publishing message: exchange %v not found", exchange)
+	}
+	cacheKey := exchange + "\n" + routingKey
+	if kind == broker.ExchangeDirect {
+		b.sync.Lock()
+		cached, ok := b.routes[cacheKey]
+		b.sync.Unlock()
+		if ok && time.Now().Before(cached.expires) {
+			return cached.queues, nil
+		}
+	}
+
+	ctx := context.TODO()
+	bindings, err := b.client.SMembers(ctx, bindingsKey(exchange)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading bindings of exchange %v: %v", exchange, err)
+	}
+	result := make([]string, 0, len(bindings))
+	routed := make(map[string]bool, len(bindings))
+	for _, bound := range bindings {
+		parts := strings.SplitN(bound, "\n", 2)
+		if len(parts) != 2 || routed[parts[0]] || (kind == broker.ExchangeDirect && parts[1] != routingKey) {
+			continue
+		}
+		routed[parts[0]] = true
+		result = append(result, parts[0])
+	}
+	if kind == broker.ExchangeDirect {
+		b.sync.Lock()
+		b.routes[cacheKey] = route{queues: result, expires: time.Now().Add(routesTTL)}
+		b.sync.Unlock()
+		return result, nil
+	}
+
+	// exclusive queues are removed by their consumers, or expire if they crash; their bindings are removed here
+	alive := result[:0]
+	for _, queue := range result {
+		options, ok, err := b.queueOptions(queue)
+		if err != nil {
+			return nil, err
+		}
+		if ok && options.Exclusive {
+			exists, err := b.client.Exists(ctx, streamKey(queue)).Result()
+			if err != nil {
+				return nil, fmt.Errorf("error checking queue %v: %v", queue, err)
+			}
+			ok = exists > 0
+		}
+		if !ok {
+			b.unbind(exchange, queue, bindings)
+			continue
+		}
+		alive = append(alive, queue)
+	}
+	return alive, nil
+}
+
+// unbind removes every binding of a queue that no longer exists from an exchange
+func (b *Broker) unbind(exchange, queue string, bindings []string) {
+	ctx := context.TODO()
+	for _, bound := range bindings {
+		if strings.HasPrefix(bound, queue+"\n") {
+			b.client.SRem(ctx, bindingsKey(exchange), bound)
+		}
+	}
+	b.client.HDel(ctx, keyPrefix+"queues", queue)
+	b.sync.Lock()
+	delete(b.queues, queue)
+	b.sync.Unlock()
+}
+
+// Publish routes a message into the queues bound to the exchange within a transaction; messages routed nowhere are
+// rejected. The confirmation is resolved by the time Publish returns
+func (b *Broker) Publish(exchange, routingKey string, body []byte, headers map[string]interface{}) broker.Confirmation {
+	queues, err := b.route(exchange, routingKey)
+	if err != nil {
+		return broker.Resolved(err)
+	}
+	if len(queues) == 0 {
+		return broker.Resolved(broker.ErrUnroutable)
+	}
+	return broker.Resolved(b.enqueue(queues, message{
+		Body:       body,
+		Headers:    headers,
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+	}))
+}
+
+// enqueue adds a message to the streams of the queues, or to their sorted set if they are delay queues
+func (b *Broker) enqueue(queues []string, m message) error {
+	fields, err := m.fields()
+	if err != nil {
+		return err
+	}
+	delays := make(map[string]time.Duration, len(queues))
+	for _, queue := range queues {
+		options, _, err := b.queueOptions(queue)
+		if err != nil {
+			return err
+		}
+		delays[queue] = options.MessageTTL
+	}
+	ctx := context.TODO()
+	_, err = b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, queue := range queues {
+			if delays[queue] <= 0 {
+				pipe.XAdd(ctx, &redis.XAddArgs{Stream: streamKey(queue), Values: fields})
+				continue
+			}
+			delayed := m
+			delayed.ID = guid.New().String()
+			member, err := json.Marshal(delayed)
+			if err != nil {
+				return fmt.Errorf("error serializing delayed message: %v", err)
+			}
+			due := time.Now().Add(delays[queue]).UnixNano() / int64(time.Millisecond)
+			pipe.ZAdd(ctx, delayedKey(queue), &redis.Z{Score: float64(due), Member: string(member)})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error publishing message: %v", err)
+	}
+	return nil
+}
+
+// deadLetter routes a rejected message to the dead-letter exchange of its queue, or drops it
+func (b *Broker) deadLetter(queue string, m message) error {
+	options, _, err := b.queueOptions(queue)
+	if err != nil {
+		return err
+	}
+	if options.DeadLetterExchange == nil {
+		log.Debugf("dropping message of queue %v", queue)
+		return nil
+	}
+	routingKey := options.DeadLetterRoutingKey
+	if routingKey == "" {
+		routingKey = m.RoutingKey
+	}
+	queues, err := b.route(*options.DeadLetterExchange, routingKey)
+	if err != nil {
+		return err
+	}
+	if len(queues) == 0 {
+		return nil
+	}
+	m.Exchange = *options.DeadLetterExchange
+	m.RoutingKey = routingKey
+	m.Redelivered = false
+	return b.enqueue(queues, m)
+}
+
+// promote moves the expired messages of a delay queue to its dead-letter exchange until the broker is closed; every
+// broker declaring the queue promotes its messages, and the script makes sure each one is moved once
+func (b *Broker) promote(queue string, options broker.QueueOptions) {
+	defer b.wait.Done()
+	ticker := time.NewTicker(promoteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.closed:
+			return
+		case <-ticker.C:
+		}
+		if err := b.promoteExpired(queue, options); err != nil {
+			log.Errorf("error promoting messages of delay queue %v: %v", queue, err)
+		}
+	}
+}
+
+func (b *Broker) promoteExpired(queue string, options broker.QueueOptions) error {
+	ctx := context.TODO()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	members, err := b.client.ZRangeByScore(ctx, delayedKey(queue), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: 100,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	if options.DeadLetterExchange == nil {
+		if len(members) > 0 {
+			ids := make([]interface{}, 0, len(members))
+			for _, member := range members {
+				ids = append(ids, member)
+			}
+			return b.client.ZRem(ctx, delayedKey(queue), ids...).Err()
+		}
+		return nil
+	}
+	for _, member := range members {
+		var m message
+		if err := json.Unmarshal([]byte(member), &m); err != nil {
+			log.Errorf("dropping undecodable message of delay queue %v: %v", queue, err)
+			b.client.ZRem(ctx, delayedKey(queue), member)
+			continue
+		}
+		routingKey := options.DeadLetterRoutingKey
+		if routingKey == "" {
+			routingKey = m.RoutingKey
+		}
+		queues, err := b.route(*options.DeadLetterExchange, routingKey)
+		if err != nil {
+			return err
+		}
+		m.ID = ""
+		m.Exchange = *options.DeadLetterExchange
+		m.RoutingKey = routingKey
+		fields, err := m.fields()
+		if err != nil {
+			return err
+		}
+		keys := []string{delayedKey(queue)}
+		for _, target := range queues {
+			keys = append(keys, streamKey(target))
+		}
+		if err := promoteScript.Run(ctx, b.client, keys, append([]interface{}{member}, fields...)...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Consume creates a consumer of a queue, declaring the retry topology of the queue if the options need it
+func (b *Broker) Consume(queue, tag string, options broker.ConsumerOptions) (broker.Consumer, error) {
+	queueOptions, ok, err := b.queueOptions(queue)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("error consuming queue %v: queue not found", queue)
+	}
+	if queueOptions.MessageTTL > 0 {
+		return nil, fmt.Errorf("error consuming queue %v: delay queues cannot be consumed", queue)
+	}
+	if options.Retry != nil {
+		if err := broker.DeclareRetry(b, queue, options.Retry); err != nil {
+			return nil, err
+		}
+	}
+	return newConsumer(b, queue, tag, queueOptions, options), nil
+}
+
+// Close stops promoting delay queues and closes the connection to redis
+func (b *Broker) Close() error {
+	b.sync.Lock()
+	select {
+	case <-b.closed:
+		b.sync.Unlock()
+		return nil
+	default:
+		close(b.closed)
+	}
+	b.sync.Unlock()
+	b.wait.Wait()
+	return b.client.Close()
+}
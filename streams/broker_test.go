@@ -0,0 +1,87 @@
+package streams
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{name: "empty", content: "", want: map[string]interface{}{}},
+		{name: "integer", content: `{"x-attempts":3}`, want: map[string]interface{}{"x-attempts": int64(3)}},
+		{name: "float", content: `{"ratio":0.5}`, want: map[string]interface{}{"ratio": 0.5}},
+		{name: "string", content: `{"datasource":"customers"}`, want: map[string]interface{}{"datasource": "customers"}},
+		{name: "invalid", content: `{"x-attempts":`, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeHeaders(test.content)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("decodeHeaders() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("decodeHeaders() = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+// entryValues converts the fields of a message to the values redis returns for its stream entry
+func entryValues(t *testing.T, m message) map[string]interface{} {
+	fields, err := m.fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]interface{})
+	for i := 0; i < len(fields); i += 2 {
+		switch value := fields[i+1].(type) {
+		case []byte:
+			result[fields[i].(string)] = string(value)
+		default:
+			result[fields[i].(string)] = value
+		}
+	}
+	return result
+}
+
+func TestMessageEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		message message
+	}{
+		{name: "plain", message: message{Body: []byte(`{"id":1}`), Headers: map[string]interface{}{}, Exchange: "gotransform", RoutingKey: "orders.extracted"}},
+		{name: "redelivered", message: message{Body: []byte("eos"), Headers: map[string]interface{}{"sequence": int64(7)}, Redelivered: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := fromEntry(entryValues(t, test.message))
+			if err != nil {
+				t.Fatalf("fromEntry() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.message) {
+				t.Errorf("fromEntry() = %#v, want %#v", got, test.message)
+			}
+		})
+	}
+}
+
+func TestKeys(t *testing.T) {
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{streamKey("orders.extracted"), "gotransform:broker:queue:orders.extracted"},
+		{delayedKey("orders.extracted"), "gotransform:broker:delayed:orders.extracted"},
+		{bindingsKey("gotransform"), "gotransform:broker:bindings:gotransform"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("key = %v, want %v", test.got, test.want)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package streams
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ezeriver94/gotransform/broker"
+)
+
+const (
+	// readBlock is the time a read waits for new messages before checking whether the consumer stopped
+	readBlock = time.Second
+
+	// reclaimInterval is the time between checks for messages of crashed consumers
+	reclaimInterval = 10 * time.Second
+)
+
+// entry is a message delivered to a consumer and not settled yet
+type entry struct {
+	id      string
+	message message
+}
+
+// consumer reads the stream of a queue as a member of its consumer group, named after its tag
+type consumer struct {
+	broker       *Broker
+	queue        string
+	tag          string
+	queueOptions broker.QueueOptions
+	dispatcher   broker.Dispatcher
+	prefetch     int
+	deliveries   chan broker.Delivery
+	unacked      map[uint64]entry
+	next         uint64
+	settled      chan struct{}
+	processing   bool
+	cancelled    bool
+	stopped      chan struct{}
+	done         chan struct{}
+	once         sync.Once
+	sync         sync.Mutex
+}
+
+func newConsumer(b *Broker, queue, tag string, queueOptions broker.QueueOptions, options broker.ConsumerOptions) *consumer {
+	return &consumer{
+		broker:       b,
+		queue:        queue,
+		tag:          tag,
+		queueOptions: queueOptions,
+		dispatcher: broker.Dispatcher{
+			Queue:   queue,
+			Options: options,
+			Publish: func(exchange, routingKey string, body []byte, headers map[string]interface{}) error {
+				return b.Publish(exchange, routingKey, body, headers).Wait()
+			},
+		},
+		prefetch:   options.PrefetchCount(),
+		deliveries: make(chan broker.Delivery, options.PrefetchCount()),
+		unacked:    make(map[uint64]entry),
+		settled:    make(chan struct{}, 1),
+		stopped:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Process handles the messages of the queue until ctx is cancelled or the consumer is shut down
+func (c *consumer) Process(ctx context.Context, handler broker.Handler) error {
+	c.sync.Lock()
+	if c.cancelled {
+		c.sync.Unlock()
+		return broker.ErrClosed
+	}
+	if c.processing {
+		c.sync.Unlock()
+		return fmt.Errorf("consumer %v is already processing", c.tag)
+	}
+	c.processing = true
+	c.sync.Unlock()
+	defer close(c.done)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.stopped:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		c.read(ctx)
+	}()
+	c.dispatcher.Dispatch(ctx, c.deliveries, handler)
+	<-read
+	return nil
+}
+
+// read delivers the messages of the stream while the consumer has prefetch left: first the ones delivered to it before
+// and never acked, as when it restarts after a crash, then new ones, and periodically the ones of crashed consumers
+func (c *consumer) read(ctx context.Context) {
+	start := "0"
+	reclaimed := time.Now()
+	refreshed := time.Time{}
+	for ctx.Err() == nil {
+		available := c.available()
+		if available == 0 {
+			select {
+			case <-c.settled:
+			case <-ctx.Done():
+			}
+			continue
+		}
+		if c.queueOptions.Exclusive && time.Since(refreshed) >= exclusiveTTL/4 {
+			refreshed = time.Now()
+			if err := c.broker.client.Expire(context.TODO(), streamKey(c.queue), exclusiveTTL).Err(); err != nil {
+				log.Errorf("error keeping queue %v alive: %v", c.queue, err)
+			}
+		}
+		if start == ">" && time.Since(reclaimed) >= reclaimInterval {
+			reclaimed = time.Now()
+			if err := c.reclaim(available); err != nil {
+				log.Errorf("error reclaiming messages of queue %v: %v", c.queue, err)
+			}
+			continue
+		}
+		streams, err := c.broker.client.XReadGroup(context.TODO(), &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: c.tag,
+			Streams:  []string{streamKey(c.queue), start},
+			Count:    int64(available),
+			Block:    readBlock,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Errorf("error reading queue %v: %v", c.queue, err)
+			select {
+			case <-time.After(readBlock):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		delivered := 0
+		for _, stream := range streams {
+			for _, received := range stream.Messages {
+				c.deliver(received, start != ">")
+				delivered++
+				if start != ">" {
+					start = received.ID
+				}
+			}
+		}
+		if start != ">" && delivered == 0 {
+			// every message left by a previous run was delivered again
+			start = ">"
+		}
+	}
+}
+
+// available returns how many messages can be delivered without exceeding the prefetch
+func (c *consumer) available() int {
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	if c.cancelled {
+		return 0
+	}
+	return c.prefetch - len(c.unacked)
+}
+
+// reclaim claims the messages that other consumers of the queue did not ack for the reclaim idle time of the broker
+func (c *consumer) reclaim(available int) error {
+	ctx := context.TODO()
+	pending, err := c.broker.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: streamKey(c.queue),
+		Group:  group,
+		Start:  "-",
+		End:    "+",
+		Count:  100,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, available)
+	for _, candidate := range pending {
+		if len(ids) == available {
+			break
+		}
+		if candidate.Consumer != c.tag && candidate.Idle >= c.broker.ReclaimIdle {
+			ids = append(ids, candidate.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	claimed, err := c.broker.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   streamKey(c.queue),
+		Group:    group,
+		Consumer: c.tag,
+		MinIdle:  c.broker.ReclaimIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, received := range claimed {
+		log.Warnf("consumer %v claimed message %v of queue %v, idle for more than %v", c.tag, received.ID, c.queue, c.broker.ReclaimIdle)
+		c.deliver(received, true)
+	}
+	return nil
+}
+
+// deliver registers a message as unacked and sends it to the handlers
+func (c *consumer) deliver(received redis.XMessage, redelivered bool) {
+	m, err := fromEntry(received.Values)
+	if err != nil {
+		log.Errorf("dropping undecodable message %v of queue %v: %v", received.ID, c.queue, err)
+		c.settle(received.ID)
+		return
+	}
+	c.sync.Lock()
+	c.next++
+	tag := c.next
+	c.unacked[tag] = entry{id: received.ID, message: m}
+	c.sync.Unlock()
+	// deliveries is buffered up to the prefetch, so this never blocks
+	c.deliveries <- broker.Delivery{
+		Body:         m.Body,
+		Headers:      m.Headers,
+		Exchange:     m.Exchange,
+		RoutingKey:   m.RoutingKey,
+		Redelivered:  m.Redelivered || redelivered,
+		DeliveryTag:  tag,
+		Acknowledger: c,
+	}
+}
+
+// settle acks a stream entry and removes it, so streams only hold pending messages
+func (c *consumer) settle(id string) error {
+	ctx := context.TODO()
+	_, err := c.broker.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, streamKey(c.queue), group, id)
+		pipe.XDel(ctx, streamKey(c.queue), id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error acking message %v of queue %v: %v", id, c.queue, err)
+	}
+	return nil
+}
+
+// take removes a delivery from the unacked ones
+func (c *consumer) take(tag uint64) (entry, bool) {
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	delivered, ok := c.unacked[tag]
+	delete(c.unacked, tag)
+	select {
+	case c.settled <- struct{}{}:
+	default:
+	}
+	return delivered, ok
+}
+
+// Ack removes a delivered message from the queue
+func (c *consumer) Ack(tag uint64) error {
+	delivered, ok := c.take(tag)
+	if !ok {
+		return broker.ErrUnknownDelivery
+	}
+	return c.settle(delivered.id)
+}
+
+// Nack adds a delivered message again at the end of the queue, or dead-letters it
+func (c *consumer) Nack(tag uint64, requeue bool) error {
+	delivered, ok := c.take(tag)
+	if !ok {
+		return broker.ErrUnknownDelivery
+	}
+	if requeue {
+		return c.requeue(delivered)
+	}
+	if err := c.broker.deadLetter(c.queue, delivered.message); err != nil {
+		return err
+	}
+	return c.settle(delivered.id)
+}
+
+// requeue replaces a stream entry with a copy marked as redelivered at the end of the stream
+func (c *consumer) requeue(delivered entry) error {
+	delivered.message.Redelivered = true
+	fields, err := delivered.message.fields()
+	if err != nil {
+		return err
+	}
+	ctx := context.TODO()
+	_, err = c.broker.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: streamKey(c.queue), Values: fields})
+		pipe.XAck(ctx, streamKey(c.queue), group, delivered.id)
+		pipe.XDel(ctx, streamKey(c.queue), delivered.id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error requeueing message %v of queue %v: %v", delivered.id, c.queue, err)
+	}
+	return nil
+}
+
+// FinalAttempt indicates whether a failure processing the delivery would be the last one
+func (c *consumer) FinalAttempt(delivery broker.Delivery) bool {
+	return c.dispatcher.FinalAttempt(delivery)
+}
+
+// Shutdown stops the consumer, waiting for the messages being processed, and requeues the messages it did not ack;
+// exclusive queues are removed along with their consumer
+func (c *consumer) Shutdown() error {
+	var result error
+	c.once.Do(func() {
+		c.sync.Lock()
+		c.cancelled = true
+		processing := c.processing
+		c.sync.Unlock()
+		close(c.stopped)
+		if processing {
+			<-c.done
+		}
+
+		c.sync.Lock()
+		tags := make([]uint64, 0, len(c.unacked))
+		for tag := range c.unacked {
+			tags = append(tags, tag)
+		}
+		c.sync.Unlock()
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+		for _, tag := range tags {
+			if err := c.Nack(tag, true); err != nil && result == nil {
+				result = err
+			}
+		}
+
+		ctx := context.TODO()
+		if c.queueOptions.Exclusive {
+			if err := c.broker.client.Del(ctx, streamKey(c.queue)).Err(); err != nil && result == nil {
+				result = fmt.Errorf("error deleting queue %v: %v", c.queue, err)
+			}
+			c.broker.client.HDel(ctx, keyPrefix+"queues", c.queue)
+			c.broker.sync.Lock()
+			delete(c.broker.queues, c.queue)
+			c.broker.sync.Unlock()
+			return
+		}
+		if result != nil {
+			// removing the consumer would drop the messages that could not be requeued
+			return
+		}
+		if err := c.broker.client.XGroupDelConsumer(ctx, streamKey(c.queue), group, c.tag).Err(); err != nil {
+			result = fmt.Errorf("error removing consumer %v of queue %v: %v", c.tag, c.queue, err)
+		}
+	})
+	return result
+}
@@ -0,0 +1,52 @@
+package streams
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/ezeriver94/gotransform/broker"
+)
+
+func TestConsumerDeliver(t *testing.T) {
+	c := newConsumer(nil, "orders.extracted", "loader", broker.QueueOptions{}, broker.ConsumerOptions{Prefetch: 2})
+	tests := []struct {
+		name            string
+		message         message
+		redelivered     bool
+		wantRedelivered bool
+	}{
+		{name: "first delivery", message: message{Body: []byte("1"), Headers: map[string]interface{}{}}},
+		{name: "reclaimed", message: message{Body: []byte("2"), Headers: map[string]interface{}{}}, redelivered: true, wantRedelivered: true},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c.deliver(redis.XMessage{ID: test.name, Values: entryValues(t, test.message)}, test.redelivered)
+			delivery := <-c.deliveries
+			if string(delivery.Body) != string(test.message.Body) {
+				t.Errorf("delivered body %s, want %s", delivery.Body, test.message.Body)
+			}
+			if delivery.Redelivered != test.wantRedelivered {
+				t.Errorf("Redelivered = %v, want %v", delivery.Redelivered, test.wantRedelivered)
+			}
+			if delivery.DeliveryTag != uint64(i+1) {
+				t.Errorf("DeliveryTag = %v, want %v", delivery.DeliveryTag, i+1)
+			}
+		})
+	}
+	if got := c.available(); got != 0 {
+		t.Errorf("available() = %v with every prefetched message unacked, want 0", got)
+	}
+	if _, ok := c.take(1); !ok {
+		t.Errorf("take(1) did not find the first delivery")
+	}
+	if got := c.available(); got != 1 {
+		t.Errorf("available() = %v after a delivery was settled, want 1", got)
+	}
+	if err := c.Ack(1); err != broker.ErrUnknownDelivery {
+		t.Errorf("Ack() of a settled delivery = %v, want %v", err, broker.ErrUnknownDelivery)
+	}
+	if err := c.Nack(9, true); err != broker.ErrUnknownDelivery {
+		t.Errorf("Nack() of an unknown delivery = %v, want %v", err, broker.ErrUnknownDelivery)
+	}
+}